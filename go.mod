@@ -1,6 +1,6 @@
 module github.com/pion/ion-examples
 
-go 1.14
+go 1.16
 
 require (
 	github.com/cloudwebrtc/go-protoo v0.0.0-20200926140535-79ecde67b906
@@ -11,8 +11,11 @@ require (
 	github.com/pion/ion-sfu v1.0.24
 	github.com/pion/mediadevices v0.1.14
 	github.com/pion/rtcp v1.2.6
+	github.com/pion/rtp v1.6.2
+	github.com/pion/turn/v2 v2.0.5
 	github.com/pion/webrtc/v2 v2.2.26
 	github.com/pion/webrtc/v3 v3.0.1
+	github.com/rs/zerolog v1.20.0
 	github.com/sourcegraph/jsonrpc2 v0.0.0-20200429184054-15c2290dcb37
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/viper v1.7.1
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pion/ion-log"
+)
+
+// AdminConfig defines parameters for the admin api
+type AdminConfig struct {
+	Token string `mapstructure:"token"`
+}
+
+// adminHandler serves the admin api, every request must carry
+// the configured token as a bearer token.
+func (r *RPC) adminHandler(token string, h *health) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/recordings", func(w http.ResponseWriter, req *http.Request) {
+		var (
+			info RecordingInfo
+			err  error
+		)
+		sid := req.URL.Query().Get("sid")
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, r.Recordings())
+			return
+		case http.MethodPost:
+			if sid == "" {
+				http.Error(w, "missing sid", http.StatusBadRequest)
+				return
+			}
+			info, err = r.record(sid)
+		case http.MethodDelete:
+			if sid == "" {
+				http.Error(w, "missing sid", http.StatusBadRequest)
+				return
+			}
+			info, err = r.stopRecord(sid)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch err {
+		case nil:
+			writeJSON(w, http.StatusOK, info)
+		case errAlreadyRecording, errNotRecording, errRecordCanceled:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Errorf("admin: recording %s: %v", sid, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Infof("draining, /readyz will now fail")
+		h.setDraining()
+		writeJSON(w, http.StatusOK, h.checks())
+	})
+	mux.HandleFunc("/log", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var levels LogLevels
+			if err := json.NewDecoder(req.Body).Decode(&levels); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := logLevels.Set(levels); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Infof("log level set to %s, debug for peers %v sessions %v", levels.Level, levels.Peers, levels.Sessions)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, logLevels.Get())
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("error writing response: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/ion-log"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// Audit message directions
+const (
+	auditIn  = "in"
+	auditOut = "out"
+)
+
+// AuditEntry is a single json-rpc message in the audit log
+type AuditEntry struct {
+	Time   time.Time        `json:"time"`
+	Conn   string           `json:"conn"`
+	Peers  []string         `json:"peers,omitempty"`
+	Dir    string           `json:"dir"`
+	Method string           `json:"method,omitempty"`
+	ID     *jsonrpc2.ID     `json:"id,omitempty"`
+	Params *json.RawMessage `json:"params,omitempty"`
+	Result *json.RawMessage `json:"result,omitempty"`
+	Error  *jsonrpc2.Error  `json:"error,omitempty"`
+}
+
+// AuditLog appends every json-rpc message sent or received
+// to a file, one json object per line.
+type AuditLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewAuditLog opens path for appending
+func NewAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// connOpts hooks the audit log into connection c
+func (a *AuditLog) connOpts(c *connContext) []jsonrpc2.ConnOpt {
+	if a == nil {
+		return nil
+	}
+	return []jsonrpc2.ConnOpt{
+		jsonrpc2.OnRecv(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			// Responses to our requests are never expected, the
+			// server only sends notifications.
+			if req != nil && resp == nil {
+				a.write(c, auditIn, req, nil)
+			}
+		}),
+		jsonrpc2.OnSend(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			a.write(c, auditOut, req, resp)
+		}),
+	}
+}
+
+func (a *AuditLog) write(c *connContext, dir string, req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+	e := AuditEntry{
+		Time:  time.Now(),
+		Conn:  c.cid,
+		Peers: c.peerIDs(),
+		Dir:   dir,
+	}
+	if req != nil {
+		e.Method = req.Method
+		e.Params = req.Params
+		if !req.Notif {
+			id := req.ID
+			e.ID = &id
+		}
+	}
+	if resp != nil {
+		id := resp.ID
+		e.ID = &id
+		e.Result = resp.Result
+		e.Error = resp.Error
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(e); err != nil {
+		log.Errorf("error writing audit log: %v", err)
+	}
+}
+
+// Close the audit log file
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/webrtc/v3"
+	"github.com/sourcegraph/jsonrpc2"
+
+	sfu "github.com/pion/ion-sfu/pkg"
+)
+
+// apiChannelLabel is the data channel ion-sfu takes layer commands on
+const apiChannelLabel = "ion-sfu"
+
+// Data notification sent with a message published on a session's data
+// channel, and message sent to publish one with sendData
+type Data struct {
+	Transport
+	Label string `json:"label"`
+	Data  string `json:"data"`
+	// Binary messages are base64 encoded
+	Binary bool `json:"binary,omitempty"`
+	// From is the peer id of the publisher
+	From string `json:"from,omitempty"`
+}
+
+// message returns the data channel message of d
+func (d Data) message() (webrtc.DataChannelMessage, error) {
+	if !d.Binary {
+		return webrtc.DataChannelMessage{IsString: true, Data: []byte(d.Data)}, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(d.Data)
+	if err != nil {
+		return webrtc.DataChannelMessage{}, err
+	}
+	return webrtc.DataChannelMessage{Data: data}, nil
+}
+
+// channel returns the open data channel of p with label, nil if there is none
+func (p *peerContext) channel(label string) *webrtc.DataChannel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.channels[label]
+}
+
+// onDataChannel bridges a data channel opened by p to the other peers of
+// its session, taking over ion-sfu's handling of its api channel.
+func (r *RPC) onDataChannel(p *peerContext, dc *webrtc.DataChannel) {
+	label := dc.Label()
+	if label == apiChannelLabel {
+		handleAPIChannel(p.peer, dc)
+		return
+	}
+
+	dc.OnOpen(func() {
+		p.mu.Lock()
+		p.channels[label] = dc
+		p.mu.Unlock()
+	})
+	dc.OnClose(func() {
+		p.mu.Lock()
+		if p.channels[label] == dc {
+			delete(p.channels, label)
+		}
+		p.mu.Unlock()
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		r.publishData(p, label, msg)
+	})
+}
+
+// publishData delivers a message to every other connection in the
+// session of from, on their data channel with the same label when they
+// have one and as a data notification otherwise.
+func (r *RPC) publishData(from *peerContext, label string, msg webrtc.DataChannelMessage) {
+	pid, sid := from.ids()
+
+	r.mu.RLock()
+	conns := make(map[*jsonrpc2.Conn][]*peerContext)
+	for q := range r.sessions[sid] {
+		if q.conn != from.conn {
+			conns[q.conn] = append(conns[q.conn], q)
+		}
+	}
+	r.mu.RUnlock()
+
+	for conn, peers := range conns {
+		sent := false
+		for _, q := range peers {
+			dc := q.channel(label)
+			if dc == nil {
+				continue
+			}
+			var err error
+			if msg.IsString {
+				err = dc.SendText(string(msg.Data))
+			} else {
+				err = dc.Send(msg.Data)
+			}
+			if err != nil {
+				log.Errorf("error sending data on %s to %s: %v", label, q.peerID(), err)
+				continue
+			}
+			sent = true
+			break
+		}
+		if sent {
+			continue
+		}
+
+		data := Data{
+			Transport: Transport{Tid: peers[0].tid},
+			Label:     label,
+			From:      pid,
+		}
+		if msg.IsString {
+			data.Data = string(msg.Data)
+		} else {
+			data.Data = base64.StdEncoding.EncodeToString(msg.Data)
+			data.Binary = true
+		}
+		if err := conn.Notify(context.Background(), "data", data); err != nil {
+			log.Errorf("error sending data %s", err)
+		}
+	}
+}
+
+// setRemoteMedia is a command on ion-sfu's api channel
+type setRemoteMedia struct {
+	StreamID string `json:"streamId"`
+	Video    string `json:"video"`
+	Audio    bool   `json:"audio"`
+}
+
+// handleAPIChannel handles ion-sfu's api channel the way ion-sfu does,
+// since a transport only has one data channel handler.
+func handleAPIChannel(t sfu.Transport, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		srm := &setRemoteMedia{}
+		if err := json.Unmarshal(msg.Data, srm); err != nil {
+			log.Errorf("Unmarshal api command err: %v", err)
+			return
+		}
+
+		for _, sender := range t.GetSenders(srm.StreamID) {
+			switch sender.Kind() {
+			case webrtc.RTPCodecTypeAudio:
+				sender.Mute(!srm.Audio)
+			case webrtc.RTPCodecTypeVideo:
+				switch srm.Video {
+				case "high":
+					sender.Mute(false)
+					sender.SwitchSpatialLayer(3)
+				case "medium":
+					sender.Mute(false)
+					sender.SwitchSpatialLayer(2)
+				case "low":
+					sender.Mute(false)
+					sender.SwitchSpatialLayer(1)
+				case "none":
+					sender.Mute(true)
+				}
+			}
+		}
+	})
+}
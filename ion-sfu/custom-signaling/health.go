@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certExpiryMargin is how long before expiry the certificate stops being ready
+const certExpiryMargin = 7 * 24 * time.Hour
+
+var errSFUStarting = errors.New("sfu not initialized yet")
+
+// HealthConfig defines how the node drains on shutdown
+type HealthConfig struct {
+	// Grace in seconds /readyz fails on SIGTERM or SIGINT before the
+	// server stops accepting connections
+	Grace int `mapstructure:"grace"`
+}
+
+// Check is the result of a single readiness check
+type Check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Status reports whether the node can serve traffic
+type Status struct {
+	OK     bool    `json:"ok"`
+	Checks []Check `json:"checks,omitempty"`
+}
+
+// health tracks the state readiness depends on
+type health struct {
+	draining int32
+	certFile string
+	keyFile  string
+
+	mu         sync.Mutex
+	components []component
+}
+
+// component is the outcome of starting a part of the node
+type component struct {
+	name string
+	err  error
+}
+
+// set records the outcome of starting component name, replacing the
+// previous one, a nil err marks it ready
+func (h *health) set(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.components {
+		if h.components[i].name == name {
+			h.components[i].err = err
+			return
+		}
+	}
+	h.components = append(h.components, component{name: name, err: err})
+}
+
+func (h *health) setDraining() { atomic.StoreInt32(&h.draining, 1) }
+
+func (h *health) checks() Status {
+	var checks []Check
+	h.mu.Lock()
+	for _, c := range h.components {
+		check := Check{Name: c.name, OK: c.err == nil}
+		if c.err != nil {
+			check.Error = c.err.Error()
+		}
+		checks = append(checks, check)
+	}
+	h.mu.Unlock()
+
+	draining := Check{Name: "draining", OK: atomic.LoadInt32(&h.draining) == 0}
+	if !draining.OK {
+		draining.Error = "node is draining"
+	}
+	checks = append(checks, draining, h.checkCert())
+
+	ok := true
+	for _, c := range checks {
+		ok = ok && c.OK
+	}
+	return Status{OK: ok, Checks: checks}
+}
+
+func (h *health) checkCert() Check {
+	c := Check{Name: "tls"}
+	pair, err := tls.LoadX509KeyPair(h.certFile, h.keyFile)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		c.Error = fmt.Sprintf("certificate not valid before %s", cert.NotBefore)
+	case now.Add(certExpiryMargin).After(cert.NotAfter):
+		c.Error = fmt.Sprintf("certificate expires %s", cert.NotAfter)
+	default:
+		c.OK = true
+	}
+	return c
+}
+
+// healthzHandler reports the process is alive
+func (h *health) healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Status{OK: true})
+	})
+}
+
+// readyzHandler reports whether the node should receive new peers
+func (h *health) readyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := h.checks()
+		code := http.StatusOK
+		if !res.OK {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, res)
+	})
+}
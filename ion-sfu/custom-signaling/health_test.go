@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate valid for validFor to dir
+func writeCert(t *testing.T, dir string, validFor time.Duration) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestHealthChecks(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir(), 30*24*time.Hour)
+	h := &health{certFile: certFile, keyFile: keyFile}
+
+	h.set("config", nil)
+	h.set("turn", errors.New("listen udp4: address already in use"))
+	if res := h.checks(); res.OK {
+		t.Fatalf("ready with a failed component: %+v", res)
+	}
+
+	// a later outcome replaces the failure
+	h.set("turn", nil)
+	res := h.checks()
+	if !res.OK {
+		t.Fatalf("not ready: %+v", res)
+	}
+	var names []string
+	for _, c := range res.Checks {
+		names = append(names, c.Name)
+	}
+	if want := []string{"config", "turn", "draining", "tls"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got checks %v, want %v", names, want)
+	}
+
+	h.setDraining()
+	if res := h.checks(); res.OK {
+		t.Fatalf("ready while draining: %+v", res)
+	}
+}
+
+func TestHealthCertExpiring(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir(), 24*time.Hour)
+	h := &health{certFile: certFile, keyFile: keyFile}
+	if c := h.checkCert(); c.OK {
+		t.Fatalf("certificate expiring within %s passed: %+v", certExpiryMargin, c)
+	}
+}
@@ -72,6 +72,11 @@ pc.onicecandidate = (event) => {
 socket.addEventListener("message", async (event) => {
   const resp = JSON.parse(event.data);
 
+  // Listen for the server closing this peer
+  if (!resp.id && resp.method === "close") {
+    log(`Peer closed by server: ${resp.params.reason}`);
+  }
+
   // Listen for server renegotiation notifications
   if (!resp.id && resp.method === "offer") {
     log(`Got offer notification`);
@@ -137,6 +142,12 @@ const join = async () => {
       log(`setRemoteDescription`);
       // log(resp)
       pc.setRemoteDescription(resp.result);
+
+      // Use the server's TURN server from the next ICE restart on
+      if (resp.result.iceServers) {
+        log("Received ice servers");
+        pc.setConfiguration({ ...pc.getConfiguration(), iceServers: resp.result.iceServers });
+      }
     } else if (resp.method == "trickle") {
       log("receive trickle");
       pc.addIceCandidate(resp.params);
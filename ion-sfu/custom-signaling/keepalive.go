@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/ion-log"
+)
+
+// WebsocketConfig defines keepalive parameters for the /ws endpoint
+type WebsocketConfig struct {
+	// PingInterval in seconds between pings, zero disables heartbeats
+	PingInterval int `mapstructure:"pinginterval"`
+	// PongTimeout in seconds without a pong or message before the connection is closed
+	PongTimeout int `mapstructure:"pongtimeout"`
+	// WriteTimeout in seconds for a single json-rpc message or ping
+	WriteTimeout int `mapstructure:"writetimeout"`
+}
+
+// keepaliveStream is a json-rpc object stream over a websocket that
+// pings the client and gives up on connections that stop answering.
+type keepaliveStream struct {
+	conn   *websocket.Conn
+	config WebsocketConfig
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newKeepaliveStream starts heartbeats on conn, they stop when the stream is closed
+func newKeepaliveStream(conn *websocket.Conn, config WebsocketConfig) *keepaliveStream {
+	s := &keepaliveStream{
+		conn:   conn,
+		config: config,
+		done:   make(chan struct{}),
+	}
+
+	if config.PingInterval > 0 && config.PongTimeout > 0 {
+		s.extendReadDeadline()
+		conn.SetPongHandler(func(string) error {
+			s.extendReadDeadline()
+			return nil
+		})
+		go s.ping()
+	}
+	return s
+}
+
+func (s *keepaliveStream) extendReadDeadline() {
+	_ = s.conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.PongTimeout) * time.Second))
+}
+
+func (s *keepaliveStream) writeDeadline() time.Time {
+	if s.config.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(s.config.WriteTimeout) * time.Second)
+}
+
+func (s *keepaliveStream) ping() {
+	ticker := time.NewTicker(time.Duration(s.config.PingInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, s.writeDeadline()); err != nil {
+				log.Infof("websocket ping failed, closing: %s", err)
+				_ = s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// WriteObject implements jsonrpc2.ObjectStream, a write that times out
+// closes the connection since the websocket can't be written to anymore.
+func (s *keepaliveStream) WriteObject(obj interface{}) error {
+	_ = s.conn.SetWriteDeadline(s.writeDeadline())
+	if err := s.conn.WriteJSON(obj); err != nil {
+		_ = s.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// ReadObject implements jsonrpc2.ObjectStream, any message from the
+// client counts as a sign of life.
+func (s *keepaliveStream) ReadObject(v interface{}) error {
+	err := s.conn.ReadJSON(v)
+	if e, ok := err.(*websocket.CloseError); ok {
+		if e.Code == websocket.CloseAbnormalClosure && e.Text == io.ErrUnexpectedEOF.Error() {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	if err == nil && s.config.PingInterval > 0 && s.config.PongTimeout > 0 {
+		s.extendReadDeadline()
+	}
+	return err
+}
+
+// Close implements jsonrpc2.ObjectStream
+func (s *keepaliveStream) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return s.conn.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveKeepalive serves a single websocket as a keepalive stream with
+// config, handled by handle, and returns the client end
+func serveKeepalive(t *testing.T, config WebsocketConfig, handle func(s *keepaliveStream)) *websocket.Conn {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("websocket upgrade: %v", err)
+			return
+		}
+		s := newKeepaliveStream(c, config)
+		defer s.Close()
+		handle(s)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+// readUntilClosed reads from s until it fails, and sends how long that took
+func readUntilClosed(s *keepaliveStream, closed chan<- time.Duration) {
+	start := time.Now()
+	var v interface{}
+	for s.ReadObject(&v) == nil {
+	}
+	closed <- time.Since(start)
+}
+
+func TestKeepalivePongTimeout(t *testing.T) {
+	config := WebsocketConfig{PingInterval: 1, PongTimeout: 2, WriteTimeout: 1}
+	closed := make(chan time.Duration, 1)
+
+	// The client never reads, so it never answers the pings
+	serveKeepalive(t, config, func(s *keepaliveStream) {
+		readUntilClosed(s, closed)
+	})
+
+	select {
+	case d := <-closed:
+		if d < 2*time.Second-100*time.Millisecond {
+			t.Errorf("closed after %s, before the pong timeout", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still open after the pong timeout")
+	}
+}
+
+func TestKeepaliveAnswered(t *testing.T) {
+	config := WebsocketConfig{PingInterval: 1, PongTimeout: 2, WriteTimeout: 1}
+	closed := make(chan time.Duration, 1)
+
+	client := serveKeepalive(t, config, func(s *keepaliveStream) {
+		readUntilClosed(s, closed)
+	})
+	// Reading answers the pings
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case d := <-closed:
+		t.Fatalf("connection answering pings closed after %s", d)
+	case <-time.After(3500 * time.Millisecond):
+	}
+}
+
+func TestKeepaliveWriteTimeout(t *testing.T) {
+	config := WebsocketConfig{WriteTimeout: 1}
+	failed := make(chan error, 1)
+	closed := make(chan time.Duration, 1)
+
+	// The client never reads, so writes stall once the socket buffers
+	// are full
+	serveKeepalive(t, config, func(s *keepaliveStream) {
+		msg := strings.Repeat("x", 1<<20)
+		var err error
+		for err == nil {
+			err = s.WriteObject(msg)
+		}
+		failed <- err
+		readUntilClosed(s, closed)
+	})
+
+	select {
+	case err := <-failed:
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Errorf("got %v, want a timeout", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stalled write didn't time out")
+	}
+
+	// The connection is closed along with the failed write
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection still open after the write timed out")
+	}
+}
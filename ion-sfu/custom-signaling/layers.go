@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	sfu "github.com/pion/ion-sfu/pkg"
+)
+
+// Simulcast layers as seen by clients, lowest resolution first. The sfu
+// numbers spatial layers from 1, its layer 0 being non simulcast tracks.
+const (
+	maxSpatialLayer  = 2
+	maxTemporalLayer = 3
+)
+
+func sfuLayer(spatial uint8) uint8 {
+	return spatial + 1
+}
+
+func clientLayer(layer uint8) uint8 {
+	if layer == 0 {
+		return 0
+	}
+	return layer - 1
+}
+
+var errNoSimulcastTrack = errors.New("no simulcast video track for stream")
+
+// LayersConfig defines how subscribers' simulcast layers are selected
+type LayersConfig struct {
+	// Bitrates in kbps each spatial layer is expected to need, lowest
+	// layer first, used to pick layers for setMaxBitrate
+	Bitrates []uint64 `mapstructure:"bitrates"`
+	// Interval in ms layers are checked for changes
+	Interval int `mapstructure:"interval"`
+}
+
+// Layer message sent to prefer simulcast layers of a subscribed stream
+type Layer struct {
+	Transport
+	StreamID string `json:"streamId"`
+	Spatial  uint8  `json:"spatial"`
+	Temporal *uint8 `json:"temporal,omitempty"`
+}
+
+// MaxBitrate message sent to cap the bitrate of a subscribed stream
+type MaxBitrate struct {
+	Transport
+	StreamID string `json:"streamId"`
+	// Bitrate in kbps, zero removes the cap
+	Bitrate uint64 `json:"bitrate"`
+}
+
+// LayerChanged notification sent when the sfu switched the layers of a stream
+type LayerChanged struct {
+	Transport
+	StreamID string `json:"streamId"`
+	Spatial  uint8  `json:"spatial"`
+	Temporal uint8  `json:"temporal"`
+}
+
+// how long a preferred layer is switched to before giving up, the sfu
+// drops switches while another one is in progress
+const layerSwitchTimeout = 5 * time.Second
+
+// streamLayers is what a subscriber asked for a stream
+type streamLayers struct {
+	preferred  uint8
+	temporal   uint8
+	maxBitrate uint64
+	current    uint8
+	notified   bool
+	// switching to the target until then, after the subscriber changed it
+	switchUntil time.Time
+}
+
+// layerSelector switches the simulcast senders of a transport to the
+// layers its subscriber asked for, retrying switches the sfu drops while
+// another one is in progress. The target is a ceiling afterwards, the sfu
+// is left to switch below it on its own. Every subscribed stream is
+// watched to report the layers it ends up on.
+type layerSelector struct {
+	peer   *sfu.WebRTCTransport
+	config LayersConfig
+	notify func(LayerChanged)
+	// streams returns the ids of the streams published in the session
+	streams func() []string
+
+	mu     sync.Mutex
+	layers map[string]*streamLayers
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newLayerSelector(peer *sfu.WebRTCTransport, config LayersConfig, streams func() []string, notify func(LayerChanged)) *layerSelector {
+	s := &layerSelector{
+		peer:    peer,
+		config:  config,
+		notify:  notify,
+		streams: streams,
+		layers:  make(map[string]*streamLayers),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// senders returns the simulcast video senders of a stream
+func (s *layerSelector) senders(streamID string) []*sfu.SimulcastSender {
+	var senders []*sfu.SimulcastSender
+	for _, sender := range s.peer.GetSenders(streamID) {
+		if ss, ok := sender.(*sfu.SimulcastSender); ok {
+			senders = append(senders, ss)
+		}
+	}
+	return senders
+}
+
+// stream returns the layers of a stream, s.mu must be held
+func (s *layerSelector) stream(streamID string) *streamLayers {
+	st, ok := s.layers[streamID]
+	if !ok {
+		st = &streamLayers{preferred: maxSpatialLayer, temporal: maxTemporalLayer}
+		s.layers[streamID] = st
+	}
+	return st
+}
+
+// target returns the spatial layer within the preferred layer and the bitrate cap
+func (s *layerSelector) target(st *streamLayers) uint8 {
+	layer := st.preferred
+	if st.maxBitrate == 0 {
+		return layer
+	}
+	for layer > 0 && int(layer) < len(s.config.Bitrates) && s.config.Bitrates[layer] > st.maxBitrate {
+		layer--
+	}
+	return layer
+}
+
+// setPreferred sets the layers of a stream
+func (s *layerSelector) setPreferred(l Layer) error {
+	senders := s.senders(l.StreamID)
+	if len(senders) == 0 {
+		return errNoSimulcastTrack
+	}
+
+	s.mu.Lock()
+	st := s.stream(l.StreamID)
+	st.preferred = l.Spatial
+	if st.preferred > maxSpatialLayer {
+		st.preferred = maxSpatialLayer
+	}
+	if l.Temporal != nil {
+		st.temporal = *l.Temporal
+		if st.temporal > maxTemporalLayer {
+			st.temporal = maxTemporalLayer
+		}
+	}
+	st.switchUntil = time.Now().Add(layerSwitchTimeout)
+	temporal := st.temporal
+	s.mu.Unlock()
+
+	for _, sender := range senders {
+		sender.SwitchTemporalLayer(temporal)
+	}
+	s.apply(l.StreamID)
+	return nil
+}
+
+// setMaxBitrate caps the bitrate of a stream
+func (s *layerSelector) setMaxBitrate(m MaxBitrate) error {
+	if len(s.senders(m.StreamID)) == 0 {
+		return errNoSimulcastTrack
+	}
+
+	s.mu.Lock()
+	st := s.stream(m.StreamID)
+	st.maxBitrate = m.Bitrate
+	st.switchUntil = time.Now().Add(layerSwitchTimeout)
+	s.mu.Unlock()
+
+	s.apply(m.StreamID)
+	return nil
+}
+
+// apply switches the senders of a stream to its target layer while the
+// subscriber's change is in progress, or down to it when the sfu went
+// above it, and notifies the subscriber when the layer changed
+func (s *layerSelector) apply(streamID string) {
+	senders := s.senders(streamID)
+	s.mu.Lock()
+	if len(senders) == 0 {
+		// not subscribed, or the publisher left
+		delete(s.layers, streamID)
+		s.mu.Unlock()
+		return
+	}
+	st := s.stream(streamID)
+	target, temporal := s.target(st), st.temporal
+	switching := time.Now().Before(st.switchUntil)
+	s.mu.Unlock()
+
+	reached := true
+	for _, sender := range senders {
+		layer := clientLayer(sender.CurrentSpatialLayer())
+		if layer == target || layer < target && !switching {
+			continue
+		}
+		sender.SwitchSpatialLayer(sfuLayer(target))
+		reached = false
+	}
+
+	current := clientLayer(senders[0].CurrentSpatialLayer())
+	s.mu.Lock()
+	if reached {
+		st.switchUntil = time.Time{}
+	}
+	changed := !st.notified || st.current != current
+	st.current = current
+	st.notified = true
+	s.mu.Unlock()
+
+	if changed {
+		s.notify(LayerChanged{StreamID: streamID, Spatial: current, Temporal: temporal})
+	}
+}
+
+func (s *layerSelector) run() {
+	interval := time.Duration(s.config.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			streamIDs := make(map[string]struct{})
+			for _, streamID := range s.streams() {
+				streamIDs[streamID] = struct{}{}
+			}
+			s.mu.Lock()
+			for streamID := range s.layers {
+				streamIDs[streamID] = struct{}{}
+			}
+			s.mu.Unlock()
+
+			for streamID := range streamIDs {
+				s.apply(streamID)
+			}
+		}
+	}
+}
+
+// stop checking layers
+func (s *layerSelector) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/candidates"
+	"github.com/pion/ion-log"
+	sfu "github.com/pion/ion-sfu/pkg"
+)
+
+// localPeer joins a peer connection living in this process to a
+// session. Both ends are in the same process, so descriptions and
+// candidates are handed over directly instead of being signaled.
+type localPeer struct {
+	pc   *webrtc.PeerConnection
+	peer *sfu.WebRTCTransport
+	mu   sync.Mutex
+
+	// candidates of each end wait for the other to have a remote description
+	toPC   *candidates.Buffer
+	toPeer *candidates.Buffer
+}
+
+// newLocalPeer joins pc to session sid, pc must already have the
+// transceivers or tracks it wants to negotiate.
+func newLocalPeer(s *sfu.SFU, sid string, pc *webrtc.PeerConnection) (*localPeer, error) {
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	me := sfu.MediaEngine{}
+	if err = me.PopulateFromSDP(offer); err != nil {
+		return nil, err
+	}
+
+	peer, err := s.NewWebRTCTransport(sid, me)
+	if err != nil {
+		return nil, err
+	}
+	l := &localPeer{pc: pc, peer: peer, toPC: candidates.New(pc), toPeer: candidates.New(peer)}
+
+	// Registered before the descriptions are set, which starts gathering
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		if err := l.toPeer.Add(c.ToJSON()); err != nil {
+			log.Errorf("local peer: error adding ice candidate %s", err)
+		}
+	})
+	peer.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		if err := l.toPC.Add(c.ToJSON()); err != nil {
+			log.Errorf("local peer: error adding ice candidate %s", err)
+		}
+	})
+	peer.OnNegotiationNeeded(func() {
+		if err := l.negotiate(); err != nil {
+			log.Errorf("local peer: negotiation error %s", err)
+		}
+	})
+
+	if err = pc.SetLocalDescription(offer); err != nil {
+		_ = peer.Close()
+		return nil, err
+	}
+	if err = l.answer(offer); err != nil {
+		_ = peer.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// answer has the sfu answer an offer from pc
+func (l *localPeer) answer(offer webrtc.SessionDescription) error {
+	if err := l.peer.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	if err := l.toPeer.Flush(); err != nil {
+		log.Errorf("local peer: error adding ice candidate %s", err)
+	}
+	answer, err := l.peer.CreateAnswer()
+	if err != nil {
+		return err
+	}
+	if err = l.peer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	if err = l.pc.SetRemoteDescription(answer); err != nil {
+		return err
+	}
+	if err = l.toPC.Flush(); err != nil {
+		log.Errorf("local peer: error adding ice candidate %s", err)
+	}
+	return nil
+}
+
+// negotiate has pc answer a renegotiation offer from the sfu
+func (l *localPeer) negotiate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	offer, err := l.peer.CreateOffer()
+	if err != nil {
+		return err
+	}
+	if err = l.peer.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	if err = l.pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	answer, err := l.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err = l.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	return l.peer.SetRemoteDescription(answer)
+}
+
+// renegotiate sends a new offer from pc, after pc added tracks
+func (l *localPeer) renegotiate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	offer, err := l.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err = l.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	return l.answer(offer)
+}
+
+// Close leaves the session and closes both ends
+func (l *localPeer) Close() {
+	if err := l.peer.Close(); err != nil {
+		log.Errorf("local peer: error closing peer %s", err)
+	}
+	if err := l.pc.Close(); err != nil {
+		log.Errorf("local peer: error closing peer connection %s", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pion/ion-log"
+	"github.com/rs/zerolog"
+)
+
+// LoggerConfig defines the output of the per-peer rpc logs
+type LoggerConfig struct {
+	// Format is "console" or "json"
+	Format string `mapstructure:"format"`
+}
+
+// LogLevels is the runtime log level, along with peers and sessions
+// that are logged at debug level whatever the level is.
+type LogLevels struct {
+	Level    string   `json:"level"`
+	Peers    []string `json:"peers"`
+	Sessions []string `json:"sessions"`
+}
+
+// levels is the shared state behind LogLevels
+type levels struct {
+	mu       sync.RWMutex
+	level    zerolog.Level
+	name     string
+	peers    map[string]struct{}
+	sessions map[string]struct{}
+}
+
+var (
+	rpcLog    zerolog.Logger
+	logLevels = &levels{level: zerolog.InfoLevel, name: "info"}
+)
+
+// initLogger sets up rpc logging, level is the [log] level of the sfu
+func initLogger(c LoggerConfig, level string) {
+	if c.Format == "json" {
+		rpcLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+	} else {
+		rpcLog = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: "2006-01-02 15:04:05.000"}).With().Timestamp().Logger()
+	}
+
+	l, err := zerolog.ParseLevel(level)
+	if err != nil || level == "" {
+		l = zerolog.InfoLevel
+	}
+	logLevels.mu.Lock()
+	logLevels.level = l
+	logLevels.name = l.String()
+	logLevels.mu.Unlock()
+}
+
+// Get returns the current levels
+func (l *levels) Get() LogLevels {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := LogLevels{Level: l.name, Peers: []string{}, Sessions: []string{}}
+	for pid := range l.peers {
+		out.Peers = append(out.Peers, pid)
+	}
+	for sid := range l.sessions {
+		out.Sessions = append(out.Sessions, sid)
+	}
+	return out
+}
+
+// Set replaces the current levels, the sfu's own logs follow the new level
+func (l *levels) Set(in LogLevels) error {
+	level, err := zerolog.ParseLevel(in.Level)
+	if err != nil || in.Level == "" {
+		return fmt.Errorf("unknown log level %q", in.Level)
+	}
+
+	l.mu.Lock()
+	l.level = level
+	l.name = level.String()
+	l.peers = make(map[string]struct{}, len(in.Peers))
+	for _, pid := range in.Peers {
+		l.peers[pid] = struct{}{}
+	}
+	l.sessions = make(map[string]struct{}, len(in.Sessions))
+	for _, sid := range in.Sessions {
+		l.sessions[sid] = struct{}{}
+	}
+	l.mu.Unlock()
+
+	log.Init(level.String(), conf.Log.Fix)
+	return nil
+}
+
+// enabled reports whether a message at level is logged for a peer
+func (l *levels) enabled(level zerolog.Level, pid, sid string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if level >= l.level {
+		return true
+	}
+	if level < zerolog.DebugLevel {
+		return false
+	}
+	if _, ok := l.peers[pid]; ok && pid != "" {
+		return true
+	}
+	_, ok := l.sessions[sid]
+	return ok && sid != ""
+}
+
+// peerLogger logs with the fields of a connection, the transport and
+// the method being handled, the peer and session are read on every
+// message since they are only known once the transport joined.
+type peerLogger struct {
+	c      *connContext
+	p      *peerContext
+	method string
+	span   *Span
+}
+
+func (l peerLogger) logf(level zerolog.Level, format string, v ...interface{}) {
+	var pid, sid, tid string
+	if l.p != nil {
+		pid, sid = l.p.ids()
+		tid = l.p.tid
+	}
+	if !logLevels.enabled(level, pid, sid) {
+		return
+	}
+	rpcLog.WithLevel(level).
+		Str("conn", l.c.cid).
+		Str("transport", tid).
+		Str("peer", pid).
+		Str("sid", sid).
+		Str("method", l.method).
+		Str("remote", l.c.remote).
+		Msgf(format, v...)
+}
+
+func (l peerLogger) Debugf(format string, v ...interface{}) {
+	l.logf(zerolog.DebugLevel, format, v...)
+}
+
+func (l peerLogger) Infof(format string, v ...interface{}) {
+	l.logf(zerolog.InfoLevel, format, v...)
+}
+
+// Errorf also marks the span of the call as failed
+func (l peerLogger) Errorf(format string, v ...interface{}) {
+	l.span.SetError(fmt.Sprintf(format, v...))
+	l.logf(zerolog.ErrorLevel, format, v...)
+}
@@ -7,26 +7,51 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 	"github.com/sourcegraph/jsonrpc2"
-	websocketjsonrpc2 "github.com/sourcegraph/jsonrpc2/websocket"
 	"github.com/spf13/viper"
 
 	"github.com/pion/ion-examples/ion-sfu/internal/crypto"
-	sfu "github.com/pion/ion-sfu/pkg"
 	"github.com/pion/ion-log"
+	sfu "github.com/pion/ion-sfu/pkg"
 )
 
+// Config defines parameters for the custom signaling server
+type Config struct {
+	sfu.Config `mapstructure:",squash"`
+	Record     RecordConfig    `mapstructure:"record"`
+	Admin      AdminConfig     `mapstructure:"admin"`
+	Webhook    WebhookConfig   `mapstructure:"webhook"`
+	Static     StaticConfig    `mapstructure:"static"`
+	Relay      []RelayConfig   `mapstructure:"relay"`
+	Peer       PeerConfig      `mapstructure:"peer"`
+	Websocket  WebsocketConfig `mapstructure:"websocket"`
+	Logger     LoggerConfig    `mapstructure:"logger"`
+	Trace      TraceConfig     `mapstructure:"trace"`
+	TURN       TURNConfig      `mapstructure:"turn"`
+	Layers     LayersConfig    `mapstructure:"layers"`
+	Stats      StatsConfig     `mapstructure:"stats"`
+	Health     HealthConfig    `mapstructure:"health"`
+}
+
 var (
-	conf = sfu.Config{}
-	file string
-	cert string
-	key  string
-	addr string
+	conf   = Config{}
+	file   string
+	cert   string
+	key    string
+	addr   string
+	audit  string
+	replay string
 )
 
 const (
@@ -39,13 +64,15 @@ func showHelp() {
 	fmt.Println("      -cert {cert file}")
 	fmt.Println("      -key {key file}")
 	fmt.Println("      -a {listen addr}")
+	fmt.Println("      -audit {json-rpc audit log file}")
+	fmt.Println("      -replay {audit log file to replay}")
 	fmt.Println("      -h (show help info)")
 }
 
-func load() bool {
+func load() error {
 	_, err := os.Stat(file)
 	if err != nil {
-		return false
+		return err
 	}
 
 	viper.SetConfigFile(file)
@@ -53,96 +80,365 @@ func load() bool {
 
 	err = viper.ReadInConfig()
 	if err != nil {
-		fmt.Printf("config file %s read failed. %v\n", file, err)
-		return false
+		return fmt.Errorf("config file %s read failed. %v", file, err)
 	}
 	err = viper.GetViper().Unmarshal(&conf)
 	if err != nil {
-		fmt.Printf("sfu config file %s loaded failed. %v\n", file, err)
-		return false
+		return fmt.Errorf("sfu config file %s loaded failed. %v", file, err)
 	}
 
 	if len(conf.WebRTC.ICEPortRange) > 2 {
-		fmt.Printf("config file %s loaded failed. range port must be [min,max]\n", file)
-		return false
+		return fmt.Errorf("config file %s loaded failed. range port must be [min,max]", file)
 	}
 
 	if len(conf.WebRTC.ICEPortRange) != 0 && conf.WebRTC.ICEPortRange[1]-conf.WebRTC.ICEPortRange[0] < portRangeLimit {
-		fmt.Printf("config file %s loaded failed. range port must be [min, max] and max - min >= %d\n", file, portRangeLimit)
-		return false
+		return fmt.Errorf("config file %s loaded failed. range port must be [min, max] and max - min >= %d", file, portRangeLimit)
 	}
 
 	fmt.Printf("config %s load ok!\n", file)
-	return true
+	return nil
 }
 
 func parse() bool {
 	flag.StringVar(&file, "c", "config.toml", "config file")
 	flag.StringVar(&addr, "a", ":7000", "address to use")
+	flag.StringVar(&audit, "audit", "", "append json-rpc messages to this file")
+	flag.StringVar(&replay, "replay", "", "replay an audit log and exit")
 	help := flag.Bool("h", false, "help info")
 	flag.Parse()
-	if !load() {
-		return false
+	return !*help
+}
+
+type contextKey struct {
+	name string
+}
+
+// connContext is a websocket connection, which carries one or more
+// transports addressed by a client chosen transport id
+type connContext struct {
+	cid    string
+	remote string
+	span   *Span
+
+	mu         sync.Mutex
+	transports map[string]*peerContext
+}
+
+// transport returns the transport with id tid, nil if there is none
+func (c *connContext) transport(tid string) *peerContext {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.transports[tid]
+}
+
+func (c *connContext) addTransport(p *peerContext) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.transports[p.tid] = p
+}
+
+// removeTransport reports whether p was still part of the connection,
+// and whether the connection has no transports left
+func (c *connContext) removeTransport(p *peerContext) (removed, empty bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.transports[p.tid] == p {
+		delete(c.transports, p.tid)
+		removed = true
 	}
+	return removed, len(c.transports) == 0
+}
 
-	if *help {
-		showHelp()
-		return false
+// removeAll removes and returns every transport of the connection
+func (c *connContext) removeAll() []*peerContext {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ps := make([]*peerContext, 0, len(c.transports))
+	for tid, p := range c.transports {
+		ps = append(ps, p)
+		delete(c.transports, tid)
 	}
-	return true
+	return ps
 }
 
-type contextKey struct {
-	name string
+// peerIDs returns the ids of the joined transports
+func (c *connContext) peerIDs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pids := make([]string, 0, len(c.transports))
+	for _, p := range c.transports {
+		pids = append(pids, p.peerID())
+	}
+	return pids
 }
+
+// peerContext is a transport joined to a session
 type peerContext struct {
-	peer *sfu.WebRTCTransport
+	cid      string
+	remote   string
+	tid      string
+	peer     *sfu.WebRTCTransport
+	sid      string
+	conn     *jsonrpc2.Conn
+	watchdog *watchdog
+	layers   *layerSelector
+	done     chan struct{}
+
+	mu          sync.Mutex
+	pid         string
+	tracks      []*webrtc.Track
+	span        *Span
+	negotiation *Span
+	channels    map[string]*webrtc.DataChannel
+}
+
+// event records a milestone on the transport span and on the
+// negotiation round in progress
+func (p *peerContext) event(name string, attrs ...string) {
+	p.mu.Lock()
+	span, n := p.span, p.negotiation
+	p.mu.Unlock()
+	span.AddEvent(name, attrs...)
+	n.AddEvent(name, attrs...)
 }
 
-var peerCtxKey = &contextKey{"peer"}
+// traceSpan returns the span of the transport
+func (p *peerContext) traceSpan() *Span {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.span
+}
 
-func forContext(ctx context.Context) *peerContext {
-	raw, _ := ctx.Value(peerCtxKey).(*peerContext)
+// startNegotiation starts the span of a server offer, ending a previous
+// round that never got an answer.
+func (p *peerContext) startNegotiation(span *Span) {
+	p.mu.Lock()
+	prev := p.negotiation
+	p.negotiation = span
+	p.mu.Unlock()
+	prev.SetError("superseded")
+	prev.End()
+}
+
+// endNegotiation returns the span of the server offer being answered
+func (p *peerContext) endNegotiation() *Span {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	span := p.negotiation
+	p.negotiation = nil
+	return span
+}
+
+// ids returns the ids of the joined peer and its session
+func (p *peerContext) ids() (pid, sid string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pid, p.sid
+}
+
+// peerID returns the id of the joined peer, safe to call from any goroutine
+func (p *peerContext) peerID() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pid
+}
+
+var connCtxKey = &contextKey{"conn"}
+
+func forContext(ctx context.Context) *connContext {
+	raw, _ := ctx.Value(connCtxKey).(*connContext)
 	return raw
 }
 
 // RPC defines the json-rpc
 type RPC struct {
-	sfu *sfu.SFU
+	sfu    *sfu.SFU
+	hooks  *Webhook
+	tracer *Tracer
+	turn   *TURN
+	audit  *AuditLog
+
+	mu        sync.RWMutex
+	sessions  map[string]map[*peerContext]struct{}
+	recorders map[string]*Recorder
+	// sessions whose recorder is joining, false once stopRecord cancels it
+	starting   map[string]bool
+	recordings []RecordingInfo
+	taps       map[*webrtc.Track]*trackTap
+	// connections being served, closed by Shutdown
+	conns   map[*jsonrpc2.Conn]struct{}
+	serving sync.WaitGroup
+	closing bool
 }
 
 // NewRPC ...
 func NewRPC() *RPC {
 	return &RPC{
-		sfu: sfu.NewSFU(conf),
+		sfu:       sfu.NewSFU(conf.Config),
+		sessions:  make(map[string]map[*peerContext]struct{}),
+		recorders: make(map[string]*Recorder),
+		starting:  make(map[string]bool),
+		taps:      make(map[*webrtc.Track]*trackTap),
+		conns:     make(map[*jsonrpc2.Conn]struct{}),
+	}
+}
+
+// addPeer registers a joined peer with its session so it can be notified
+func (r *RPC) addPeer(p *peerContext) {
+	r.mu.Lock()
+	peers, ok := r.sessions[p.sid]
+	if !ok {
+		peers = make(map[*peerContext]struct{})
+		r.sessions[p.sid] = peers
+	}
+	peers[p] = struct{}{}
+	r.mu.Unlock()
+
+	if !ok {
+		r.hooks.Emit(Event{Type: EventSessionCreated, Sid: p.sid})
+	}
+	r.hooks.Emit(Event{Type: EventPeerJoined, Sid: p.sid, Peer: p.peer.ID()})
+}
+
+// removePeer unregisters a peer, stopping any recording once its session is empty
+func (r *RPC) removePeer(p *peerContext) {
+	r.mu.Lock()
+	peers, ok := r.sessions[p.sid]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	delete(peers, p)
+	empty := len(peers) == 0
+	if empty {
+		delete(r.sessions, p.sid)
+	}
+	r.mu.Unlock()
+
+	p.mu.Lock()
+	tracks := p.tracks
+	p.tracks = nil
+	p.mu.Unlock()
+	for _, track := range tracks {
+		r.hooks.Emit(trackEvent(EventTrackUnpublished, p, track))
+	}
+	r.hooks.Emit(Event{Type: EventPeerLeft, Sid: p.sid, Peer: p.peer.ID()})
+
+	if empty {
+		r.hooks.Emit(Event{Type: EventSessionClosed, Sid: p.sid})
+		if _, err := r.stopRecord(p.sid); err != nil && err != errNotRecording {
+			log.Errorf("error stopping recording for session %s: %v", p.sid, err)
+		}
+	}
+}
+
+// broadcast sends a notification to every connection in a session
+func (r *RPC) broadcast(ctx context.Context, sid, method string, params interface{}) {
+	r.mu.RLock()
+	conns := make(map[*jsonrpc2.Conn]struct{}, len(r.sessions[sid]))
+	for p := range r.sessions[sid] {
+		conns[p.conn] = struct{}{}
+	}
+	r.mu.RUnlock()
+
+	for conn := range conns {
+		if err := conn.Notify(ctx, method, params); err != nil {
+			log.Errorf("error sending %s %s", method, err)
+		}
+	}
+}
+
+// streams returns the ids of the streams published in a session
+func (r *RPC) streams(sid string) []string {
+	r.mu.RLock()
+	peers := make([]*peerContext, 0, len(r.sessions[sid]))
+	for p := range r.sessions[sid] {
+		peers = append(peers, p)
+	}
+	r.mu.RUnlock()
+
+	var streamIDs []string
+	for _, p := range peers {
+		p.mu.Lock()
+		for _, track := range p.tracks {
+			streamIDs = append(streamIDs, track.Label())
+		}
+		p.mu.Unlock()
 	}
+	return streamIDs
+}
+
+// Transport addresses one of the transports of a connection, clients
+// with a single transport can leave it empty
+type Transport struct {
+	Tid string `json:"tid,omitempty"`
 }
 
 // Join message sent when initializing a peer connection
 type Join struct {
+	Transport
 	Sid   string                    `json:"sid"`
 	Offer webrtc.SessionDescription `json:"offer"`
 }
 
 // Negotiation message sent when renegotiating
 type Negotiation struct {
+	Transport
 	Desc webrtc.SessionDescription `json:"desc"`
 }
 
 // Trickle message sent when renegotiating
 type Trickle struct {
+	Transport
 	Candidate webrtc.ICECandidateInit `json:"candidate"`
 }
 
+// Offer notification sent when the server renegotiates a transport
+type Offer struct {
+	webrtc.SessionDescription
+	Transport
+}
+
+// Candidate notification sent for each ice candidate of a transport
+type Candidate struct {
+	webrtc.ICECandidateInit
+	Transport
+}
+
+// JoinReply is the answer to a join, along with the ice servers of the
+// embedded TURN server when it is enabled
+type JoinReply struct {
+	webrtc.SessionDescription
+	ICEServers []webrtc.ICEServer `json:"iceServers,omitempty"`
+}
+
+// Record message sent to start or stop recording a session
+type Record struct {
+	Sid string `json:"sid"`
+}
+
 // Handle RPC call
 func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
-	log.Infof("Handling......")
-	p := forContext(ctx)
+	c := forContext(ctx)
+	var target Transport
+	if req.Params != nil {
+		_ = json.Unmarshal(*req.Params, &target)
+	}
+	p := c.transport(target.Tid)
+
+	parent := c.span
+	if p != nil {
+		parent = p.traceSpan()
+	}
+	span := r.tracer.Start(parent, "rpc."+req.Method)
+	defer span.End()
+	l := peerLogger{c: c, p: p, method: req.Method, span: span}
+	l.Debugf("handling %s", req.Method)
 
 	switch req.Method {
 	case "join":
-		if p.peer != nil {
-			log.Errorf("connect: peer already exists for connection")
+		if p != nil {
+			l.Errorf("connect: peer already exists for transport %q", target.Tid)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", errors.New("peer already exists")),
@@ -153,7 +449,7 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 		var join Join
 		err := json.Unmarshal(*req.Params, &join)
 		if err != nil {
-			log.Errorf("connect: error parsing offer: %v", err)
+			l.Errorf("connect: error parsing offer: %v", err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -164,7 +460,7 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 		me := sfu.MediaEngine{}
 		err = me.PopulateFromSDP(join.Offer)
 		if err != nil {
-			log.Errorf("connect: error creating peer: %v", err)
+			l.Errorf("connect: error creating peer: %v", err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -173,9 +469,11 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 		}
 
 		peer, err := r.sfu.NewWebRTCTransport(join.Sid, me)
+		p = &peerContext{cid: c.cid, remote: c.remote, tid: join.Tid, channels: make(map[string]*webrtc.DataChannel)}
+		l.p = p
 
 		if err != nil {
-			log.Errorf("connect: error creating peer: %v", err)
+			l.Errorf("connect: error creating peer: %v", err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -183,11 +481,15 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 			break
 		}
 
-		log.Infof("peer %s join session %s", peer.ID(), join.Sid)
+		l.Infof("peer %s join session %s", peer.ID(), join.Sid)
+
+		peer.OnDataChannel(func(dc *webrtc.DataChannel) {
+			r.onDataChannel(p, dc)
+		})
 
 		err = peer.SetRemoteDescription(join.Offer)
 		if err != nil {
-			log.Errorf("Offer error: %v", err)
+			l.Errorf("Offer error: %v", err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -197,7 +499,7 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 
 		answer, err := peer.CreateAnswer()
 		if err != nil {
-			log.Errorf("Offer error: answer=%v err=%v", answer, err)
+			l.Errorf("Offer error: answer=%v err=%v", answer, err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -207,7 +509,7 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 
 		err = peer.SetLocalDescription(answer)
 		if err != nil {
-			log.Errorf("Offer error: answer=%v err=%v", answer, err)
+			l.Errorf("Offer error: answer=%v err=%v", answer, err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -217,43 +519,126 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 
 		// Notify user of trickle candidates
 		peer.OnICECandidate(func(c *webrtc.ICECandidate) {
-			log.Debugf("Sending ICE candidate")
+			l.Debugf("Sending ICE candidate")
 			if c == nil {
 				// Gathering done
+				p.event("ice.gathering.complete")
 				return
 			}
+			p.event("ice.candidate", "type", c.Typ.String(), "protocol", c.Protocol.String())
+
+			if err := conn.Notify(ctx, "trickle", Candidate{c.ToJSON(), join.Transport}); err != nil {
+				l.Errorf("error sending trickle %s", err)
+			}
+		})
+
+		peer.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+			p.mu.Lock()
+			p.tracks = append(p.tracks, track)
+			p.mu.Unlock()
+			r.tapTrack(peer, track)
+			r.hooks.Emit(trackEvent(EventTrackPublished, p, track))
+		})
 
-			if err := conn.Notify(ctx, "trickle", c.ToJSON()); err != nil {
-				log.Errorf("error sending trickle %s", err)
+		// Close transports that never connect or lose their connection,
+		// along with the connection once it has none left
+		wd := newWatchdog(conf.Peer, func(reason string) {
+			l.Infof("closing peer %s: %s", peer.ID(), reason)
+			if err := conn.Notify(ctx, "close", Close{Reason: reason, Transport: join.Transport}); err != nil {
+				l.Errorf("error sending close %s", err)
+			}
+			removed, empty := c.removeTransport(p)
+			if removed {
+				r.closeTransport(p)
+			}
+			if empty {
+				_ = conn.Close()
 			}
 		})
 
+		peer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+			l.Debugf("peer %s connection state %s", peer.ID(), state)
+			p.event("connection.state", "state", state.String())
+			if state == webrtc.PeerConnectionStateFailed {
+				r.hooks.Emit(Event{Type: EventICEFailed, Sid: join.Sid, Peer: peer.ID()})
+			}
+			wd.update(state)
+		})
+
 		peer.OnNegotiationNeeded(func() {
-			log.Debugf("on negotiation needed called")
+			l.Debugf("on negotiation needed called")
+			ns := r.tracer.Start(p.traceSpan(), "negotiation")
+			p.startNegotiation(ns)
+			l := peerLogger{c: c, p: p, method: "negotiation", span: ns}
+
 			offer, err := p.peer.CreateOffer()
 			if err != nil {
-				log.Errorf("CreateOffer error: %v", err)
+				l.Errorf("CreateOffer error: %v", err)
+				p.endNegotiation().End()
 				return
 			}
+			ns.AddEvent("offer.created")
 
 			err = p.peer.SetLocalDescription(offer)
 			if err != nil {
-				log.Errorf("SetLocalDescription error: %v", err)
+				l.Errorf("SetLocalDescription error: %v", err)
+				p.endNegotiation().End()
 				return
 			}
 
-			if err := conn.Notify(ctx, "offer", offer); err != nil {
-				log.Errorf("error sending offer %s", err)
+			if err := conn.Notify(ctx, "offer", Offer{offer, join.Transport}); err != nil {
+				l.Errorf("error sending offer %s", err)
+				p.endNegotiation().End()
+				return
+			}
+			ns.AddEvent("offer.sent")
+		})
+
+		layers := newLayerSelector(peer, conf.Layers, func() []string {
+			_, sid := p.ids()
+			return r.streams(sid)
+		}, func(changed LayerChanged) {
+			changed.Transport = join.Transport
+			if err := conn.Notify(ctx, "layerChanged", changed); err != nil {
+				l.Errorf("error sending layerChanged %s", err)
 			}
 		})
 
+		ts := r.tracer.Start(c.span, "transport")
+		ts.SetAttr("tid", join.Tid)
+		ts.SetAttr("peer", peer.ID())
+		ts.SetAttr("sid", join.Sid)
+
 		p.peer = peer
+		p.watchdog = wd
+		p.layers = layers
+		p.done = make(chan struct{})
+		p.mu.Lock()
+		p.pid = peer.ID()
+		p.sid = join.Sid
+		p.span = ts
+		p.mu.Unlock()
+		p.conn = conn
+		c.addTransport(p)
+		r.addPeer(p)
+
+		if conf.Stats.Interval > 0 {
+			go r.pushStats(p, time.Duration(conf.Stats.Interval)*time.Second, func(stats Stats) {
+				if err := conn.Notify(ctx, "stats", stats); err != nil {
+					l.Errorf("error sending stats %s", err)
+				}
+			}, p.done)
+		}
 
-		_ = conn.Reply(ctx, req.ID, answer)
+		iceServers, err := r.turn.ICEServers()
+		if err != nil {
+			l.Errorf("error creating turn credentials: %v", err)
+		}
+		_ = conn.Reply(ctx, req.ID, JoinReply{SessionDescription: answer, ICEServers: iceServers})
 
 	case "offer":
-		if p.peer == nil {
-			log.Errorf("connect: no peer exists for connection")
+		if p == nil {
+			l.Errorf("connect: no peer exists for transport %q", target.Tid)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
@@ -261,12 +646,12 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 			break
 		}
 
-		log.Infof("peer %s offer", p.peer.ID())
+		l.Infof("peer %s offer", p.peer.ID())
 
 		var negotiation Negotiation
 		err := json.Unmarshal(*req.Params, &negotiation)
 		if err != nil {
-			log.Errorf("connect: error parsing offer: %v", err)
+			l.Errorf("connect: error parsing offer: %v", err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -277,7 +662,7 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 		// Peer exists, renegotiating existing peer
 		err = p.peer.SetRemoteDescription(negotiation.Desc)
 		if err != nil {
-			log.Errorf("Offer error: %v", err)
+			l.Errorf("Offer error: %v", err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -287,7 +672,7 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 
 		answer, err := p.peer.CreateAnswer()
 		if err != nil {
-			log.Errorf("Offer error: answer=%v err=%v", answer, err)
+			l.Errorf("Offer error: answer=%v err=%v", answer, err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -297,7 +682,7 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 
 		err = p.peer.SetLocalDescription(answer)
 		if err != nil {
-			log.Errorf("Offer error: answer=%v err=%v", answer, err)
+			l.Errorf("Offer error: answer=%v err=%v", answer, err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -308,8 +693,8 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 		_ = conn.Reply(ctx, req.ID, answer)
 
 	case "answer":
-		if p.peer == nil {
-			log.Errorf("connect: no peer exists for connection")
+		if p == nil {
+			l.Errorf("connect: no peer exists for transport %q", target.Tid)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
@@ -317,12 +702,12 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 			break
 		}
 
-		log.Infof("peer %s answer", p.peer.ID())
+		l.Infof("peer %s answer", p.peer.ID())
 
 		var negotiation Negotiation
 		err := json.Unmarshal(*req.Params, &negotiation)
 		if err != nil {
-			log.Errorf("connect: error parsing answer: %v", err)
+			l.Errorf("connect: error parsing answer: %v", err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -330,15 +715,19 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 			break
 		}
 
+		ns := p.endNegotiation()
+		ns.AddEvent("answer.received")
 		err = p.peer.SetRemoteDescription(negotiation.Desc)
 		if err != nil {
-			log.Errorf("error setting remote description %s", err)
+			l.Errorf("error setting remote description %s", err)
+			ns.SetError(err.Error())
 		}
+		ns.End()
 
 	case "trickle":
-		log.Debugf("trickle")
-		if p.peer == nil {
-			log.Errorf("connect: no peer exists for connection")
+		l.Debugf("trickle")
+		if p == nil {
+			l.Errorf("connect: no peer exists for transport %q", target.Tid)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
@@ -346,12 +735,12 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 			break
 		}
 
-		log.Infof("peer %s trickle", p.peer.ID())
+		l.Infof("peer %s trickle", p.peer.ID())
 
 		var trickle Trickle
 		err := json.Unmarshal(*req.Params, &trickle)
 		if err != nil {
-			log.Errorf("connect: error parsing candidate: %v", err)
+			l.Errorf("connect: error parsing candidate: %v", err)
 			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 				Code:    500,
 				Message: fmt.Sprintf("%s", err),
@@ -361,8 +750,258 @@ func (r *RPC) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Req
 
 		err = p.peer.AddICECandidate(trickle.Candidate)
 		if err != nil {
-			log.Errorf("error setting ice candidate %s", err)
+			l.Errorf("error setting ice candidate %s", err)
+		}
+
+	case "setPreferredLayer":
+		if p == nil {
+			l.Errorf("connect: no peer exists for transport %q", target.Tid)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		var layer Layer
+		err := json.Unmarshal(*req.Params, &layer)
+		if err != nil {
+			l.Errorf("connect: error parsing layer: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		err = p.layers.setPreferred(layer)
+		if err != nil {
+			l.Errorf("error setting layer of stream %s: %v", layer.StreamID, err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
 		}
+
+		_ = conn.Reply(ctx, req.ID, layer)
+
+	case "setMaxBitrate":
+		if p == nil {
+			l.Errorf("connect: no peer exists for transport %q", target.Tid)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		var bitrate MaxBitrate
+		err := json.Unmarshal(*req.Params, &bitrate)
+		if err != nil {
+			l.Errorf("connect: error parsing bitrate: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		err = p.layers.setMaxBitrate(bitrate)
+		if err != nil {
+			l.Errorf("error setting bitrate of stream %s: %v", bitrate.StreamID, err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, bitrate)
+
+	case "getStats":
+		if p == nil {
+			l.Errorf("connect: no peer exists for transport %q", target.Tid)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, r.stats(p))
+
+	case "sendData":
+		if p == nil {
+			l.Errorf("connect: no peer exists for transport %q", target.Tid)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		var data Data
+		err := json.Unmarshal(*req.Params, &data)
+		if err == nil {
+			var msg webrtc.DataChannelMessage
+			if msg, err = data.message(); err == nil {
+				r.publishData(p, data.Label, msg)
+			}
+		}
+		if err != nil {
+			l.Errorf("connect: error parsing data: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, true)
+
+	case "record", "stopRecord":
+		var record Record
+		if req.Params != nil {
+			err := json.Unmarshal(*req.Params, &record)
+			if err != nil {
+				l.Errorf("connect: error parsing record: %v", err)
+				_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+					Code:    500,
+					Message: fmt.Sprintf("%s", err),
+				})
+				break
+			}
+		}
+
+		// peers only record the session they joined, other sessions are
+		// recorded through the admin api
+		if p == nil {
+			l.Errorf("connect: no session to record")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no session to record")),
+			})
+			break
+		}
+		if record.Sid != "" && record.Sid != p.sid {
+			l.Errorf("connect: %s of session %s refused: %v", req.Method, record.Sid, errNotInSession)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errNotInSession),
+			})
+			break
+		}
+		record.Sid = p.sid
+
+		var (
+			info RecordingInfo
+			err  error
+		)
+		if req.Method == "record" {
+			info, err = r.record(record.Sid)
+		} else {
+			info, err = r.stopRecord(record.Sid)
+		}
+		if err != nil {
+			l.Errorf("%s error: %v", req.Method, err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, info)
+	}
+}
+
+// closeTransport tears down a transport removed from its connection
+func (r *RPC) closeTransport(p *peerContext) {
+	p.watchdog.stop()
+	p.layers.stop()
+	close(p.done)
+	r.untapTracks(p)
+	r.removePeer(p)
+	p.peer.Close()
+	p.endNegotiation().End()
+	p.traceSpan().End()
+}
+
+// Serve handles json-rpc requests from stream until the connection closes
+func (r *RPC) Serve(ctx context.Context, remote string, stream jsonrpc2.ObjectStream) {
+	c := &connContext{
+		cid:        uuid.New().String(),
+		remote:     remote,
+		transports: make(map[string]*peerContext),
+	}
+	c.span = r.tracer.Start(nil, "connection")
+	c.span.SetAttr("conn", c.cid)
+	c.span.SetAttr("remote", remote)
+	defer c.span.End()
+	ctx = context.WithValue(ctx, connCtxKey, c)
+	jc := jsonrpc2.NewConn(ctx, stream, r, r.audit.connOpts(c)...)
+	if r.addConn(jc) {
+		defer r.removeConn(jc)
+	} else {
+		_ = jc.Close()
+	}
+
+	<-jc.DisconnectNotify()
+
+	for _, p := range c.removeAll() {
+		peerLogger{c: c, p: p, method: "close"}.Infof("Closing peer")
+		r.closeTransport(p)
+	}
+}
+
+// addConn registers a connection being served so Shutdown closes it, it
+// reports false once the node is shutting down
+func (r *RPC) addConn(jc *jsonrpc2.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closing {
+		return false
+	}
+	r.conns[jc] = struct{}{}
+	r.serving.Add(1)
+	return true
+}
+
+// removeConn forgets a connection once its peers are closed
+func (r *RPC) removeConn(jc *jsonrpc2.Conn) {
+	r.mu.Lock()
+	delete(r.conns, jc)
+	r.mu.Unlock()
+	r.serving.Done()
+}
+
+// Shutdown closes the connections being served, which http.Server's
+// Shutdown leaves open once hijacked by the websocket upgrade, and waits
+// until their peers are closed or ctx is done
+func (r *RPC) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	r.closing = true
+	conns := make([]*jsonrpc2.Conn, 0, len(r.conns))
+	for jc := range r.conns {
+		conns = append(conns, jc)
+	}
+	r.mu.Unlock()
+
+	for _, jc := range conns {
+		_ = jc.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.serving.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -383,8 +1022,87 @@ func main() {
 		os.Exit(-1)
 	}
 
+	// readiness reports the outcome of each part of the node started below
+	h := &health{certFile: "cert.pem", keyFile: "key.pem"}
+	err := load()
+	h.set("config", err)
+	if err != nil {
+		fmt.Println(err)
+		showHelp()
+		os.Exit(-1)
+	}
+
 	log.Infof("--- Starting SFU Node ---")
+	t, err := NewTURN(conf.TURN)
+	if conf.TURN.Enabled {
+		// peers behind restrictive nats can't connect without it, the
+		// node keeps running but isn't ready
+		h.set("turn", err)
+	}
+	if err != nil {
+		log.Errorf("error starting turn server: %v", err)
+	}
+	defer t.Close()
+	if t != nil {
+		conf.WebRTC.ICEServers = append(conf.WebRTC.ICEServers, t.SFUICEServer())
+	}
+
+	h.set("sfu", errSFUStarting)
 	rpc := NewRPC()
+	h.set("sfu", nil)
+	rpc.turn = t
+	initLogger(conf.Logger, conf.Log.Level)
+
+	hooks, err := NewWebhook(conf.Webhook)
+	if conf.Webhook.URL != "" {
+		h.set("webhook", err)
+	}
+	if err != nil {
+		log.Errorf("error starting webhook: %v", err)
+	}
+	// runs once main waited for the peers closed on shutdown, delivering
+	// their events
+	defer hooks.Close()
+	rpc.hooks = hooks
+
+	tracer, err := NewTracer(conf.Trace)
+	if err != nil {
+		panic(err)
+	}
+	defer tracer.Close()
+	rpc.tracer = tracer
+
+	if audit != "" {
+		a, err := NewAuditLog(audit)
+		if err != nil {
+			panic(err)
+		}
+		defer a.Close()
+		rpc.audit = a
+	}
+
+	for _, c := range conf.Relay {
+		name := "relay " + c.Sid
+		h.set(name, errRelayConnecting)
+		relay := NewRelay(rpc.sfu, c)
+		relay.OnStatus = func(err error) {
+			h.set(name, err)
+		}
+		go relay.Run(context.Background())
+	}
+
+	if replay != "" {
+		mismatches, err := Replay(rpc, replay)
+		if err != nil {
+			panic(err)
+		}
+		log.Infof("replay of %s done, %d replies diverged", replay, mismatches)
+		if mismatches > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
@@ -400,26 +1118,60 @@ func main() {
 		}
 		defer c.Close()
 
-		p := &peerContext{}
-		ctx := context.WithValue(r.Context(), peerCtxKey, p)
-		jc := jsonrpc2.NewConn(ctx, websocketjsonrpc2.NewObjectStream(c), rpc)
-
-		<-jc.DisconnectNotify()
-
-		if p.peer != nil {
-			log.Infof("Closing peer")
-			p.peer.Close()
-		}
+		rpc.Serve(r.Context(), r.RemoteAddr, newKeepaliveStream(c, conf.Websocket))
 	}))
 
-	http.Handle("/", http.FileServer(http.Dir(".")))
+	if conf.Admin.Token != "" {
+		http.Handle("/admin/", http.StripPrefix("/admin", rpc.adminHandler(conf.Admin.Token, h)))
+	}
 
-	var err error
+	http.Handle("/healthz", h.healthzHandler())
+	http.Handle("/readyz", h.readyzHandler())
 
-	log.Infof("Listening at https://[%s]", addr)
-	err = http.ListenAndServeTLS(addr, "cert.pem", "key.pem", nil)
+	static, err := staticHandler(conf.Static.Dir)
+	if err != nil {
+		panic(err)
+	}
+	http.Handle("/", static)
+
+	srv := &http.Server{Addr: addr}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		// load balancers see /readyz fail and stop routing new peers to the
+		// node before it stops accepting them, a second signal cuts it short
+		h.setDraining()
+		grace := time.Duration(conf.Health.Grace) * time.Second
+		log.Infof("%s received, draining for %s", sig, grace)
+		select {
+		case <-time.After(grace):
+		case <-sigs:
+		}
+		log.Infof("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("error shutting down: %v", err)
+		}
+		if err := rpc.Shutdown(ctx); err != nil {
+			log.Errorf("error closing peers: %v", err)
+		}
+	}()
 
+	l, err := net.Listen("tcp", addr)
+	h.set("listener", err)
 	if err != nil {
 		panic(err)
 	}
+	log.Infof("Listening at https://[%s]", addr)
+	err = srv.ServeTLS(l, "cert.pem", "key.pem")
+
+	if err != nil && err != http.ErrServerClosed {
+		panic(err)
+	}
+	// ServeTLS returns as soon as Shutdown is called
+	<-stopped
 }
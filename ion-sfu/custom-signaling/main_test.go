@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/harness"
+)
+
+// TestMain loads the example config, the nodes of the tests run with it
+func TestMain(m *testing.M) {
+	file = "config.toml"
+	if err := load(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// startNode serves a custom-signaling node on loopback and returns it
+// with its websocket url, the node is closed when the test ends
+func startNode(t *testing.T) (*RPC, string) {
+	t.Helper()
+	rpc := NewRPC()
+	return rpc, harness.StartJSONRPC(t, rpc.Serve)
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	_, url := startNode(t)
+
+	pub := harness.NewPeer(t)
+	pub.Publish(t, "pub")
+	harness.DialJSONRPC(t, url, pub).Join(t, "test")
+
+	sub := harness.NewPeer(t)
+	sub.Receive(t)
+	harness.DialJSONRPC(t, url, sub).Join(t, "test")
+
+	sub.WaitForPackets(t, 2, 50, 20*time.Second)
+}
+
+func TestSubscribeBeforePublish(t *testing.T) {
+	_, url := startNode(t)
+
+	// The publisher's tracks reach the subscriber through renegotiation
+	sub := harness.NewPeer(t)
+	sub.Receive(t)
+	harness.DialJSONRPC(t, url, sub).Join(t, "test")
+
+	pub := harness.NewPeer(t)
+	pub.Publish(t, "pub")
+	harness.DialJSONRPC(t, url, pub).Join(t, "test")
+
+	sub.WaitForPackets(t, 2, 50, 20*time.Second)
+}
+
+func TestGetStats(t *testing.T) {
+	_, url := startNode(t)
+
+	pub := harness.NewPeer(t)
+	pub.Publish(t, "pub")
+	pubc := harness.DialJSONRPC(t, url, pub)
+	pubc.Join(t, "test")
+
+	sub := harness.NewPeer(t)
+	sub.Receive(t)
+	subc := harness.DialJSONRPC(t, url, sub)
+	subc.Join(t, "test")
+	sub.WaitForPackets(t, 2, 50, 20*time.Second)
+
+	// bitrates are counted once a second of packets came in
+	var stats Stats
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if err := pubc.Conn().Call(context.Background(), "getStats", map[string]interface{}{}, &stats); err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.Tracks) == 2 && stats.Tracks[0].Bitrate > 0 && stats.Tracks[1].Bitrate > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got stats %+v, want both published tracks with a bitrate", stats.Tracks)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	kinds := map[string]bool{}
+	for _, s := range stats.Tracks {
+		kinds[s.Kind] = true
+		if s.StreamID != "pub" || s.Direction != "inbound" || s.Packets == 0 {
+			t.Errorf("got %+v, want inbound packets of stream pub", s)
+		}
+	}
+	if !kinds["audio"] || !kinds["video"] {
+		t.Errorf("got tracks of kinds %v, want audio and video", kinds)
+	}
+
+	// the subscriber publishes nothing
+	if err := subc.Conn().Call(context.Background(), "getStats", map[string]interface{}{}, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Tracks) != 0 {
+		t.Errorf("got subscriber stats %+v, want none", stats.Tracks)
+	}
+}
+
+// recordedSizes returns the size of every file of a recording
+func recordedSizes(t *testing.T, files []string) map[string]int64 {
+	t.Helper()
+	sizes := make(map[string]int64, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[file] = info.Size()
+	}
+	return sizes
+}
+
+func TestRecord(t *testing.T) {
+	dir := conf.Record.Dir
+	conf.Record.Dir = t.TempDir()
+	t.Cleanup(func() { conf.Record.Dir = dir })
+
+	rpc, url := startNode(t)
+	ctx := context.Background()
+
+	pub := harness.NewPeer(t)
+	pub.Publish(t, "pub")
+	pubc := harness.DialJSONRPC(t, url, pub)
+	pubc.Join(t, "test")
+
+	// the other peer of the session is told when recording starts and stops
+	notified := make(chan RecordingInfo, 2)
+	sub := harness.NewPeer(t)
+	sub.Receive(t)
+	subc := harness.DialJSONRPC(t, url, sub)
+	subc.OnNotify(func(method string, params json.RawMessage) {
+		if method != "recording" {
+			return
+		}
+		var info RecordingInfo
+		if err := json.Unmarshal(params, &info); err != nil {
+			t.Errorf("error parsing recording: %v", err)
+			return
+		}
+		notified <- info
+	})
+	subc.Join(t, "test")
+	sub.WaitForPackets(t, 2, 50, 20*time.Second)
+
+	var info RecordingInfo
+	if err := pubc.Conn().Call(ctx, "record", map[string]interface{}{}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Sid != "test" || !info.Recording {
+		t.Errorf("got %+v, want session test recording", info)
+	}
+	select {
+	case got := <-notified:
+		if got.Sid != "test" || !got.Recording {
+			t.Errorf("got notification %+v, want session test recording", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no recording notification")
+	}
+
+	// both tracks are saved once the recorder received them
+	var files []string
+	for deadline := time.Now().Add(10 * time.Second); len(files) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got files %v, want an ogg and an ivf file", files)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if recordings := rpc.Recordings(); len(recordings) == 1 {
+			files = recordings[0].Files
+		}
+	}
+	exts := map[string]bool{}
+	for _, file := range files {
+		exts[filepath.Ext(file)] = true
+	}
+	if !exts[".ogg"] || !exts[".ivf"] {
+		t.Fatalf("got files %v, want an ogg and an ivf file", files)
+	}
+	before := recordedSizes(t, files)
+	time.Sleep(time.Second)
+	for file, size := range recordedSizes(t, files) {
+		if size <= before[file] {
+			t.Errorf("%s didn't grow from %d bytes", file, before[file])
+		}
+	}
+
+	if err := pubc.Conn().Call(ctx, "stopRecord", map[string]interface{}{}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Recording || info.Stopped == nil {
+		t.Errorf("got %+v, want the recording stopped", info)
+	}
+	select {
+	case got := <-notified:
+		if got.Sid != "test" || got.Recording || got.Stopped == nil {
+			t.Errorf("got notification %+v, want session test stopped", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no recording notification")
+	}
+
+	// the finalized files are listed by the admin api and no longer written
+	admin := httptest.NewServer(http.StripPrefix("/admin", rpc.adminHandler("token", &health{})))
+	defer admin.Close()
+	req, err := http.NewRequest(http.MethodGet, admin.URL+"/admin/recordings", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var recordings []RecordingInfo
+	if err = json.NewDecoder(resp.Body).Decode(&recordings); err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 1 || recordings[0].Recording || recordings[0].Stopped == nil {
+		t.Fatalf("got recordings %+v, want the stopped recording of session test", recordings)
+	}
+	if fmt.Sprint(recordings[0].Files) != fmt.Sprint(files) {
+		t.Errorf("got files %v, want %v", recordings[0].Files, files)
+	}
+	stopped := recordedSizes(t, files)
+	time.Sleep(500 * time.Millisecond)
+	for file, size := range recordedSizes(t, files) {
+		if size != stopped[file] {
+			t.Errorf("%s grew from %d to %d bytes after the recording stopped", file, stopped[file], size)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+
+	"github.com/pion/ion-log"
+	sfu "github.com/pion/ion-sfu/pkg"
+)
+
+var (
+	errAlreadyRecording = errors.New("session is already being recorded")
+	errNotRecording     = errors.New("session is not being recorded")
+	errRecordCanceled   = errors.New("recording was stopped before it started")
+	errNotInSession     = errors.New("peers can only record the session they joined")
+)
+
+// RecordConfig defines parameters for server side recording
+type RecordConfig struct {
+	Dir string `mapstructure:"dir"`
+}
+
+// RecordingInfo describes a recording of a session
+type RecordingInfo struct {
+	Sid       string     `json:"sid"`
+	Recording bool       `json:"recording"`
+	Started   time.Time  `json:"started"`
+	Stopped   *time.Time `json:"stopped,omitempty"`
+	Files     []string   `json:"files"`
+}
+
+// Recorder is an internal subscriber that saves every track
+// published in a session to disk, Opus as ogg and VP8 as ivf.
+type Recorder struct {
+	sid     string
+	dir     string
+	started time.Time
+	pc      *webrtc.PeerConnection
+	local   *localPeer
+	done    chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	files   []string
+	writers []media.Writer
+}
+
+// NewRecorder joins session sid with an in-process peer connection
+// and writes the tracks it receives into a directory under dir.
+func NewRecorder(s *sfu.SFU, sid, dir string) (*Recorder, error) {
+	dir = filepath.Join(dir, safeName(sid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	m := webrtc.MediaEngine{}
+	m.RegisterCodec(webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000))
+	m.RegisterCodec(webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000))
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &Recorder{
+		sid:     sid,
+		dir:     dir,
+		started: time.Now(),
+		pc:      pc,
+		done:    make(chan struct{}),
+	}
+	pc.OnTrack(rec.onTrack)
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err = pc.AddTransceiverFromKind(kind, webrtc.RtpTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			_ = pc.Close()
+			return nil, err
+		}
+	}
+
+	rec.local, err = newLocalPeer(s, sid, pc)
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+
+	log.Infof("recorder %s recording session %s to %s", rec.local.peer.ID(), sid, dir)
+	return rec, nil
+}
+
+func (rec *Recorder) onTrack(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+	var (
+		name   string
+		writer media.Writer
+		err    error
+	)
+
+	base := filepath.Join(rec.dir, fmt.Sprintf("%s-%s", safeName(track.Label()), safeName(track.ID())))
+	switch track.Codec().Name {
+	case webrtc.Opus:
+		name = base + ".ogg"
+		writer, err = oggwriter.New(name, 48000, 2)
+	case webrtc.VP8:
+		name = base + ".ivf"
+		writer, err = ivfwriter.New(name)
+	default:
+		log.Warnf("recorder: ignoring %s track %s", track.Codec().Name, track.ID())
+		return
+	}
+	if err != nil {
+		log.Errorf("recorder: error creating %s: %v", name, err)
+		return
+	}
+
+	rec.mu.Lock()
+	if rec.closed {
+		rec.mu.Unlock()
+		_ = writer.Close()
+		return
+	}
+	rec.files = append(rec.files, name)
+	rec.writers = append(rec.writers, writer)
+	rec.mu.Unlock()
+
+	log.Infof("recorder: saving %s track %s to %s", track.Codec().Name, track.ID(), name)
+
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		// Send a PLI on an interval so the file gets a keyframe early on
+		go func() {
+			ticker := time.NewTicker(time.Second * 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-rec.done:
+					return
+				case <-ticker.C:
+					if err := rec.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}}); err != nil {
+						log.Errorf("recorder: WriteRTCP error: %s", err)
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			pkt, err := track.ReadRTP()
+			if err != nil {
+				if err != io.EOF {
+					log.Errorf("recorder: error reading track %s: %v", track.ID(), err)
+				}
+				return
+			}
+
+			if track.Kind() == webrtc.RTPCodecTypeVideo && len(pkt.Payload) < 4 {
+				continue
+			}
+
+			rec.mu.Lock()
+			if rec.closed {
+				rec.mu.Unlock()
+				return
+			}
+			err = writer.WriteRTP(pkt)
+			rec.mu.Unlock()
+			if err != nil {
+				log.Errorf("recorder: error writing %s: %v", name, err)
+				return
+			}
+		}
+	}()
+}
+
+// Info returns a description of the recording
+func (rec *Recorder) Info() RecordingInfo {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return RecordingInfo{
+		Sid:       rec.sid,
+		Recording: !rec.closed,
+		Started:   rec.started,
+		Files:     append([]string{}, rec.files...),
+	}
+}
+
+// Close stops recording and finalizes the files written so far
+func (rec *Recorder) Close() {
+	rec.mu.Lock()
+	if rec.closed {
+		rec.mu.Unlock()
+		return
+	}
+	rec.closed = true
+	close(rec.done)
+	writers := rec.writers
+	rec.mu.Unlock()
+
+	rec.local.Close()
+	for _, w := range writers {
+		if err := w.Close(); err != nil {
+			log.Errorf("recorder: error closing file %s", err)
+		}
+	}
+}
+
+// record starts recording session sid and announces it to the session
+func (r *RPC) record(sid string) (RecordingInfo, error) {
+	r.mu.Lock()
+	_, recording := r.recorders[sid]
+	_, starting := r.starting[sid]
+	if recording || starting {
+		r.mu.Unlock()
+		return RecordingInfo{}, errAlreadyRecording
+	}
+	r.starting[sid] = true
+	r.mu.Unlock()
+
+	// joining negotiates a peer connection, which must not block the
+	// sessions in the meantime
+	rec, err := NewRecorder(r.sfu, sid, conf.Record.Dir)
+
+	r.mu.Lock()
+	keep := r.starting[sid]
+	delete(r.starting, sid)
+	if err == nil && keep {
+		r.recorders[sid] = rec
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	if !keep {
+		rec.Close()
+		return RecordingInfo{}, errRecordCanceled
+	}
+
+	info := rec.Info()
+	r.broadcast(context.Background(), sid, "recording", info)
+	return info, nil
+}
+
+// stopRecord finalizes the recording of session sid and announces it to the session.
+// A recording still starting is canceled instead.
+func (r *RPC) stopRecord(sid string) (RecordingInfo, error) {
+	r.mu.Lock()
+	rec, ok := r.recorders[sid]
+	if !ok {
+		_, starting := r.starting[sid]
+		if starting {
+			r.starting[sid] = false
+		}
+		r.mu.Unlock()
+		if starting {
+			return RecordingInfo{Sid: sid}, nil
+		}
+		return RecordingInfo{}, errNotRecording
+	}
+	delete(r.recorders, sid)
+	r.mu.Unlock()
+
+	rec.Close()
+	info := rec.Info()
+	stopped := time.Now()
+	info.Stopped = &stopped
+
+	r.mu.Lock()
+	r.recordings = append(r.recordings, info)
+	r.mu.Unlock()
+
+	r.broadcast(context.Background(), sid, "recording", info)
+	return info, nil
+}
+
+// Recordings lists active and finished recordings
+func (r *RPC) Recordings() []RecordingInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	infos := append([]RecordingInfo{}, r.recordings...)
+	for _, rec := range r.recorders {
+		infos = append(infos, rec.Info())
+	}
+	return infos
+}
+
+// safeName makes s usable as a single path element
+func safeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+	if s == "" {
+		return "_"
+	}
+	return s
+}
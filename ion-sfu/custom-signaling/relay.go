@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/sourcegraph/jsonrpc2"
+	websocketjsonrpc2 "github.com/sourcegraph/jsonrpc2/websocket"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/candidates"
+	"github.com/pion/ion-log"
+	sfu "github.com/pion/ion-sfu/pkg"
+)
+
+// relayRetryInterval is how long a relay waits before reconnecting upstream
+const relayRetryInterval = 5 * time.Second
+
+var (
+	errUpstreamClosed  = errors.New("upstream connection closed")
+	errUpstreamFailed  = errors.New("upstream ice connection failed")
+	errRelayConnecting = errors.New("relay not connected upstream yet")
+)
+
+// RelayConfig defines an upstream node a session is relayed from
+type RelayConfig struct {
+	Sid      string `mapstructure:"sid"`
+	URL      string `mapstructure:"url"`
+	Insecure bool   `mapstructure:"insecure"`
+}
+
+// Relay subscribes to a session on an upstream custom-signaling node
+// over a server to server WebRTC connection, and republishes its
+// tracks in the same session on this node.
+type Relay struct {
+	sfu    *sfu.SFU
+	config RelayConfig
+
+	// OnStatus is called with nil once the upstream node answered the
+	// join, and with the error the upstream connection ended with
+	OnStatus func(err error)
+}
+
+// NewRelay creates a relay for config
+func NewRelay(s *sfu.SFU, config RelayConfig) *Relay {
+	return &Relay{sfu: s, config: config}
+}
+
+// Run relays the session until ctx is done, reconnecting when the
+// upstream connection is lost.
+func (r *Relay) Run(ctx context.Context) {
+	for {
+		log.Infof("relay: relaying session %s from %s", r.config.Sid, r.config.URL)
+		if err := r.relay(ctx); err != nil {
+			log.Errorf("relay: session %s from %s: %v", r.config.Sid, r.config.URL, err)
+			r.status(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(relayRetryInterval):
+		}
+	}
+}
+
+func (r *Relay) status(err error) {
+	if r.OnStatus != nil {
+		r.OnStatus(err)
+	}
+}
+
+// relayUpstream is the subscribing end of a relay
+type relayUpstream struct {
+	pc   *webrtc.PeerConnection
+	conn *jsonrpc2.Conn
+	// candidates trickled before the join answer wait for it
+	candidates *candidates.Buffer
+}
+
+// Handle offers and trickle candidates sent by the upstream node
+func (u *relayUpstream) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Params == nil {
+		return
+	}
+
+	switch req.Method {
+	case "offer":
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(*req.Params, &offer); err != nil {
+			log.Errorf("relay: error parsing offer: %v", err)
+			return
+		}
+		if err := u.pc.SetRemoteDescription(offer); err != nil {
+			log.Errorf("relay: offer error: %v", err)
+			return
+		}
+		answer, err := u.pc.CreateAnswer(nil)
+		if err != nil {
+			log.Errorf("relay: answer error: %v", err)
+			return
+		}
+		if err = u.pc.SetLocalDescription(answer); err != nil {
+			log.Errorf("relay: answer error: %v", err)
+			return
+		}
+		if err = conn.Notify(ctx, "answer", Negotiation{Desc: answer}); err != nil {
+			log.Errorf("relay: error sending answer %s", err)
+		}
+
+	case "trickle":
+		var candidate webrtc.ICECandidateInit
+		if err := json.Unmarshal(*req.Params, &candidate); err != nil {
+			log.Errorf("relay: error parsing candidate: %v", err)
+			return
+		}
+		if err := u.candidates.Add(candidate); err != nil {
+			log.Errorf("relay: error adding ice candidate %s", err)
+		}
+	}
+}
+
+// relay runs a single upstream connection until it fails
+func (r *Relay) relay(ctx context.Context) error {
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+
+	up, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer up.Close()
+
+	pub, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	// The local end needs something to negotiate before any track arrives
+	if _, err = pub.CreateDataChannel("relay", nil); err != nil {
+		_ = pub.Close()
+		return err
+	}
+	local, err := newLocalPeer(r.sfu, r.config.Sid, pub)
+	if err != nil {
+		_ = pub.Close()
+		return err
+	}
+	defer local.Close()
+
+	pub.OnNegotiationNeeded(func() {
+		if err := local.renegotiate(); err != nil {
+			log.Errorf("relay: negotiation error %s", err)
+		}
+	})
+
+	up.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		r.republish(up, pub, track)
+	})
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err = up.AddTransceiverFromKind(kind, webrtc.RtpTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			return err
+		}
+	}
+
+	dialer := websocket.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: r.config.Insecure}, // nolint: gosec
+	}
+	ws, _, err := dialer.DialContext(ctx, r.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	u := &relayUpstream{pc: up, candidates: candidates.New(up)}
+	u.conn = jsonrpc2.NewConn(ctx, websocketjsonrpc2.NewObjectStream(ws), u)
+	defer u.conn.Close()
+
+	up.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		if err := u.conn.Notify(ctx, "trickle", Trickle{Candidate: c.ToJSON()}); err != nil {
+			log.Errorf("relay: error sending trickle %s", err)
+		}
+	})
+
+	failed := make(chan struct{})
+	var once sync.Once
+	up.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Debugf("relay: upstream ice connection state %s", state)
+		if state == webrtc.ICEConnectionStateFailed || state == webrtc.ICEConnectionStateClosed {
+			once.Do(func() { close(failed) })
+		}
+	})
+
+	offer, err := up.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err = up.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	var answer webrtc.SessionDescription
+	if err = u.conn.Call(ctx, "join", Join{Sid: r.config.Sid, Offer: offer}, &answer); err != nil {
+		return err
+	}
+	if err = up.SetRemoteDescription(answer); err != nil {
+		return err
+	}
+	if err = u.candidates.Flush(); err != nil {
+		log.Errorf("relay: error adding ice candidate %s", err)
+	}
+	r.status(nil)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-u.conn.DisconnectNotify():
+		return errUpstreamClosed
+	case <-failed:
+		return errUpstreamFailed
+	}
+}
+
+// republish forwards an upstream track into the local session, and
+// keyframe requests from local subscribers back upstream.
+func (r *Relay) republish(up, pub *webrtc.PeerConnection, track *webrtc.Track) {
+	log.Infof("relay: republishing %s track %s of stream %s", track.Kind(), track.ID(), track.Label())
+
+	out, err := pub.NewTrack(track.PayloadType(), track.SSRC(), track.ID(), track.Label())
+	if err != nil {
+		log.Errorf("relay: error creating track: %v", err)
+		return
+	}
+	sender, err := pub.AddTrack(out)
+	if err != nil {
+		log.Errorf("relay: error adding track: %v", err)
+		return
+	}
+
+	go func() {
+		for {
+			pkts, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				switch pkt.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					if err := up.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}}); err != nil {
+						log.Errorf("relay: WriteRTCP error: %s", err)
+					}
+				}
+			}
+		}
+	}()
+
+	go func() {
+		defer func() {
+			if err := pub.RemoveTrack(sender); err != nil {
+				log.Errorf("relay: error removing track: %v", err)
+			}
+		}()
+		for {
+			pkt, err := track.ReadRTP()
+			if err != nil {
+				if err != io.EOF {
+					log.Errorf("relay: error reading track %s: %v", track.ID(), err)
+				}
+				return
+			}
+			if err = out.WriteRTP(pkt); err != nil && err != io.ErrClosedPipe {
+				log.Errorf("relay: error writing track %s: %v", track.ID(), err)
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/harness"
+)
+
+// TestRelayLoopback relays a session between two nodes on loopback: a
+// peer publishing on the upstream node is received by a peer of the
+// same session on the relaying node.
+func TestRelayLoopback(t *testing.T) {
+	_, upstream := startNode(t)
+	node, url := startNode(t)
+
+	pub := harness.NewPeer(t)
+	pub.Publish(t, "pub")
+	harness.DialJSONRPC(t, upstream, pub).Join(t, "relay")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewRelay(node.sfu, RelayConfig{Sid: "relay", URL: upstream}).Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	sub := harness.NewPeer(t)
+	sub.Receive(t)
+	harness.DialJSONRPC(t, url, sub).Join(t, "relay")
+
+	sub.WaitForPackets(t, 2, 50, 20*time.Second)
+}
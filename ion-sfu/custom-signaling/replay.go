@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sourcegraph/jsonrpc2"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/candidates"
+	"github.com/pion/ion-log"
+)
+
+var errReplayNoOffer = errors.New("no offer from the server to answer")
+
+const (
+	// replayCallTimeout bounds how long a replayed request waits for its
+	// reply, and a replayed answer for the server's offer
+	replayCallTimeout = 10 * time.Second
+	// replayOffers is how many server offers a transport holds unanswered
+	replayOffers = 16
+	// maxAuditLine is the longest audit log line accepted, sdp can be large
+	maxAuditLine = 4 * 1024 * 1024
+)
+
+// readAuditLog reads all entries of an audit log ordered by time
+func readAuditLog(path string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), maxAuditLine)
+	for line := 1; s.Scan(); line++ {
+		var e AuditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// replayConn is the client end of a replayed connection
+type replayConn struct {
+	conn    *jsonrpc2.Conn
+	replies map[string]AuditEntry
+
+	mu         sync.Mutex
+	transports map[string]*replayTransport
+}
+
+// replayTransport stands in for a recorded transport with a pion peer
+// connection, which makes the offers and answers in place of the
+// recorded ones and trickles its own candidates.
+type replayTransport struct {
+	Transport
+	pc         *webrtc.PeerConnection
+	candidates *candidates.Buffer
+	// data is set once pc has a data channel
+	data bool
+	// offers sent by the server, answered when the log reaches the
+	// answer recorded for them
+	offers chan webrtc.SessionDescription
+}
+
+// replayMedia is a media section of a recorded description
+type replayMedia struct {
+	kind      string
+	direction string
+}
+
+// recordedMedia lists the media sections of a recorded description
+func recordedMedia(sdp string) []replayMedia {
+	var media []replayMedia
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			kind := strings.SplitN(line[len("m="):], " ", 2)[0]
+			media = append(media, replayMedia{kind: kind, direction: "sendrecv"})
+		case len(media) > 0 && (line == "a=sendrecv" || line == "a=sendonly" || line == "a=recvonly" || line == "a=inactive"):
+			media[len(media)-1].direction = line[len("a="):]
+		}
+	}
+	return media
+}
+
+// transport returns the transport for tid, creating it when create is set
+func (c *replayConn) transport(ctx context.Context, tid string, create bool) (*replayTransport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.transports[tid]; ok || !create {
+		return t, nil
+	}
+
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &replayTransport{
+		Transport:  Transport{Tid: tid},
+		pc:         pc,
+		candidates: candidates.New(pc),
+		offers:     make(chan webrtc.SessionDescription, replayOffers),
+	}
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		if err := c.conn.Notify(ctx, "trickle", Trickle{Transport: t.Transport, Candidate: candidate.ToJSON()}); err != nil {
+			log.Errorf("replay: error sending trickle %s", err)
+		}
+	})
+	c.transports[tid] = t
+	return t, nil
+}
+
+// mirror adds the media sections of a recorded offer that pc doesn't
+// have yet, so its own offer negotiates the same media
+func (t *replayTransport) mirror(recorded webrtc.SessionDescription) error {
+	have := len(t.pc.GetTransceivers())
+	i := 0
+	for _, m := range recordedMedia(recorded.SDP) {
+		var kind webrtc.RTPCodecType
+		var payloadType uint8
+		switch m.kind {
+		case "audio":
+			kind, payloadType = webrtc.RTPCodecTypeAudio, webrtc.DefaultPayloadTypeOpus
+		case "video":
+			kind, payloadType = webrtc.RTPCodecTypeVideo, webrtc.DefaultPayloadTypeVP8
+		case "application":
+			if !t.data {
+				if _, err := t.pc.CreateDataChannel("replay", nil); err != nil {
+					return err
+				}
+				t.data = true
+			}
+			continue
+		default:
+			continue
+		}
+
+		i++
+		if i <= have {
+			continue
+		}
+		if m.direction == "sendrecv" || m.direction == "sendonly" {
+			// The track stays silent, only its negotiation is replayed
+			track, err := t.pc.NewTrack(payloadType, rand.Uint32(), m.kind, "replay")
+			if err != nil {
+				return err
+			}
+			if _, err = t.pc.AddTrack(track); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := t.pc.AddTransceiverFromKind(kind, webrtc.RtpTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offer makes a fresh offer with the media of a recorded one
+func (t *replayTransport) offer(recorded webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if err := t.mirror(recorded); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	offer, err := t.pc.CreateOffer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	if err = t.pc.SetLocalDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	return offer, nil
+}
+
+// setAnswer applies the server's answer to an offer of pc
+func (t *replayTransport) setAnswer(result json.RawMessage) error {
+	var answer webrtc.SessionDescription
+	if err := json.Unmarshal(result, &answer); err != nil {
+		return err
+	}
+	if err := t.pc.SetRemoteDescription(answer); err != nil {
+		return err
+	}
+	return t.candidates.Flush()
+}
+
+// answer answers the next offer the server sent for t
+func (c *replayConn) answer(ctx context.Context, t *replayTransport) error {
+	var offer webrtc.SessionDescription
+	select {
+	case offer = <-t.offers:
+	case <-time.After(replayCallTimeout):
+		return errReplayNoOffer
+	}
+
+	if err := t.pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	if err := t.candidates.Flush(); err != nil {
+		return err
+	}
+	answer, err := t.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err = t.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	return c.conn.Notify(ctx, "answer", Negotiation{Transport: t.Transport, Desc: answer})
+}
+
+// params returns the params to send in place of recorded entry e, join
+// and offer carry a fresh offer of the transport they target
+func (c *replayConn) params(ctx context.Context, e AuditEntry) (interface{}, *replayTransport, error) {
+	if e.Params == nil {
+		return nil, nil, nil
+	}
+
+	switch e.Method {
+	case "join":
+		var join Join
+		if err := json.Unmarshal(*e.Params, &join); err != nil {
+			return nil, nil, err
+		}
+		t, err := c.transport(ctx, join.Tid, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		if join.Offer, err = t.offer(join.Offer); err != nil {
+			return nil, nil, err
+		}
+		return join, t, nil
+
+	case "offer":
+		var negotiation Negotiation
+		if err := json.Unmarshal(*e.Params, &negotiation); err != nil {
+			return nil, nil, err
+		}
+		t, err := c.transport(ctx, negotiation.Tid, false)
+		if err != nil || t == nil {
+			// Replayed verbatim, for the server to refuse as recorded
+			return e.Params, nil, err
+		}
+		if negotiation.Desc, err = t.offer(negotiation.Desc); err != nil {
+			return nil, nil, err
+		}
+		return negotiation, t, nil
+	}
+	return e.Params, nil, nil
+}
+
+// Handle queues the offers and adds the candidates the server sends
+// during replay, and prints the other notifications
+func (c *replayConn) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params []byte
+	if req.Params != nil {
+		params = *req.Params
+	}
+	log.Infof("replay: <- %s %s", req.Method, params)
+
+	switch req.Method {
+	case "offer":
+		var offer Offer
+		if err := json.Unmarshal(params, &offer); err != nil {
+			log.Errorf("replay: error parsing offer: %v", err)
+			return
+		}
+		t, _ := c.transport(ctx, offer.Tid, false)
+		if t == nil {
+			return
+		}
+		select {
+		case t.offers <- offer.SessionDescription:
+		default:
+			log.Errorf("replay: dropping offer for transport %q, the log answers fewer", offer.Tid)
+		}
+
+	case "trickle":
+		var candidate Candidate
+		if err := json.Unmarshal(params, &candidate); err != nil {
+			log.Errorf("replay: error parsing candidate: %v", err)
+			return
+		}
+		t, _ := c.transport(ctx, candidate.Tid, false)
+		if t == nil {
+			return
+		}
+		if err := t.candidates.Add(candidate.ICECandidateInit); err != nil {
+			log.Errorf("replay: error adding ice candidate %s", err)
+		}
+	}
+}
+
+// Replay runs the requests of an audit log against an in-process RPC
+// in their recorded order, one pipe connection per recorded connection.
+// Each recorded transport is played by a pion peer connection: join and
+// offer carry its fresh offers, the server's offers are answered by it
+// where the log has an answer, and it trickles its own candidates in
+// place of the recorded ones. Other messages are sent as recorded.
+// Requests that were answered wait for the new reply, which is compared
+// with the recorded one. It returns the number of replies that diverged
+// from the log.
+func Replay(rpc *RPC, path string) (int, error) {
+	entries, err := readAuditLog(path)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	conns := make(map[string]*replayConn)
+	connFor := func(id string) *replayConn {
+		c, ok := conns[id]
+		if !ok {
+			c = &replayConn{
+				replies:    make(map[string]AuditEntry),
+				transports: make(map[string]*replayTransport),
+			}
+			conns[id] = c
+		}
+		return c
+	}
+	for _, e := range entries {
+		if e.Dir != auditOut || e.ID == nil || e.Method != "" {
+			continue
+		}
+		connFor(e.Conn).replies[e.ID.String()] = e
+	}
+
+	mismatches := 0
+	for _, e := range entries {
+		if e.Dir != auditIn {
+			continue
+		}
+
+		c := connFor(e.Conn)
+		if c.conn == nil {
+			server, client := net.Pipe()
+			go rpc.Serve(ctx, "replay", jsonrpc2.NewBufferedStream(server, jsonrpc2.VSCodeObjectCodec{}))
+			c.conn = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(client, jsonrpc2.VSCodeObjectCodec{}), c)
+			log.Infof("replay: connection %s", e.Conn)
+		}
+
+		var target Transport
+		if e.Params != nil {
+			_ = json.Unmarshal(*e.Params, &target)
+		}
+		t, err := c.transport(ctx, target.Tid, false)
+		if err != nil {
+			return mismatches, err
+		}
+
+		switch {
+		case e.Method == "trickle" && t != nil:
+			// The peer connection trickles its own candidates
+			continue
+		case e.Method == "answer" && t != nil:
+			log.Infof("replay: -> answer (notification)")
+			if err := c.answer(ctx, t); err != nil {
+				mismatches++
+				log.Errorf("replay: answer for transport %q: %v", target.Tid, err)
+			}
+			continue
+		}
+
+		params, t, err := c.params(ctx, e)
+		if err != nil {
+			return mismatches, err
+		}
+
+		if e.ID == nil {
+			log.Infof("replay: -> %s (notification)", e.Method)
+			if err := c.conn.Notify(ctx, e.Method, params); err != nil {
+				return mismatches, err
+			}
+			continue
+		}
+
+		recorded, answered := c.replies[e.ID.String()]
+		if !answered {
+			// The original request never got a reply, don't wait for one
+			log.Infof("replay: -> %s id=%s (unanswered)", e.Method, e.ID)
+			go func(conn *jsonrpc2.Conn, e AuditEntry, params interface{}) {
+				_ = conn.Call(ctx, e.Method, params, nil, jsonrpc2.PickID(*e.ID))
+			}(c.conn, e, params)
+			continue
+		}
+
+		log.Infof("replay: -> %s id=%s", e.Method, e.ID)
+		callCtx, cancel := context.WithTimeout(ctx, replayCallTimeout)
+		var result json.RawMessage
+		err = c.conn.Call(callCtx, e.Method, params, &result, jsonrpc2.PickID(*e.ID))
+		cancel()
+
+		switch {
+		case err == nil && recorded.Error != nil:
+			mismatches++
+			log.Errorf("replay: %s id=%s succeeded, recorded error %q", e.Method, e.ID, recorded.Error.Message)
+		case err != nil && recorded.Error == nil:
+			mismatches++
+			log.Errorf("replay: %s id=%s failed with %v, recorded success", e.Method, e.ID, err)
+		case err != nil:
+			log.Infof("replay: %s id=%s failed as recorded: %v", e.Method, e.ID, err)
+		case t != nil:
+			if err = t.setAnswer(result); err != nil {
+				mismatches++
+				log.Errorf("replay: %s id=%s answer refused: %v", e.Method, e.ID, err)
+				break
+			}
+			log.Infof("replay: %s id=%s ok", e.Method, e.ID)
+		default:
+			log.Infof("replay: %s id=%s ok", e.Method, e.ID)
+		}
+	}
+
+	for _, c := range conns {
+		for _, t := range c.transports {
+			_ = t.pc.Close()
+		}
+		if c.conn != nil {
+			_ = c.conn.Close()
+		}
+	}
+	return mismatches, nil
+}
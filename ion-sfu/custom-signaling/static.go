@@ -0,0 +1,96 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// StaticConfig defines parameters for static file serving
+type StaticConfig struct {
+	Dir string `mapstructure:"dir"`
+}
+
+// demo holds the demo assets only, its jsfiddle sub-tree is served as is
+//
+//go:embed jsfiddle/demo.html jsfiddle/demo.js
+var demo embed.FS
+
+// deniedExts are never served, whatever directory is configured
+var deniedExts = []string{".pem", ".key", ".crt", ".toml"}
+
+const indexPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>custom-signaling</title>
+</head>
+<body>
+%s
+<script src="demo.js"></script>
+</body>
+</html>
+`
+
+// denied reports whether name must not be served
+func denied(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") && elem != "." {
+			return true
+		}
+	}
+	ext := strings.ToLower(path.Ext(name))
+	for _, d := range deniedExts {
+		if ext == d {
+			return true
+		}
+	}
+	return false
+}
+
+// isFile reports whether name is a file of fsys
+func isFile(fsys fs.FS, name string) bool {
+	info, err := fs.Stat(fsys, strings.TrimPrefix(name, "/"))
+	return err == nil && !info.IsDir()
+}
+
+// staticHandler serves the embedded demo assets, with the demo page as
+// the index, and files from dir when it is set. Key material, config and
+// dot files are never served.
+func staticHandler(dir string) (http.Handler, error) {
+	sub, err := fs.Sub(demo, "jsfiddle")
+	if err != nil {
+		return nil, err
+	}
+	body, err := fs.ReadFile(sub, "demo.html")
+	if err != nil {
+		return nil, err
+	}
+	index := []byte(fmt.Sprintf(indexPage, body))
+	embedded := http.FileServer(http.FS(sub))
+
+	var files http.Handler
+	if dir != "" {
+		files = http.FileServer(http.Dir(dir))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		switch {
+		case denied(name):
+			http.NotFound(w, r)
+		case name == "/" || name == "/index.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write(index)
+		case isFile(sub, name):
+			embedded.ServeHTTP(w, r)
+		case files != nil:
+			files.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStaticHandler(t *testing.T) {
+	// The example directory holds the key, certificate and config next
+	// to the demo
+	for _, tt := range []struct {
+		dir    string
+		path   string
+		status int
+	}{
+		{"", "/", http.StatusOK},
+		{"", "/index.html", http.StatusOK},
+		{"", "/demo.js", http.StatusOK},
+		{"", "/demo.html", http.StatusOK},
+		{"", "/key.pem", http.StatusNotFound},
+		{"", "/README.md", http.StatusNotFound},
+		{".", "/README.md", http.StatusOK},
+		{".", "/key.pem", http.StatusNotFound},
+		{".", "/cert.pem", http.StatusNotFound},
+		{".", "/config.toml", http.StatusNotFound},
+		{".", "/KEY.PEM", http.StatusNotFound},
+		{".", "/jsfiddle/../key.pem", http.StatusNotFound},
+		{".", "/.git/config", http.StatusNotFound},
+	} {
+		h, err := staticHandler(tt.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("dir %q: got %d for %s, want %d", tt.dir, w.Code, tt.path, tt.status)
+		}
+	}
+}
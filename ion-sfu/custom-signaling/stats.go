@@ -0,0 +1,235 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	sfu "github.com/pion/ion-sfu/pkg"
+)
+
+// tapID is the sender id stats taps are added to receivers with
+const tapID = "custom-signaling-stats"
+
+// StatsConfig defines how often peers are sent their stats
+type StatsConfig struct {
+	// Interval in seconds between stats notifications, zero disables them
+	Interval int `mapstructure:"interval"`
+}
+
+// TrackStats are the stats of a track over the last second. They're
+// counted as packets reach the sfu, which reads the RTCP of its peer
+// connections itself, so only the tracks a peer publishes have stats.
+type TrackStats struct {
+	TrackID  string `json:"trackId"`
+	StreamID string `json:"streamId"`
+	Kind     string `json:"kind"`
+	// Direction is "inbound", for tracks published by the peer
+	Direction string `json:"direction"`
+	// Layer is the simulcast layer, for simulcast tracks only
+	Layer *uint8 `json:"layer,omitempty"`
+	// Bitrate in bits per second
+	Bitrate      uint64  `json:"bitrate"`
+	Packets      uint64  `json:"packets"`
+	PacketsLost  uint64  `json:"packetsLost"`
+	FractionLost float64 `json:"fractionLost"`
+}
+
+// Stats notification sent to a peer with the stats of its tracks
+type Stats struct {
+	Transport
+	Peer   string       `json:"peer"`
+	Time   time.Time    `json:"time"`
+	Tracks []TrackStats `json:"tracks"`
+}
+
+// trackTap is a sender added to the receiver of a published track which
+// only counts the packets it is given.
+type trackTap struct {
+	track *webrtc.Track
+
+	mu          sync.Mutex
+	packets     uint64
+	baseSeq     uint32
+	maxSeq      uint32
+	started     bool
+	window      time.Time
+	windowBytes uint64
+	windowExp   uint32
+	windowRecv  uint64
+	bitrate     uint64
+	fraction    float64
+	updated     time.Time
+}
+
+func newTrackTap(track *webrtc.Track) *trackTap {
+	return &trackTap{track: track}
+}
+
+func (t *trackTap) ID() string                      { return tapID }
+func (t *trackTap) Close()                          {}
+func (t *trackTap) Kind() webrtc.RTPCodecType       { return t.track.Kind() }
+func (t *trackTap) Mute(bool)                       {}
+func (t *trackTap) CurrentSpatialLayer() uint8      { return 0 }
+func (t *trackTap) OnCloseHandler(func())           {}
+func (t *trackTap) SwitchSpatialLayer(layer uint8)  {}
+func (t *trackTap) SwitchTemporalLayer(layer uint8) {}
+
+// WriteRTP counts a packet, it is called for every packet of the track
+func (t *trackTap) WriteRTP(pkt *rtp.Packet) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seq := pkt.SequenceNumber
+	if !t.started {
+		t.started = true
+		t.baseSeq = uint32(seq)
+		t.maxSeq = uint32(seq)
+		t.window = now
+		t.windowExp = 1
+	} else {
+		// extend the sequence number with the number of wrap arounds,
+		// late packets from before a wrap around are only counted
+		highest := uint16(t.maxSeq)
+		ext := t.maxSeq&^0xffff | uint32(seq)
+		if seq < highest && highest-seq > 0x8000 {
+			ext += 0x10000
+		} else if seq > highest && seq-highest > 0x8000 {
+			ext = 0
+		}
+		if ext > t.maxSeq {
+			t.windowExp += ext - t.maxSeq
+			t.maxSeq = ext
+		}
+	}
+
+	t.packets++
+	t.windowRecv++
+	t.windowBytes += uint64(len(pkt.Payload) + pkt.Header.MarshalSize())
+
+	if elapsed := now.Sub(t.window); elapsed >= time.Second {
+		t.bitrate = uint64(float64(t.windowBytes*8) / elapsed.Seconds())
+		t.fraction = 0
+		if t.windowExp > 0 && uint64(t.windowExp) > t.windowRecv {
+			t.fraction = float64(uint64(t.windowExp)-t.windowRecv) / float64(t.windowExp)
+		}
+		t.updated = now
+		t.window = now
+		t.windowBytes = 0
+		t.windowExp = 0
+		t.windowRecv = 0
+	}
+}
+
+// stats returns the counters of the track, the bitrate drops to zero
+// once packets stop coming in
+func (t *trackTap) stats() TrackStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := TrackStats{
+		TrackID:      t.track.ID(),
+		StreamID:     t.track.Label(),
+		Kind:         t.track.Kind().String(),
+		Packets:      t.packets,
+		Bitrate:      t.bitrate,
+		FractionLost: t.fraction,
+	}
+	if t.started {
+		if expected := uint64(t.maxSeq-t.baseSeq) + 1; expected > t.packets {
+			s.PacketsLost = expected - t.packets
+		}
+	}
+	if time.Since(t.updated) > 2*time.Second {
+		s.Bitrate = 0
+	}
+	return s
+}
+
+// tapTrack adds a stats tap to the receiver of a track published on peer
+func (r *RPC) tapTrack(peer *sfu.WebRTCTransport, track *webrtc.Track) {
+	router := peer.GetRouter(track.ID())
+	if router == nil {
+		return
+	}
+	for layer := uint8(0); layer <= maxSpatialLayer+1; layer++ {
+		recv := router.GetReceiver(layer)
+		if recv == nil || recv.Track() != track {
+			continue
+		}
+		tap := newTrackTap(track)
+		recv.AddSender(tap)
+
+		r.mu.Lock()
+		r.taps[track] = tap
+		r.mu.Unlock()
+		return
+	}
+}
+
+// untapTracks forgets the taps of tracks published by p
+func (r *RPC) untapTracks(p *peerContext) {
+	p.mu.Lock()
+	tracks := p.tracks
+	p.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, track := range tracks {
+		delete(r.taps, track)
+	}
+}
+
+// stats returns the stats of the tracks p publishes
+func (r *RPC) stats(p *peerContext) Stats {
+	pid, _ := p.ids()
+	stats := Stats{
+		Transport: Transport{Tid: p.tid},
+		Peer:      pid,
+		Time:      time.Now(),
+		Tracks:    []TrackStats{},
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, router := range p.peer.Routers() {
+		for layer := uint8(0); layer <= maxSpatialLayer+1; layer++ {
+			recv := router.GetReceiver(layer)
+			if recv == nil {
+				continue
+			}
+			tap, ok := r.taps[recv.Track()]
+			if !ok {
+				continue
+			}
+
+			s := tap.stats()
+			s.Direction = "inbound"
+			if layer > 0 {
+				l := clientLayer(layer)
+				s.Layer = &l
+			}
+			stats.Tracks = append(stats.Tracks, s)
+		}
+	}
+	return stats
+}
+
+// pushStats notifies p of its stats every interval until done is closed
+func (r *RPC) pushStats(p *peerContext, interval time.Duration, notify func(Stats), done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			notify(r.stats(p))
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/ion-log"
+)
+
+// TraceConfig defines where spans are exported to
+type TraceConfig struct {
+	// Exporter is "stdout", "otlp" or empty to disable tracing
+	Exporter string `mapstructure:"exporter"`
+	// File spans are appended to as OTLP-JSON lines by the otlp exporter
+	File string `mapstructure:"file"`
+}
+
+// Tracer records spans of signaling and negotiation, a nil Tracer
+// records nothing.
+type Tracer struct {
+	mu   sync.Mutex
+	out  io.Writer
+	file *os.File
+	otlp bool
+}
+
+// NewTracer opens the configured exporter, it returns nil when tracing is disabled
+func NewTracer(c TraceConfig) (*Tracer, error) {
+	switch c.Exporter {
+	case "":
+		return nil, nil
+	case "stdout":
+		return &Tracer{out: os.Stdout}, nil
+	case "otlp":
+		if c.File == "" {
+			return nil, fmt.Errorf("trace: otlp exporter needs a file")
+		}
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &Tracer{out: f, file: f, otlp: true}, nil
+	default:
+		return nil, fmt.Errorf("trace: unknown exporter %q", c.Exporter)
+	}
+}
+
+// Close the exporter
+func (t *Tracer) Close() error {
+	if t == nil || t.file == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file.Close()
+}
+
+// Start a span, it is a root span of a new trace when parent is nil
+func (t *Tracer) Start(parent *Span, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+		spanID: randomID(8),
+		attrs:  make(map[string]string),
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = randomID(16)
+	}
+	return s
+}
+
+func (t *Tracer) export(s *Span) {
+	var v interface{} = s.stdout()
+	if t.otlp {
+		v = s.otlp()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := json.NewEncoder(t.out).Encode(v); err != nil {
+		log.Errorf("error exporting span %s: %v", s.name, err)
+	}
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SpanEvent is a milestone within a span
+type SpanEvent struct {
+	Time  time.Time         `json:"time"`
+	Name  string            `json:"name"`
+	Attrs map[string]string `json:"attributes,omitempty"`
+}
+
+// Span is a timed operation, all methods are safe on a nil Span
+type Span struct {
+	tracer   *Tracer
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]string
+	events []SpanEvent
+	err    string
+}
+
+// SetAttr sets an attribute of the span
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.attrs[key] = value
+	}
+}
+
+// AddEvent records a milestone, attrs are key value pairs
+func (s *Span) AddEvent(name string, attrs ...string) {
+	if s == nil {
+		return
+	}
+	e := SpanEvent{Time: time.Now(), Name: name}
+	if len(attrs) > 1 {
+		e.Attrs = make(map[string]string, len(attrs)/2)
+		for i := 0; i+1 < len(attrs); i += 2 {
+			e.Attrs[attrs[i]] = attrs[i+1]
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.events = append(s.events, e)
+	}
+}
+
+// SetError marks the span as failed, the first error is kept
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() && s.err == "" {
+		s.err = msg
+	}
+}
+
+// End the span and export it, later calls do nothing
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.export(s)
+}
+
+type stdoutSpan struct {
+	Name     string            `json:"name"`
+	TraceID  string            `json:"traceId"`
+	SpanID   string            `json:"spanId"`
+	ParentID string            `json:"parentSpanId,omitempty"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Duration string            `json:"duration"`
+	Attrs    map[string]string `json:"attributes,omitempty"`
+	Events   []SpanEvent       `json:"events,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+func (s *Span) stdout() stdoutSpan {
+	return stdoutSpan{
+		Name:     s.name,
+		TraceID:  s.traceID,
+		SpanID:   s.spanID,
+		ParentID: s.parentID,
+		Start:    s.start,
+		End:      s.end,
+		Duration: s.end.Sub(s.start).String(),
+		Attrs:    s.attrs,
+		Events:   s.events,
+		Error:    s.err,
+	}
+}
+
+// otlp types follow the OTLP/JSON encoding of ExportTraceServiceRequest
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const (
+	otlpSpanKindServer = 2
+	otlpStatusOK       = 1
+	otlpStatusError    = 2
+)
+
+func otlpAttrs(attrs map[string]string) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kv := otlpKeyValue{Key: k}
+		kv.Value.StringValue = v
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (s *Span) otlp() otlpTraces {
+	span := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+		Attributes:        otlpAttrs(s.attrs),
+		Status:            otlpStatus{Code: otlpStatusOK},
+	}
+	if s.err != "" {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: s.err}
+	}
+	for _, e := range s.events {
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: unixNano(e.Time),
+			Name:         e.Name,
+			Attributes:   otlpAttrs(e.Attrs),
+		})
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttrs(map[string]string{"service.name": "custom-signaling"})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "custom-signaling"}, Spans: []otlpSpan{span}}},
+	}}}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+
+	sfu "github.com/pion/ion-sfu/pkg"
+)
+
+// TURNConfig defines parameters for the embedded TURN/STUN server
+type TURNConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Address the server listens on for UDP
+	Address string `mapstructure:"address"`
+	// PublicIP advertised to clients and used for relayed candidates
+	PublicIP string `mapstructure:"publicip"`
+	Realm    string `mapstructure:"realm"`
+	// PortRange [min, max] relayed candidates are allocated in
+	PortRange []uint16 `mapstructure:"portrange"`
+	// Credentials are long-term users as "user=password" pairs separated by commas
+	Credentials string `mapstructure:"credentials"`
+	// Secret for time-limited REST credentials handed out in join replies
+	Secret string `mapstructure:"secret"`
+	// TTL of REST credentials in seconds
+	TTL int `mapstructure:"ttl"`
+}
+
+var errTURNNoPublicIP = errors.New("turn: publicip must be set")
+
+// TURN is the embedded TURN server, a nil TURN hands out no ice servers
+type TURN struct {
+	config TURNConfig
+	server *turn.Server
+	users  map[string][]byte
+	urls   []string
+	// client is the long-term user handed out when there is no secret
+	client webrtc.ICEServer
+	sfu    sfu.ICEServerConfig
+}
+
+// NewTURN starts the TURN server, it returns nil when disabled
+func NewTURN(c TURNConfig) (*TURN, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	ip := net.ParseIP(c.PublicIP)
+	if ip == nil {
+		return nil, errTURNNoPublicIP
+	}
+	if c.Realm == "" {
+		c.Realm = "ion"
+	}
+
+	t := &TURN{config: c, users: make(map[string][]byte)}
+	for _, kv := range strings.Split(c.Credentials, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("turn: invalid credential %q, want user=password", kv)
+		}
+		t.users[parts[0]] = turn.GenerateAuthKey(parts[0], c.Realm, parts[1])
+		if t.client.Username == "" {
+			t.client = webrtc.ICEServer{Username: parts[0], Credential: parts[1]}
+		}
+	}
+
+	_, port, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return nil, err
+	}
+	host := net.JoinHostPort(c.PublicIP, port)
+	t.urls = []string{"stun:" + host, "turn:" + host}
+	t.client.URLs = t.urls[1:]
+
+	// the sfu gets its own user, so its ice config doesn't depend on
+	// credentials that expire
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return nil, err
+	}
+	password := base64.StdEncoding.EncodeToString(b)
+	t.users["sfu"] = turn.GenerateAuthKey("sfu", c.Realm, password)
+	t.sfu = sfu.ICEServerConfig{URLs: t.urls, Username: "sfu", Credential: password}
+
+	conn, err := net.ListenPacket("udp4", c.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	var generator turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{
+		RelayAddress: ip,
+		Address:      "0.0.0.0",
+	}
+	if len(c.PortRange) == 2 {
+		generator = &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: ip,
+			Address:      "0.0.0.0",
+			MinPort:      c.PortRange[0],
+			MaxPort:      c.PortRange[1],
+		}
+	}
+
+	var rest turn.AuthHandler
+	if c.Secret != "" {
+		rest = turn.NewLongTermAuthHandler(c.Secret, nil)
+	}
+
+	t.server, err = turn.NewServer(turn.ServerConfig{
+		Realm: c.Realm,
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			if key, ok := t.users[username]; ok {
+				return key, true
+			}
+			if rest != nil {
+				return rest(username, realm, srcAddr)
+			}
+			return nil, false
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            conn,
+				RelayAddressGenerator: generator,
+			},
+		},
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	log.Infof("TURN server listening at %s, advertised as %s", c.Address, host)
+	return t, nil
+}
+
+// SFUICEServer returns the ice server the sfu itself uses
+func (t *TURN) SFUICEServer() sfu.ICEServerConfig {
+	return t.sfu
+}
+
+// ICEServers returns the ice servers handed out to a joining client,
+// with fresh REST credentials when a secret is configured.
+func (t *TURN) ICEServers() ([]webrtc.ICEServer, error) {
+	if t == nil {
+		return nil, nil
+	}
+	stun := webrtc.ICEServer{URLs: t.urls[:1]}
+	if t.config.Secret == "" {
+		if t.client.Username == "" {
+			return []webrtc.ICEServer{stun}, nil
+		}
+		return []webrtc.ICEServer{stun, t.client}, nil
+	}
+
+	ttl := time.Duration(t.config.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	username, password, err := turn.GenerateLongTermCredentials(t.config.Secret, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return []webrtc.ICEServer{
+		stun,
+		{URLs: t.urls[1:], Username: username, Credential: password},
+	}, nil
+}
+
+// Close the TURN server
+func (t *TURN) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.server.Close()
+}
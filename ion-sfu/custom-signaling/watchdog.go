@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Reasons a peer is closed by its watchdog
+const (
+	reasonConnectTimeout    = "connect timeout"
+	reasonDisconnectTimeout = "disconnect timeout"
+	reasonICEFailed         = "ice failed"
+)
+
+// PeerConfig defines how long a peer may go without a connection
+type PeerConfig struct {
+	// ConnectTimeout in seconds for the first connection, zero disables it
+	ConnectTimeout int `mapstructure:"connecttimeout"`
+	// DisconnectTimeout in seconds a peer may stay disconnected, zero disables it
+	DisconnectTimeout int `mapstructure:"disconnecttimeout"`
+}
+
+// Close notification sent to a client before its transport is closed
+type Close struct {
+	Transport
+	Reason string `json:"reason"`
+}
+
+// watchdog follows the connection state of a peer and closes it when
+// it never connects, stays disconnected too long or fails.
+type watchdog struct {
+	config  PeerConfig
+	onClose func(reason string)
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	closed bool
+}
+
+// newWatchdog starts the connect timeout, onClose is called at most once
+func newWatchdog(config PeerConfig, onClose func(reason string)) *watchdog {
+	w := &watchdog{config: config, onClose: onClose}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.arm(config.ConnectTimeout, reasonConnectTimeout)
+	return w
+}
+
+// arm starts a timer closing the peer after seconds, w.mu must be held
+func (w *watchdog) arm(seconds int, reason string) {
+	if seconds <= 0 || w.timer != nil {
+		return
+	}
+	w.timer = time.AfterFunc(time.Duration(seconds)*time.Second, func() {
+		w.close(reason)
+	})
+}
+
+// disarm stops a pending timer, w.mu must be held
+func (w *watchdog) disarm() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+func (w *watchdog) close(reason string) {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.disarm()
+	w.mu.Unlock()
+
+	w.onClose(reason)
+}
+
+// update handles a connection state change of the peer
+func (w *watchdog) update(state webrtc.PeerConnectionState) {
+	if state == webrtc.PeerConnectionStateFailed {
+		w.close(reasonICEFailed)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		w.disarm()
+	case webrtc.PeerConnectionStateDisconnected:
+		w.arm(w.config.DisconnectTimeout, reasonDisconnectTimeout)
+	case webrtc.PeerConnectionStateClosed:
+		w.closed = true
+		w.disarm()
+	}
+}
+
+// stop the watchdog without closing the peer
+func (w *watchdog) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.disarm()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/ion-log"
+	"github.com/pion/webrtc/v3"
+)
+
+// Webhook event types
+const (
+	EventSessionCreated   = "session.created"
+	EventSessionClosed    = "session.closed"
+	EventPeerJoined       = "peer.joined"
+	EventPeerLeft         = "peer.left"
+	EventTrackPublished   = "track.published"
+	EventTrackUnpublished = "track.unpublished"
+	EventICEFailed        = "ice.failed"
+)
+
+const signatureHeader = "X-Signature"
+
+var errWebhookURL = errors.New("webhook url must be an absolute http or https url")
+
+// WebhookConfig defines parameters for outbound webhooks
+type WebhookConfig struct {
+	URL     string `mapstructure:"url"`
+	Secret  string `mapstructure:"secret"`
+	Retries int    `mapstructure:"retries"`
+	Backoff int    `mapstructure:"backoff"`
+	Queue   int    `mapstructure:"queue"`
+	Timeout int    `mapstructure:"timeout"`
+	Drain   int    `mapstructure:"drain"`
+}
+
+// Event is posted to the webhook url as json
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Sid       string    `json:"sid"`
+	Peer      string    `json:"peer,omitempty"`
+	Track     string    `json:"track,omitempty"`
+	Stream    string    `json:"stream,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Webhook delivers events to a url in the background. Events are
+// queued, and dropped when the queue is full, so signaling never
+// blocks on a slow receiver.
+type Webhook struct {
+	config WebhookConfig
+	client *http.Client
+	queue  chan Event
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewWebhook starts delivering events for config,
+// it returns nil when no url is configured.
+func NewWebhook(config WebhookConfig) (*Webhook, error) {
+	if config.URL == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q", errWebhookURL, config.URL)
+	}
+	if config.Queue <= 0 {
+		config.Queue = 1024
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = 500
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5000
+	}
+	if config.Drain <= 0 {
+		config.Drain = 10000
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Webhook{
+		config: config,
+		client: &http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond},
+		queue:  make(chan Event, config.Queue),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Emit queues an event for delivery
+func (w *Webhook) Emit(e Event) {
+	if w == nil {
+		return
+	}
+	e.ID = uuid.New().String()
+	e.Timestamp = time.Now()
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		log.Warnf("webhook closed, dropping %s event for session %s", e.Type, e.Sid)
+		return
+	}
+	select {
+	case w.queue <- e:
+	default:
+		log.Warnf("webhook queue full, dropping %s event for session %s", e.Type, e.Sid)
+	}
+}
+
+// Close stops accepting events and delivers the ones still in the
+// queue, dropping what is left after the drain timeout
+func (w *Webhook) Close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	timer := time.AfterFunc(time.Duration(w.config.Drain)*time.Millisecond, w.cancel)
+	<-w.done
+	timer.Stop()
+	w.cancel()
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+	dropped := 0
+	for e := range w.queue {
+		if w.ctx.Err() != nil {
+			dropped++
+			continue
+		}
+		w.deliver(e)
+	}
+	if dropped > 0 {
+		log.Warnf("webhook: dropped %d events not delivered before the drain timeout", dropped)
+	}
+}
+
+// deliver posts an event, retrying with exponential backoff
+func (w *Webhook) deliver(e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("webhook: error marshaling %s event: %v", e.Type, err)
+		return
+	}
+
+	backoff := time.Duration(w.config.Backoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.config.Retries {
+			log.Errorf("webhook: giving up on %s event %s after %d attempts: %v", e.Type, e.ID, attempt+1, err)
+			return
+		}
+
+		log.Warnf("webhook: error delivering %s event %s, retrying in %s: %v", e.Type, e.ID, backoff, err)
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.config.Secret != "" {
+		req.Header.Set(signatureHeader, "sha256="+Sign(w.config.Secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body, receivers
+// compare it with the X-Signature header to authenticate events.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func trackEvent(typ string, p *peerContext, track *webrtc.Track) Event {
+	return Event{
+		Type:   typ,
+		Sid:    p.sid,
+		Peer:   p.peer.ID(),
+		Track:  track.ID(),
+		Stream: track.Label(),
+		Kind:   track.Kind().String(),
+	}
+}
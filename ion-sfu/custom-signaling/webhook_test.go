@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/harness"
+)
+
+// receiver records the events posted to it, answering with the status
+// status returns for each attempt
+type receiver struct {
+	mu       sync.Mutex
+	events   []Event
+	times    []time.Time
+	attempts int
+	status   func(attempt int) int
+	body     []byte
+	header   http.Header
+}
+
+func newReceiver(t *testing.T, status func(attempt int) int) (*receiver, *httptest.Server) {
+	rcv := &receiver{status: status}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("error reading body: %v", err)
+		}
+
+		rcv.mu.Lock()
+		rcv.attempts++
+		attempt := rcv.attempts
+		rcv.times = append(rcv.times, time.Now())
+		rcv.mu.Unlock()
+
+		code := http.StatusOK
+		if rcv.status != nil {
+			code = rcv.status(attempt)
+		}
+
+		rcv.mu.Lock()
+		rcv.body, rcv.header = body, r.Header.Clone()
+		if code == http.StatusOK {
+			var e Event
+			if err := json.Unmarshal(body, &e); err != nil {
+				t.Errorf("error decoding event: %v", err)
+			}
+			rcv.events = append(rcv.events, e)
+		}
+		rcv.mu.Unlock()
+
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(s.Close)
+	return rcv, s
+}
+
+func (rcv *receiver) sids() []string {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	var sids []string
+	for _, e := range rcv.events {
+		sids = append(sids, e.Sid)
+	}
+	return sids
+}
+
+func TestWebhookSignature(t *testing.T) {
+	rcv, s := newReceiver(t, nil)
+	w, err := NewWebhook(WebhookConfig{URL: s.URL, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Emit(Event{Type: EventPeerJoined, Sid: "room", Peer: "peer"})
+	w.Close()
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if len(rcv.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(rcv.events))
+	}
+	e := rcv.events[0]
+	if e.Type != EventPeerJoined || e.Sid != "room" || e.Peer != "peer" || e.ID == "" || e.Timestamp.IsZero() {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if got, want := rcv.header.Get(signatureHeader), "sha256="+Sign("secret", rcv.body); got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+	if got := rcv.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("got content type %q", got)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	rcv, s := newReceiver(t, func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	w, err := NewWebhook(WebhookConfig{URL: s.URL, Retries: 3, Backoff: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Emit(Event{Type: EventSessionCreated, Sid: "room"})
+	w.Close()
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if rcv.attempts != 3 || len(rcv.events) != 1 {
+		t.Fatalf("got %d attempts and %d events, want 3 and 1", rcv.attempts, len(rcv.events))
+	}
+	// the backoff doubles after each failed attempt
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if got := rcv.times[i+1].Sub(rcv.times[i]); got < want {
+			t.Errorf("retry %d after %s, want at least %s", i+1, got, want)
+		}
+	}
+}
+
+func TestWebhookGiveUp(t *testing.T) {
+	rcv, s := newReceiver(t, func(int) int { return http.StatusInternalServerError })
+	w, err := NewWebhook(WebhookConfig{URL: s.URL, Retries: 2, Backoff: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Emit(Event{Type: EventSessionCreated, Sid: "room"})
+	w.Close()
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if rcv.attempts != 3 {
+		t.Errorf("got %d attempts, want 3", rcv.attempts)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	rcv, s := newReceiver(t, func(attempt int) int {
+		if attempt == 1 {
+			once.Do(func() { close(received) })
+			<-release
+		}
+		return http.StatusOK
+	})
+	w, err := NewWebhook(WebhookConfig{URL: s.URL, Queue: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first event is being delivered, the second fills the queue
+	// and the third is dropped
+	w.Emit(Event{Type: EventSessionCreated, Sid: "1"})
+	<-received
+	w.Emit(Event{Type: EventSessionCreated, Sid: "2"})
+	w.Emit(Event{Type: EventSessionCreated, Sid: "3"})
+	close(release)
+	w.Close()
+
+	if got := rcv.sids(); len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Errorf("got events of sessions %v, want [1 2]", got)
+	}
+}
+
+func TestWebhookCloseDrains(t *testing.T) {
+	rcv, s := newReceiver(t, func(int) int {
+		time.Sleep(5 * time.Millisecond)
+		return http.StatusOK
+	})
+	w, err := NewWebhook(WebhookConfig{URL: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sid := range []string{"1", "2", "3", "4", "5"} {
+		w.Emit(Event{Type: EventSessionClosed, Sid: sid})
+	}
+	w.Close()
+
+	if got := rcv.sids(); len(got) != 5 {
+		t.Errorf("got events of sessions %v, want all 5", got)
+	}
+
+	// events emitted after close are dropped
+	w.Emit(Event{Type: EventSessionClosed, Sid: "6"})
+	if got := rcv.sids(); len(got) != 5 {
+		t.Errorf("got events of sessions %v after close", got)
+	}
+}
+
+func TestWebhookDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	rcv, s := newReceiver(t, func(int) int {
+		<-release
+		return http.StatusOK
+	})
+	w, err := NewWebhook(WebhookConfig{URL: s.URL, Drain: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Emit(Event{Type: EventSessionClosed, Sid: "1"})
+	w.Emit(Event{Type: EventSessionClosed, Sid: "2"})
+
+	start := time.Now()
+	w.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("close took %s with a 50ms drain timeout", elapsed)
+	}
+	if got := rcv.sids(); len(got) != 0 {
+		t.Errorf("got events of sessions %v from a stalled receiver", got)
+	}
+}
+
+func TestWebhookURL(t *testing.T) {
+	if w, err := NewWebhook(WebhookConfig{}); w != nil || err != nil {
+		t.Fatalf("got %v, %v without a url, want nil, nil", w, err)
+	}
+	for _, u := range []string{"localhost:8080/hook", "ftp://example.com/hook", "http://", "%"} {
+		if _, err := NewWebhook(WebhookConfig{URL: u}); !errors.Is(err, errWebhookURL) {
+			t.Errorf("url %q: got %v, want %v", u, err, errWebhookURL)
+		}
+	}
+}
+
+func TestWebhookShutdown(t *testing.T) {
+	rcv, s := newReceiver(t, nil)
+	hooks, err := NewWebhook(WebhookConfig{URL: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc, url := startNode(t)
+	rpc.hooks = hooks
+
+	pub := harness.NewPeer(t)
+	pub.Publish(t, "pub")
+	harness.DialJSONRPC(t, url, pub).Join(t, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = rpc.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	hooks.Close()
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	var types []string
+	for _, e := range rcv.events {
+		if e.Sid == "test" {
+			types = append(types, e.Type)
+		}
+	}
+	if len(types) < 2 || types[len(types)-2] != EventPeerLeft || types[len(types)-1] != EventSessionClosed {
+		t.Errorf("got events %v, want the peer to leave and the session to close", types)
+	}
+}
@@ -0,0 +1,58 @@
+// Package candidates holds the remote ICE candidates trickled to a peer
+// connection, or an sfu transport, before its remote description is set,
+// which pion refuses.
+package candidates
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Peer is the end candidates are added to, a *webrtc.PeerConnection or
+// an ion-sfu *WebRTCTransport
+type Peer interface {
+	AddICECandidate(candidate webrtc.ICECandidateInit) error
+}
+
+// Buffer adds remote candidates to a peer, holding the ones that arrive
+// before Flush is called once the remote description is set
+type Buffer struct {
+	mu      sync.Mutex
+	pc      Peer
+	ready   bool
+	pending []webrtc.ICECandidateInit
+}
+
+// New returns a buffer adding candidates to pc
+func New(pc Peer) *Buffer {
+	return &Buffer{pc: pc}
+}
+
+// Add adds a remote candidate, or holds it until Flush
+func (b *Buffer) Add(candidate webrtc.ICECandidateInit) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.ready {
+		b.pending = append(b.pending, candidate)
+		return nil
+	}
+	return b.pc.AddICECandidate(candidate)
+}
+
+// Flush adds the candidates held so far, candidates added after it go
+// to the peer connection directly. It stops at the first candidate the
+// peer connection refuses, dropping the rest.
+func (b *Buffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ready = true
+	pending := b.pending
+	b.pending = nil
+	for _, candidate := range pending {
+		if err := b.pc.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package candidates
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestBuffer(t *testing.T) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offerer.Close()
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer answerer.Close()
+
+	if _, err = offerer.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	candidate := webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 2130706431 127.0.0.1 9 typ host"}
+
+	// the answerer has no remote description, so the candidate waits
+	b := New(answerer)
+	if err = b.Add(candidate); err != nil {
+		t.Fatalf("add before flush: %v", err)
+	}
+	if len(b.pending) != 1 {
+		t.Fatalf("got %d pending candidates, want 1", len(b.pending))
+	}
+
+	if err = answerer.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(b.pending) != 0 {
+		t.Fatalf("got %d pending candidates after flush", len(b.pending))
+	}
+	if err = b.Add(candidate); err != nil {
+		t.Fatalf("add after flush: %v", err)
+	}
+	if len(b.pending) != 0 {
+		t.Fatalf("candidate added after flush was held")
+	}
+}
@@ -0,0 +1,346 @@
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/sfuclient"
+	pb "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+	sfu "github.com/pion/ion-sfu/pkg"
+)
+
+var (
+	errJoined    = errors.New("harness: signal stream already joined")
+	errNotJoined = errors.New("harness: signal stream not joined")
+)
+
+// SFUConfig has the router settings of ion-sfu's example config.toml,
+// for StartGRPC
+var SFUConfig = sfu.Config{
+	Router: sfu.RouterConfig{
+		MaxBandwidth: 400,
+		MaxNackTime:  1,
+		Video: sfu.WebRTCVideoReceiverConfig{
+			REMBCycle:     2,
+			MaxBufferTime: 1000,
+		},
+		Simulcast: sfu.SimulcastConfig{
+			BestQualityFirst: true,
+		},
+	},
+}
+
+// StartGRPC starts an sfu with config and serves the ion-sfu grpc Signal
+// api for it on a loopback port, the way ion-sfu's grpc server does, and
+// returns its address. The server is stopped when the test ends.
+func StartGRPC(t testing.TB, config sfu.Config) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	signal := &grpcSignal{sfu: sfu.NewSFU(config), t: t}
+	s := grpc.NewServer()
+	pb.RegisterSFUService(s, &pb.SFUService{Signal: signal.Signal})
+	go func() {
+		if err := s.Serve(l); err != nil {
+			t.Errorf("grpc serve: %v", err)
+		}
+	}()
+	t.Cleanup(s.Stop)
+
+	return l.Addr().String()
+}
+
+// grpcSignal serves the Signal streams of StartGRPC, each one joins a
+// transport to a session of the sfu
+type grpcSignal struct {
+	sfu *sfu.SFU
+	t   testing.TB
+}
+
+// grpcPeer is the transport of one Signal stream
+type grpcPeer struct {
+	stream pb.SFU_SignalServer
+	t      testing.TB
+
+	// grpc streams don't allow concurrent sends, candidates are sent
+	// from pion's goroutines
+	sendMu sync.Mutex
+
+	// negotiations of either side take turns
+	mu   sync.Mutex
+	peer *sfu.WebRTCTransport
+
+	// candidates trickled before the join request, clients start
+	// gathering before they send it
+	early []webrtc.ICECandidateInit
+}
+
+// Signal handles a stream until the client closes it, closing its transport
+func (s *grpcSignal) Signal(stream pb.SFU_SignalServer) error {
+	p := &grpcPeer{stream: stream, t: s.t}
+	defer p.close()
+
+	for {
+		in, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF || status.Code(err) == codes.Canceled {
+				return nil
+			}
+			return err
+		}
+
+		switch payload := in.Payload.(type) {
+		case *pb.SignalRequest_Join:
+			if err = p.join(s.sfu, payload.Join); err != nil {
+				return status.Errorf(codes.Internal, "join error: %v", err)
+			}
+
+		case *pb.SignalRequest_Negotiate:
+			if err = p.negotiate(payload.Negotiate); err != nil {
+				return status.Errorf(codes.Internal, "negotiate error: %v", err)
+			}
+
+		case *pb.SignalRequest_Trickle:
+			var candidate webrtc.ICECandidateInit
+			if err = json.Unmarshal([]byte(payload.Trickle.Init), &candidate); err != nil {
+				return status.Errorf(codes.InvalidArgument, "error parsing ice candidate: %v", err)
+			}
+			if err = p.trickle(candidate); err != nil {
+				return status.Errorf(codes.Internal, "trickle error: %v", err)
+			}
+		}
+	}
+}
+
+// join creates the transport of the stream and answers the join offer
+func (p *grpcPeer) join(s *sfu.SFU, join *pb.JoinRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peer != nil {
+		return errJoined
+	}
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(join.Offer.Sdp),
+	}
+
+	me := sfu.MediaEngine{}
+	if err := me.PopulateFromSDP(offer); err != nil {
+		return err
+	}
+	peer, err := s.NewWebRTCTransport(join.Sid, me)
+	if err != nil {
+		return err
+	}
+	p.peer = peer
+
+	peer.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			// Gathering done
+			return
+		}
+		bytes, err := json.Marshal(c.ToJSON())
+		if err != nil {
+			p.t.Logf("grpc signal: marshal candidate: %v", err)
+			return
+		}
+		if err = p.send(&pb.SignalReply{
+			Payload: &pb.SignalReply_Trickle{
+				Trickle: &pb.Trickle{
+					Init: string(bytes),
+				},
+			},
+		}); err != nil {
+			p.t.Logf("grpc signal: send trickle: %v", err)
+		}
+	})
+	peer.OnNegotiationNeeded(p.negotiationNeeded)
+
+	if err = peer.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	for _, candidate := range p.early {
+		if err = peer.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	p.early = nil
+
+	answer, err := peer.CreateAnswer()
+	if err != nil {
+		return err
+	}
+	if err = peer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	return p.send(&pb.SignalReply{
+		Payload: &pb.SignalReply_Join{
+			Join: &pb.JoinReply{
+				Pid:    peer.ID(),
+				Answer: description(answer),
+			},
+		},
+	})
+}
+
+// negotiate answers a renegotiation offer of the client, or applies its
+// answer to one of the sfu
+func (p *grpcPeer) negotiate(desc *pb.SessionDescription) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peer == nil {
+		return errNotJoined
+	}
+	if desc.Type != webrtc.SDPTypeOffer.String() {
+		return p.peer.SetRemoteDescription(webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  string(desc.Sdp),
+		})
+	}
+
+	if err := p.peer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(desc.Sdp),
+	}); err != nil {
+		return err
+	}
+	answer, err := p.peer.CreateAnswer()
+	if err != nil {
+		return err
+	}
+	if err = p.peer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	return p.send(&pb.SignalReply{
+		Payload: &pb.SignalReply_Negotiate{
+			Negotiate: description(answer),
+		},
+	})
+}
+
+// negotiationNeeded offers tracks the sfu added to the transport, like
+// the ones of peers publishing to the session. While another negotiation
+// is in progress pion calls it again once the transport is back to stable.
+func (p *grpcPeer) negotiationNeeded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	offer, err := p.peer.CreateOffer()
+	if err != nil {
+		p.t.Logf("grpc signal: create offer: %v", err)
+		return
+	}
+	if err = p.peer.SetLocalDescription(offer); err != nil {
+		p.t.Logf("grpc signal: set local description: %v", err)
+		return
+	}
+	if err = p.send(&pb.SignalReply{
+		Payload: &pb.SignalReply_Negotiate{
+			Negotiate: description(offer),
+		},
+	}); err != nil {
+		p.t.Logf("grpc signal: send offer: %v", err)
+	}
+}
+
+// trickle adds a candidate of the client, holding it until the join
+// request created the transport
+func (p *grpcPeer) trickle(candidate webrtc.ICECandidateInit) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peer == nil {
+		p.early = append(p.early, candidate)
+		return nil
+	}
+	return p.peer.AddICECandidate(candidate)
+}
+
+func (p *grpcPeer) send(reply *pb.SignalReply) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	return p.stream.Send(reply)
+}
+
+func (p *grpcPeer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peer != nil {
+		if err := p.peer.Close(); err != nil {
+			p.t.Logf("grpc signal: close transport: %v", err)
+		}
+	}
+}
+
+func description(desc webrtc.SessionDescription) *pb.SessionDescription {
+	return &pb.SessionDescription{
+		Type: desc.Type.String(),
+		Sdp:  []byte(desc.SDP),
+	}
+}
+
+// GRPCClient signals a peer with the ion-sfu grpc Signal api, the way
+// the grpc examples do.
+type GRPCClient struct {
+	peer   *Peer
+	client *sfuclient.Client
+	ctx    context.Context
+	t      testing.TB
+}
+
+// DialGRPC connects to the grpc server at addr
+func DialGRPC(t testing.TB, addr string, peer *Peer) *GRPCClient {
+	t.Helper()
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	client := sfuclient.New(pb.NewSFUClient(conn))
+	client.Events.OnError = func(err error) {
+		t.Logf("signal: %v", err)
+	}
+
+	return &GRPCClient{
+		peer:   peer,
+		client: client,
+		ctx:    ctx,
+		t:      t,
+	}
+}
+
+// Join joins session sid with an offer and handles signal replies in
+// the background for the rest of the test.
+func (c *GRPCClient) Join(t testing.TB, sid string) {
+	t.Helper()
+
+	go func() {
+		if err := c.client.Join(c.ctx, sid, c.peer.PC); err != nil && err != context.Canceled {
+			c.t.Logf("join: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,63 @@
+// Package harness runs the sfu examples in-process on loopback and drives
+// pion clients against them, so the examples can have integration tests
+// that run offline.
+//
+// A test starts a signaling server, joins a publisher and a subscriber to
+// the same session and asserts media arrives:
+//
+//	url := harness.StartJSONRPC(t, rpc.Serve)
+//
+//	pub := harness.NewPeer(t)
+//	pub.Publish(t, "pub")
+//	harness.DialJSONRPC(t, url, pub).Join(t, "test")
+//
+//	sub := harness.NewPeer(t)
+//	sub.Receive(t)
+//	harness.DialJSONRPC(t, url, sub).Join(t, "test")
+//
+//	sub.WaitForPackets(t, 2, 50, 10*time.Second)
+//
+// The grpc examples are tested the same way against an sfu serving the
+// ion-sfu grpc Signal api, started with StartGRPC and joined with DialGRPC.
+package harness
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/sourcegraph/jsonrpc2"
+	websocketjsonrpc2 "github.com/sourcegraph/jsonrpc2/websocket"
+)
+
+// ServeFunc handles a single json-rpc connection from remote until it
+// closes, custom-signaling's RPC.Serve is one.
+type ServeFunc func(ctx context.Context, remote string, stream jsonrpc2.ObjectStream)
+
+// StartJSONRPC serves json-rpc over websocket on a loopback port and
+// returns the websocket url. The server is closed when the test ends.
+func StartJSONRPC(t testing.TB, serve ServeFunc) string {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("websocket upgrade: %v", err)
+			return
+		}
+		defer c.Close()
+
+		serve(r.Context(), r.RemoteAddr, websocketjsonrpc2.NewObjectStream(c))
+	}))
+	t.Cleanup(s.Close)
+
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
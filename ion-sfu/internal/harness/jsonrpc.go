@@ -0,0 +1,166 @@
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"github.com/sourcegraph/jsonrpc2"
+	websocketjsonrpc2 "github.com/sourcegraph/jsonrpc2/websocket"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/candidates"
+)
+
+// JSONRPCClient signals a peer with custom-signaling's json-rpc
+// protocol, the way the browser demo does.
+type JSONRPCClient struct {
+	peer       *Peer
+	conn       *jsonrpc2.Conn
+	candidates *candidates.Buffer
+	t          testing.TB
+
+	mu     sync.Mutex
+	notify func(method string, params json.RawMessage)
+}
+
+// DialJSONRPC connects to the websocket url of a json-rpc server
+func DialJSONRPC(t testing.TB, url string, peer *Peer) *JSONRPCClient {
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+
+	c := &JSONRPCClient{
+		peer:       peer,
+		candidates: candidates.New(peer.PC),
+		t:          t,
+	}
+	c.conn = jsonrpc2.NewConn(context.Background(), websocketjsonrpc2.NewObjectStream(ws), c)
+	t.Cleanup(func() {
+		_ = c.conn.Close()
+	})
+	return c
+}
+
+// Conn returns the underlying json-rpc connection
+func (c *JSONRPCClient) Conn() *jsonrpc2.Conn {
+	return c.conn
+}
+
+// OnNotify calls f with the notifications the server sends besides
+// offers and trickle candidates, f must not block
+func (c *JSONRPCClient) OnNotify(f func(method string, params json.RawMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notify = f
+}
+
+// Join joins session sid with an offer, trickles candidates, and answers
+// or sends renegotiation offers for the rest of the test.
+func (c *JSONRPCClient) Join(t testing.TB, sid string) {
+	t.Helper()
+	ctx := context.Background()
+
+	c.peer.PC.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		if err := c.conn.Notify(ctx, "trickle", map[string]interface{}{"candidate": candidate.ToJSON()}); err != nil {
+			c.t.Logf("send trickle: %v", err)
+		}
+	})
+
+	offer, err := c.peer.PC.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("create offer: %v", err)
+	}
+	if err = c.peer.PC.SetLocalDescription(offer); err != nil {
+		t.Fatalf("set local description: %v", err)
+	}
+
+	var answer webrtc.SessionDescription
+	if err = c.conn.Call(ctx, "join", map[string]interface{}{"sid": sid, "offer": offer}, &answer); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if err = c.peer.PC.SetRemoteDescription(answer); err != nil {
+		t.Fatalf("set remote description: %v", err)
+	}
+	if err = c.candidates.Flush(); err != nil {
+		t.Fatalf("add ice candidate: %v", err)
+	}
+
+	c.peer.PC.OnNegotiationNeeded(func() {
+		offer, err := c.peer.PC.CreateOffer(nil)
+		if err != nil {
+			c.t.Logf("create offer: %v", err)
+			return
+		}
+		if err = c.peer.PC.SetLocalDescription(offer); err != nil {
+			c.t.Logf("set local description: %v", err)
+			return
+		}
+		var answer webrtc.SessionDescription
+		if err = c.conn.Call(ctx, "offer", map[string]interface{}{"desc": offer}, &answer); err != nil {
+			c.t.Logf("offer: %v", err)
+			return
+		}
+		if err = c.peer.PC.SetRemoteDescription(answer); err != nil {
+			c.t.Logf("set remote description: %v", err)
+		}
+	})
+}
+
+// Handle offers and trickle candidates sent by the server
+func (c *JSONRPCClient) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Params == nil {
+		return
+	}
+
+	switch req.Method {
+	case "offer":
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(*req.Params, &offer); err != nil {
+			c.t.Logf("parse offer: %v", err)
+			return
+		}
+		if err := c.peer.PC.SetRemoteDescription(offer); err != nil {
+			c.t.Logf("set remote description: %v", err)
+			return
+		}
+		answer, err := c.peer.PC.CreateAnswer(nil)
+		if err != nil {
+			c.t.Logf("create answer: %v", err)
+			return
+		}
+		if err = c.peer.PC.SetLocalDescription(answer); err != nil {
+			c.t.Logf("set local description: %v", err)
+			return
+		}
+		if err = conn.Notify(ctx, "answer", map[string]interface{}{"desc": answer}); err != nil {
+			c.t.Logf("send answer: %v", err)
+		}
+
+	case "trickle":
+		var candidate webrtc.ICECandidateInit
+		if err := json.Unmarshal(*req.Params, &candidate); err != nil {
+			c.t.Logf("parse candidate: %v", err)
+			return
+		}
+		if err := c.candidates.Add(candidate); err != nil {
+			c.t.Logf("add ice candidate: %v", err)
+		}
+
+	default:
+		c.mu.Lock()
+		notify := c.notify
+		c.mu.Unlock()
+		if notify != nil {
+			notify(req.Method, *req.Params)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package harness
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	videoInterval = 33 * time.Millisecond
+	audioInterval = 20 * time.Millisecond
+)
+
+// Synthetic frames, the sfu forwards rtp without decoding it
+var (
+	videoFrame = append([]byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}, make([]byte, 1000)...)
+	audioFrame = append([]byte{0xfc}, make([]byte, 80)...)
+)
+
+// Peer is a pion client that can publish synthetic media and counts
+// the rtp packets it receives per track.
+type Peer struct {
+	PC *webrtc.PeerConnection
+
+	connected     context.Context
+	connectedDone context.CancelFunc
+
+	mu      sync.Mutex
+	packets map[string]int
+}
+
+// NewPeer creates a peer with the default codecs, it is closed when the test ends.
+func NewPeer(t testing.TB) *Peer {
+	t.Helper()
+
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new peer connection: %v", err)
+	}
+
+	connected, connectedDone := context.WithCancel(context.Background())
+	p := &Peer{
+		PC:            pc,
+		connected:     connected,
+		connectedDone: connectedDone,
+		packets:       make(map[string]int),
+	}
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			connectedDone()
+		}
+	})
+	pc.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		go func() {
+			for {
+				if _, err := track.ReadRTP(); err != nil {
+					return
+				}
+				p.mu.Lock()
+				p.packets[track.ID()]++
+				p.mu.Unlock()
+			}
+		}()
+	})
+
+	t.Cleanup(func() {
+		connectedDone()
+		if err := pc.Close(); err != nil {
+			t.Errorf("close peer connection: %v", err)
+		}
+	})
+	return p
+}
+
+// Publish adds a VP8 and an Opus track to the peer that carry synthetic
+// frames once ICE is connected, until the peer is closed.
+func (p *Peer) Publish(t testing.TB, streamID string) {
+	t.Helper()
+
+	video, err := p.PC.NewTrack(webrtc.DefaultPayloadTypeVP8, rand.Uint32(), "video", streamID)
+	if err != nil {
+		t.Fatalf("new video track: %v", err)
+	}
+	if _, err = p.PC.AddTrack(video); err != nil {
+		t.Fatalf("add video track: %v", err)
+	}
+
+	audio, err := p.PC.NewTrack(webrtc.DefaultPayloadTypeOpus, rand.Uint32(), "audio", streamID)
+	if err != nil {
+		t.Fatalf("new audio track: %v", err)
+	}
+	if _, err = p.PC.AddTrack(audio); err != nil {
+		t.Fatalf("add audio track: %v", err)
+	}
+
+	go p.send(video, videoFrame, videoInterval, 90000)
+	go p.send(audio, audioFrame, audioInterval, 48000)
+}
+
+func (p *Peer) send(track *webrtc.Track, frame []byte, interval time.Duration, clockRate int) {
+	<-p.connected.Done()
+
+	samples := uint32(interval.Seconds() * float64(clockRate))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if p.PC.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		if err := track.WriteSample(media.Sample{Data: frame, Samples: samples}); err != nil && err != io.ErrClosedPipe {
+			return
+		}
+	}
+}
+
+// Receive adds a receive only audio and video transceiver, for peers
+// that only subscribe.
+func (p *Peer) Receive(t testing.TB) {
+	t.Helper()
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := p.PC.AddTransceiverFromKind(kind, webrtc.RtpTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			t.Fatalf("add transceiver: %v", err)
+		}
+	}
+}
+
+// Packets returns the number of rtp packets received per track id
+func (p *Peer) Packets() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	packets := make(map[string]int, len(p.packets))
+	for id, n := range p.packets {
+		packets[id] = n
+	}
+	return packets
+}
+
+// WaitForPackets waits until at least min packets were received on each
+// of tracks tracks, and fails the test on timeout.
+func (p *Peer) WaitForPackets(t testing.TB, tracks, min int, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		packets := p.Packets()
+		ready := 0
+		for _, n := range packets {
+			if n >= min {
+				ready++
+			}
+		}
+		if ready >= tracks {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d packets on %d tracks, got %v", min, tracks, packets)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
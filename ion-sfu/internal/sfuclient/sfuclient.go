@@ -0,0 +1,322 @@
+// Package sfuclient signals a pion peer connection with the ion-sfu grpc
+// Signal api, handling the join offer and answer, trickled candidates and
+// renegotiation from either side.
+//
+//	client := sfuclient.New(sfu.NewSFUClient(conn))
+//	client.Events.OnJoin = func(pid string) {
+//		log.Infof("joined as %s", pid)
+//	}
+//	err := client.Join(ctx, "test", pc)
+//
+// Offers made elsewhere, like a browser's pasted by the user, are joined
+// with JoinOffer.
+package sfuclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/candidates"
+	sfu "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+var errNoAnswer = errors.New("sfuclient: join reply without answer")
+
+// Events are called as signaling progresses, nil events are skipped.
+// OnJoin and OnNegotiate are called from the goroutine running Join.
+type Events struct {
+	// OnJoin is called once the join answer is applied, with the peer id
+	// the sfu gave the peer connection
+	OnJoin func(pid string)
+	// OnNegotiate is called after an offer from the sfu is answered
+	OnNegotiate func()
+	// OnError is called with errors that don't end signaling, like a
+	// failed renegotiation or a candidate that can't be parsed
+	OnError func(err error)
+}
+
+// Client joins peer connections to sessions of an sfu
+type Client struct {
+	sfu    sfu.SFUClient
+	Events Events
+}
+
+// New returns a client signaling with c
+func New(c sfu.SFUClient) *Client {
+	return &Client{sfu: c}
+}
+
+// session is the signal stream of one peer connection
+type session struct {
+	events     Events
+	pc         *webrtc.PeerConnection
+	stream     sfu.SFU_SignalClient
+	candidates *candidates.Buffer
+
+	// answer gets the join answer of an offer made elsewhere, pc is nil
+	answer func(pid string, answer webrtc.SessionDescription)
+
+	// grpc streams don't allow concurrent sends, candidates are sent
+	// from pion's goroutines
+	sendMu sync.Mutex
+
+	// negotiations take turns, pion asks for the offer of pc again once
+	// the one in progress completed
+	negotiateMu sync.Mutex
+	joined      bool
+}
+
+// Join joins session sid with pc and handles signaling until ctx is done
+// or the sfu closes the stream. It returns nil when the sfu closed the
+// stream, ctx.Err() when ctx is done and the error otherwise. Tracks
+// added to pc once it joined are offered to the sfu. pion stops checking
+// whether negotiation is needed if a check finds no handler, so callers
+// adding tracks before Join set pc.OnNegotiationNeeded, even to a no-op,
+// before the first track; Join replaces it.
+func (c *Client) Join(ctx context.Context, sid string, pc *webrtc.PeerConnection) error {
+	stream, err := c.sfu.Signal(ctx)
+	if err != nil {
+		return err
+	}
+	s := &session{events: c.Events, pc: pc, stream: stream, candidates: candidates.New(pc)}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			// Gathering done
+			return
+		}
+		bytes, err := json.Marshal(candidate.ToJSON())
+		if err != nil {
+			s.error(err)
+			return
+		}
+		if err = s.send(&sfu.SignalRequest{
+			Payload: &sfu.SignalRequest_Trickle{
+				Trickle: &sfu.Trickle{
+					Init: string(bytes),
+				},
+			},
+		}); err != nil {
+			s.error(err)
+		}
+	})
+	pc.OnNegotiationNeeded(s.negotiationNeeded)
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err = pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	return s.join(ctx, sid, offer)
+}
+
+// JoinOffer joins session sid with an offer made elsewhere, like a
+// browser's, and handles signaling until ctx is done or the sfu closes
+// the stream. answer is called with the peer id and the answer to hand
+// back to the offerer. Candidates and renegotiation offers of the sfu
+// can't reach the offerer and are skipped, so the offer has to hold all
+// of its candidates.
+func (c *Client) JoinOffer(ctx context.Context, sid string, offer webrtc.SessionDescription,
+	answer func(pid string, answer webrtc.SessionDescription)) error {
+	stream, err := c.sfu.Signal(ctx)
+	if err != nil {
+		return err
+	}
+	s := &session{events: c.Events, stream: stream, answer: answer}
+	return s.join(ctx, sid, offer)
+}
+
+// join sends the join offer and handles the stream until it ends
+func (s *session) join(ctx context.Context, sid string, offer webrtc.SessionDescription) error {
+	err := s.send(&sfu.SignalRequest{
+		Payload: &sfu.SignalRequest_Join{
+			Join: &sfu.JoinRequest{
+				Sid: sid,
+				Offer: &sfu.SessionDescription{
+					Type: offer.Type.String(),
+					Sdp:  []byte(offer.SDP),
+				},
+			},
+		},
+	})
+	if err == nil {
+		err = s.run()
+	}
+	_ = s.stream.CloseSend()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// run handles signal replies until the stream ends
+func (s *session) run() error {
+	for {
+		res, err := s.stream.Recv()
+		if err != nil {
+			if err == io.EOF || status.Code(err) == codes.Canceled {
+				// WebRTC Transport closed
+				return nil
+			}
+			return err
+		}
+
+		switch payload := res.Payload.(type) {
+		case *sfu.SignalReply_Join:
+			if payload.Join.Answer == nil {
+				return errNoAnswer
+			}
+			answer := webrtc.SessionDescription{
+				Type: webrtc.SDPTypeAnswer,
+				SDP:  string(payload.Join.Answer.Sdp),
+			}
+			if s.pc == nil {
+				s.answer(payload.Join.Pid, answer)
+			} else if err = s.joinAnswer(answer); err != nil {
+				return err
+			}
+			if s.events.OnJoin != nil {
+				s.events.OnJoin(payload.Join.Pid)
+			}
+
+		case *sfu.SignalReply_Negotiate:
+			if s.pc == nil {
+				continue
+			}
+			if err = s.negotiate(payload.Negotiate); err != nil {
+				s.error(err)
+			}
+
+		case *sfu.SignalReply_Trickle:
+			if s.pc == nil {
+				continue
+			}
+			var candidate webrtc.ICECandidateInit
+			if err = json.Unmarshal([]byte(payload.Trickle.Init), &candidate); err != nil {
+				s.error(err)
+				continue
+			}
+			if err = s.candidates.Add(candidate); err != nil {
+				s.error(err)
+			}
+		}
+	}
+}
+
+// joinAnswer applies the answer to the join offer
+func (s *session) joinAnswer(answer webrtc.SessionDescription) error {
+	s.negotiateMu.Lock()
+	if err := s.pc.SetRemoteDescription(answer); err != nil {
+		s.negotiateMu.Unlock()
+		return err
+	}
+	s.joined = true
+	s.negotiateMu.Unlock()
+
+	if err := s.candidates.Flush(); err != nil {
+		s.error(err)
+	}
+	return nil
+}
+
+// negotiate applies a description from the sfu, answering its offers
+func (s *session) negotiate(desc *sfu.SessionDescription) error {
+	if desc.Type != webrtc.SDPTypeOffer.String() {
+		// the answer to an offer of pc
+		s.negotiateMu.Lock()
+		defer s.negotiateMu.Unlock()
+		return s.pc.SetRemoteDescription(webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  string(desc.Sdp),
+		})
+	}
+
+	if err := s.answerOffer(desc); err != nil {
+		return err
+	}
+	if s.events.OnNegotiate != nil {
+		s.events.OnNegotiate()
+	}
+	return nil
+}
+
+// answerOffer answers a renegotiation offer from the sfu
+func (s *session) answerOffer(desc *sfu.SessionDescription) error {
+	s.negotiateMu.Lock()
+	defer s.negotiateMu.Unlock()
+
+	if err := s.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(desc.Sdp),
+	}); err != nil {
+		return err
+	}
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err = s.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	return s.send(&sfu.SignalRequest{
+		Payload: &sfu.SignalRequest_Negotiate{
+			Negotiate: &sfu.SessionDescription{
+				Type: answer.Type.String(),
+				Sdp:  []byte(answer.SDP),
+			},
+		},
+	})
+}
+
+// negotiationNeeded offers the changes made to pc once it joined. Before
+// that the join offer holds them, and while another negotiation is in
+// progress pion calls it again once pc is back to stable.
+func (s *session) negotiationNeeded() {
+	s.negotiateMu.Lock()
+	defer s.negotiateMu.Unlock()
+
+	if !s.joined || s.pc.SignalingState() != webrtc.SignalingStateStable {
+		return
+	}
+
+	offer, err := s.pc.CreateOffer(nil)
+	if err != nil {
+		s.error(err)
+		return
+	}
+	if err = s.pc.SetLocalDescription(offer); err != nil {
+		s.error(err)
+		return
+	}
+	if err = s.send(&sfu.SignalRequest{
+		Payload: &sfu.SignalRequest_Negotiate{
+			Negotiate: &sfu.SessionDescription{
+				Type: offer.Type.String(),
+				Sdp:  []byte(offer.SDP),
+			},
+		},
+	}); err != nil {
+		s.error(err)
+	}
+}
+
+func (s *session) send(req *sfu.SignalRequest) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.stream.Send(req)
+}
+
+func (s *session) error(err error) {
+	if s.events.OnError != nil {
+		s.events.OnError(err)
+	}
+}
@@ -0,0 +1,399 @@
+package sfuclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	sfu "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+const testTimeout = 5 * time.Second
+
+var errTest = errors.New("test error")
+
+// fakeSFU hands out a single fakeStream instead of a grpc stream
+type fakeSFU struct {
+	stream *fakeStream
+}
+
+func (f *fakeSFU) Signal(ctx context.Context, opts ...grpc.CallOption) (sfu.SFU_SignalClient, error) {
+	f.stream.ctx = ctx
+	return f.stream, nil
+}
+
+// fakeStream records the requests sent by the client and replies with
+// the ones the test queues, closing replies ends the stream with err
+type fakeStream struct {
+	grpc.ClientStream
+	ctx     context.Context
+	sent    chan *sfu.SignalRequest
+	replies chan *sfu.SignalReply
+	err     error
+}
+
+func newFakeStream() *fakeStream {
+	return &fakeStream{
+		sent:    make(chan *sfu.SignalRequest, 100),
+		replies: make(chan *sfu.SignalReply, 100),
+		err:     io.EOF,
+	}
+}
+
+func (f *fakeStream) Send(req *sfu.SignalRequest) error {
+	f.sent <- req
+	return nil
+}
+
+func (f *fakeStream) Recv() (*sfu.SignalReply, error) {
+	select {
+	case reply, ok := <-f.replies:
+		if !ok {
+			return nil, f.err
+		}
+		return reply, nil
+	case <-f.ctx.Done():
+		return nil, status.Error(codes.Canceled, f.ctx.Err().Error())
+	}
+}
+
+func (f *fakeStream) CloseSend() error {
+	return nil
+}
+
+// next returns the next request that isn't a trickled candidate
+func (f *fakeStream) next(t *testing.T) *sfu.SignalRequest {
+	t.Helper()
+	for {
+		select {
+		case req := <-f.sent:
+			if _, ok := req.Payload.(*sfu.SignalRequest_Trickle); ok {
+				continue
+			}
+			return req
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for a request")
+			return nil
+		}
+	}
+}
+
+func newPC(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+	return pc
+}
+
+// answer has the sfu end answer an offer. The answer holds the candidates
+// of the sfu end, so the client connects without trickling them: pion
+// holds back renegotiation until the transports started.
+func answer(t *testing.T, pc *webrtc.PeerConnection, offer webrtc.SessionDescription) webrtc.SessionDescription {
+	t.Helper()
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		t.Fatalf("set remote description: %v", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("create answer: %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(answer); err != nil {
+		t.Fatalf("set local description: %v", err)
+	}
+	<-gathered
+	return *pc.LocalDescription()
+}
+
+func description(desc webrtc.SessionDescription) *sfu.SessionDescription {
+	return &sfu.SessionDescription{Type: desc.Type.String(), Sdp: []byte(desc.SDP)}
+}
+
+func trickle(candidate string) *sfu.SignalReply {
+	init, _ := json.Marshal(webrtc.ICECandidateInit{Candidate: candidate})
+	return &sfu.SignalReply{Payload: &sfu.SignalReply_Trickle{Trickle: &sfu.Trickle{Init: string(init)}}}
+}
+
+// joined runs Join with a client pc offering audio, answered by the sfu
+// pc, and returns the stream, the sfu pc and the result of Join
+func joined(t *testing.T, client *Client, stream *fakeStream) (*webrtc.PeerConnection, *webrtc.PeerConnection, chan error) {
+	t.Helper()
+	pc, sfuPC := newPC(t), newPC(t)
+	pc.OnNegotiationNeeded(func() {})
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+
+	joinedAs := make(chan string, 1)
+	client.Events.OnJoin = func(pid string) {
+		joinedAs <- pid
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Join(context.Background(), "room", pc)
+	}()
+
+	join, ok := stream.next(t).Payload.(*sfu.SignalRequest_Join)
+	if !ok {
+		t.Fatal("first request isn't a join")
+	}
+	if join.Join.Sid != "room" || join.Join.Offer.Type != webrtc.SDPTypeOffer.String() {
+		t.Fatalf("unexpected join %+v", join.Join)
+	}
+
+	// a candidate before the answer waits for it
+	stream.replies <- trickle("candidate:1 1 udp 2130706431 127.0.0.1 9 typ host")
+	answer := answer(t, sfuPC, webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(join.Join.Offer.Sdp)})
+	stream.replies <- &sfu.SignalReply{Payload: &sfu.SignalReply_Join{Join: &sfu.JoinReply{Pid: "pid", Answer: description(answer)}}}
+
+	select {
+	case pid := <-joinedAs:
+		if pid != "pid" {
+			t.Fatalf("joined as %q, want pid", pid)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the join")
+	}
+	if state := pc.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Fatalf("signaling state %s after join", state)
+	}
+	return pc, sfuPC, done
+}
+
+func wait(t *testing.T, done chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for Join to return")
+		return nil
+	}
+}
+
+func TestJoin(t *testing.T) {
+	stream := newFakeStream()
+	client := New(&fakeSFU{stream: stream})
+	var errs []error
+	var mu sync.Mutex
+	client.Events.OnError = func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}
+
+	_, _, done := joined(t, client, stream)
+
+	close(stream.replies)
+	if err := wait(t, done); err != nil {
+		t.Fatalf("join returned %v after the stream ended", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
+
+func TestNegotiateFromSFU(t *testing.T) {
+	stream := newFakeStream()
+	client := New(&fakeSFU{stream: stream})
+	negotiated := make(chan struct{}, 1)
+	client.Events.OnNegotiate = func() {
+		negotiated <- struct{}{}
+	}
+	_, sfuPC, done := joined(t, client, stream)
+
+	// the sfu adds a track for the client to receive
+	if _, err := sfuPC.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := sfuPC.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sfuPC.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	stream.replies <- &sfu.SignalReply{Payload: &sfu.SignalReply_Negotiate{Negotiate: description(offer)}}
+
+	negotiate, ok := stream.next(t).Payload.(*sfu.SignalRequest_Negotiate)
+	if !ok || negotiate.Negotiate.Type != webrtc.SDPTypeAnswer.String() {
+		t.Fatalf("expected an answer, got %+v", negotiate)
+	}
+	if err = sfuPC.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(negotiate.Negotiate.Sdp),
+	}); err != nil {
+		t.Fatalf("set answer: %v", err)
+	}
+	select {
+	case <-negotiated:
+	case <-time.After(testTimeout):
+		t.Fatal("OnNegotiate wasn't called")
+	}
+
+	close(stream.replies)
+	if err = wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNegotiateFromClient(t *testing.T) {
+	stream := newFakeStream()
+	client := New(&fakeSFU{stream: stream})
+	pc, sfuPC, done := joined(t, client, stream)
+
+	// a track added once joined is offered to the sfu
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	negotiate, ok := stream.next(t).Payload.(*sfu.SignalRequest_Negotiate)
+	if !ok || negotiate.Negotiate.Type != webrtc.SDPTypeOffer.String() {
+		t.Fatalf("expected an offer, got %+v", negotiate)
+	}
+	answer := answer(t, sfuPC, webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(negotiate.Negotiate.Sdp),
+	})
+	stream.replies <- &sfu.SignalReply{Payload: &sfu.SignalReply_Negotiate{Negotiate: description(answer)}}
+
+	deadline := time.Now().Add(testTimeout)
+	for pc.SignalingState() != webrtc.SignalingStateStable {
+		if time.Now().After(deadline) {
+			t.Fatalf("signaling state %s after the answer", pc.SignalingState())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(stream.replies)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	t.Run("no answer", func(t *testing.T) {
+		stream := newFakeStream()
+		stream.replies <- &sfu.SignalReply{Payload: &sfu.SignalReply_Join{Join: &sfu.JoinReply{Pid: "pid"}}}
+		err := New(&fakeSFU{stream: stream}).Join(context.Background(), "room", newPC(t))
+		if err != errNoAnswer {
+			t.Fatalf("got %v, want %v", err, errNoAnswer)
+		}
+	})
+
+	t.Run("stream error", func(t *testing.T) {
+		stream := newFakeStream()
+		stream.err = errTest
+		close(stream.replies)
+		err := New(&fakeSFU{stream: stream}).Join(context.Background(), "room", newPC(t))
+		if err != errTest {
+			t.Fatalf("got %v, want %v", err, errTest)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		stream := newFakeStream()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := New(&fakeSFU{stream: stream}).Join(ctx, "room", newPC(t))
+		if err != context.Canceled {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("bad candidate", func(t *testing.T) {
+		stream := newFakeStream()
+		client := New(&fakeSFU{stream: stream})
+		errs := make(chan error, 1)
+		client.Events.OnError = func(err error) {
+			errs <- err
+		}
+		stream.replies <- &sfu.SignalReply{Payload: &sfu.SignalReply_Trickle{Trickle: &sfu.Trickle{Init: "{"}}}
+		close(stream.replies)
+		if err := client.Join(context.Background(), "room", newPC(t)); err != nil {
+			t.Fatalf("got %v, signaling should go on", err)
+		}
+		select {
+		case <-errs:
+		default:
+			t.Fatal("OnError wasn't called")
+		}
+	})
+}
+
+func TestJoinOffer(t *testing.T) {
+	stream := newFakeStream()
+	client := New(&fakeSFU{stream: stream})
+
+	// the offer of a browser, with its candidates gathered
+	browser, sfuPC := newPC(t), newPC(t)
+	if _, err := browser.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := browser.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(browser)
+	if err = browser.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	offer = *browser.LocalDescription()
+
+	answers := make(chan webrtc.SessionDescription, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.JoinOffer(context.Background(), "room", offer, func(pid string, answer webrtc.SessionDescription) {
+			if pid != "pid" {
+				t.Errorf("joined as %q, want pid", pid)
+			}
+			answers <- answer
+		})
+	}()
+
+	join, ok := stream.next(t).Payload.(*sfu.SignalRequest_Join)
+	if !ok || string(join.Join.Offer.Sdp) != offer.SDP {
+		t.Fatal("join doesn't carry the offer")
+	}
+	sfuAnswer := answer(t, sfuPC, offer)
+
+	// candidates and offers of the sfu can't reach the browser
+	stream.replies <- trickle("candidate:1 1 udp 2130706431 127.0.0.1 9 typ host")
+	stream.replies <- &sfu.SignalReply{Payload: &sfu.SignalReply_Join{Join: &sfu.JoinReply{Pid: "pid", Answer: description(sfuAnswer)}}}
+	stream.replies <- &sfu.SignalReply{Payload: &sfu.SignalReply_Negotiate{Negotiate: description(offer)}}
+	close(stream.replies)
+
+	if err = wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-answers:
+		if got.Type != webrtc.SDPTypeAnswer || got.SDP != sfuAnswer.SDP {
+			t.Fatalf("got answer %+v", got)
+		}
+	default:
+		t.Fatal("answer wasn't called")
+	}
+	select {
+	case req := <-stream.sent:
+		t.Fatalf("unexpected request %+v", req)
+	default:
+	}
+}
@@ -0,0 +1,34 @@
+package tracks
+
+import (
+	"time"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// PLIInterval is how often RequestKeyframes asks for a keyframe
+const PLIInterval = 3 * time.Second
+
+// RequestKeyframe sends a PLI for a video track pc receives
+func RequestKeyframe(pc *webrtc.PeerConnection, track *webrtc.Track) {
+	if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}}); err != nil {
+		log.Errorf("WriteRTCP error: %s", err)
+	}
+}
+
+// RequestKeyframes sends a PLI on an interval so that the publisher is
+// pushing a keyframe every PLIInterval, until done is closed
+func RequestKeyframes(pc *webrtc.PeerConnection, track *webrtc.Track, done <-chan struct{}) {
+	ticker := time.NewTicker(PLIInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			RequestKeyframe(pc, track)
+		}
+	}
+}
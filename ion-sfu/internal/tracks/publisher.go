@@ -0,0 +1,193 @@
+// Package tracks sends media files over pion tracks and requests
+// keyframes of received ones, for the examples and ionctl publishing
+// from and saving to disk.
+package tracks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// Publisher sends a VP8 ivf file and an Opus ogg file over tracks of a
+// peer connection, at the pace they should be played back at
+type Publisher struct {
+	video     *webrtc.Track
+	audio     *webrtc.Track
+	videoFile string
+	audioFile string
+}
+
+// NewPublisher adds a track to pc for each of videoFile and audioFile
+// that exists, and fails when neither does. pc must have the default
+// codecs registered.
+func NewPublisher(pc *webrtc.PeerConnection, videoFile, audioFile string) (*Publisher, error) {
+	_, err := os.Stat(videoFile)
+	haveVideoFile := err == nil
+	_, err = os.Stat(audioFile)
+	haveAudioFile := err == nil
+	if !haveAudioFile && !haveVideoFile {
+		return nil, fmt.Errorf("could not find `%s` or `%s`", videoFile, audioFile)
+	}
+
+	p := &Publisher{videoFile: videoFile, audioFile: audioFile}
+	if haveVideoFile {
+		if p.video, err = pc.NewTrack(webrtc.DefaultPayloadTypeVP8, rand.Uint32(), "video", "pion"); err != nil {
+			return nil, err
+		}
+		if _, err = pc.AddTrack(p.video); err != nil {
+			return nil, err
+		}
+	}
+	if haveAudioFile {
+		if p.audio, err = pc.NewTrack(webrtc.DefaultPayloadTypeOpus, rand.Uint32(), "audio", "pion"); err != nil {
+			return nil, err
+		}
+		if _, err = pc.AddTrack(p.audio); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Run sends the files once connected is closed, until the first of them
+// is sent or fails, or ctx is done. It returns nil once a file is sent.
+func (p *Publisher) Run(ctx context.Context, connected <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Each file is sent from its own goroutine, the first one to finish
+	// or fail ends the publish
+	sent := make(chan error, 2)
+	n := 0
+	if p.video != nil {
+		n++
+		go func() {
+			sent <- sendIVF(ctx, connected, p.video, p.videoFile)
+		}()
+	}
+	if p.audio != nil {
+		n++
+		go func() {
+			sent <- sendOgg(ctx, connected, p.audio, p.audioFile)
+		}()
+	}
+
+	err := <-sent
+	cancel()
+	for i := 1; i < n; i++ {
+		<-sent
+	}
+	return err
+}
+
+// sleep waits for d, it returns false when ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sendIVF sends an ivf file once connected, at the pace it should be
+// played back at
+func sendIVF(ctx context.Context, connected <-chan struct{}, track *webrtc.Track, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ivf, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return err
+	}
+
+	// Wait for connection established
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return nil
+	}
+
+	// Send our video file frame at a time. Pace our sending so we send it at the same speed it should be played back as.
+	// This isn't required since the video is timestamped, but we will such much higher loss if we send all at once.
+	sleepTime := time.Millisecond * time.Duration((float32(header.TimebaseNumerator)/float32(header.TimebaseDenominator))*1000)
+	for {
+		frame, _, err := ivf.ParseNextFrame()
+		if err == io.EOF {
+			log.Infof("All video frames parsed and sent")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !sleep(ctx, sleepTime) {
+			return nil
+		}
+		if err = track.WriteSample(media.Sample{Data: frame, Samples: 90000}); err != nil {
+			return err
+		}
+	}
+}
+
+// sendOgg sends an ogg file once connected, at the pace it should be
+// played back at
+func sendOgg(ctx context.Context, connected <-chan struct{}, track *webrtc.Track, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ogg, _, err := oggreader.NewWith(file)
+	if err != nil {
+		return err
+	}
+
+	// Wait for connection established
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return nil
+	}
+
+	// Keep track of last granule, the difference is the amount of samples in the buffer
+	var lastGranule uint64
+	for {
+		pageData, pageHeader, err := ogg.ParseNextPage()
+		if err == io.EOF {
+			log.Infof("All audio pages parsed and sent")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// The amount of samples is the difference between the last and current timestamp
+		sampleCount := float64(pageHeader.GranulePosition - lastGranule)
+		lastGranule = pageHeader.GranulePosition
+		if err = track.WriteSample(media.Sample{Data: pageData, Samples: uint32(sampleCount)}); err != nil {
+			return err
+		}
+
+		// Convert seconds to Milliseconds, Sleep doesn't accept floats
+		if !sleep(ctx, time.Duration((sampleCount/48000)*1000)*time.Millisecond) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/webrtc/v3"
+	"github.com/spf13/cobra"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/sfuclient"
+	"github.com/pion/ion-examples/ion-sfu/internal/signal"
+	sfu "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+func pubBrowserCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pub-browser [sid]",
+		Short: "Join a browser's publish offer, read base64 from stdin, to a session",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sid, err := sid(args)
+			if err != nil {
+				return err
+			}
+			return joinBrowser(sid, "pub")
+		},
+	}
+}
+
+func subBrowserCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "sub-browser [sid]",
+		Short: "Join a browser's subscribe offer, read base64 from stdin, to a session",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sid, err := sid(args)
+			if err != nil {
+				return err
+			}
+			return joinBrowser(sid, "sub")
+		},
+	}
+}
+
+// joinBrowser joins an offer pasted from the browser to a session, prints
+// the answer to paste back and keeps the transport open until the sfu
+// closes it. The browser trickles no candidates, so its offer has to be
+// complete.
+func joinBrowser(sid, role string) error {
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	offer := webrtc.SessionDescription{}
+	fmt.Printf("Paste the %s offer from the browser:\n", role)
+	signal.Decode(signal.MustReadStdin(), &offer)
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	client := sfuclient.New(sfu.NewSFUClient(conn))
+	err = client.JoinOffer(ctx, sid, offer, func(pid string, answer webrtc.SessionDescription) {
+		// Output the pid and answer in base64 so we can paste it in browser
+		fmt.Printf("\npid: %s", pid)
+		fmt.Printf("\n%s answer: %s\n", role, signal.Encode(answer))
+	})
+	if err == context.Canceled {
+		return nil
+	}
+	if err == nil {
+		// WebRTC Transport closed
+		log.Infof("WebRTC Transport Closed")
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+// Package ionctl is a command line client for the ion-sfu grpc Signal api,
+// publishing from and subscribing to disk, and relaying browser offers.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/webrtc/v3"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var errNoSid = errors.New("no session id, set --sid")
+
+func main() {
+	rootCmd := &cobra.Command{
+		Use:   "ionctl",
+		Short: "Publish to and subscribe from ion-sfu sessions over grpc",
+		// Flags are bound once cobra parsed them, so config files and
+		// the environment only fill in flags that weren't set
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := viper.BindPFlags(cmd.Flags()); err != nil {
+				return err
+			}
+			if file := viper.GetString("config"); file != "" {
+				viper.SetConfigFile(file)
+				if err := viper.ReadInConfig(); err != nil {
+					return fmt.Errorf("config file %s: %w", file, err)
+				}
+			}
+			log.Init(viper.GetString("log-level"), []string{"proc.go", "asm_amd64.s", "jsonrpc2.go"})
+			return nil
+		},
+		SilenceUsage: true,
+	}
+
+	flags := rootCmd.PersistentFlags()
+	flags.StringP("config", "c", "", "config file, any format viper reads")
+	flags.StringP("addr", "a", "localhost:50051", "ion-sfu grpc address")
+	flags.StringP("sid", "s", "", "session id to join")
+	flags.StringSlice("ice-servers", []string{"stun:stun.l.google.com:19302"}, "ice server urls")
+	flags.Bool("tls", false, "connect to the sfu with tls")
+	flags.String("tls-ca", "", "pem file of the certificate authority to verify the sfu with, the system roots when empty")
+	flags.Bool("tls-insecure", false, "skip verifying the sfu certificate")
+	flags.StringP("log-level", "l", "info", "log level, trace, debug, info, warn or error")
+
+	viper.SetEnvPrefix("ionctl")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+
+	rootCmd.AddCommand(pubCmd(), subCmd(), pubBrowserCmd(), subBrowserCmd())
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// sid returns the session id to join, from --sid or the first argument
+// like the examples take it
+func sid(args []string) (string, error) {
+	if s := viper.GetString("sid"); s != "" {
+		return s, nil
+	}
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	return "", errNoSid
+}
+
+// dial connects to the sfu with the transport security from the flags
+func dial() (*grpc.ClientConn, error) {
+	addr := viper.GetString("addr")
+	opts := []grpc.DialOption{grpc.WithBlock()}
+
+	if !viper.GetBool("tls") {
+		opts = append(opts, grpc.WithInsecure())
+	} else {
+		config := &tls.Config{
+			InsecureSkipVerify: viper.GetBool("tls-insecure"), // nolint:gosec
+		}
+		if ca := viper.GetString("tls-ca"); ca != "" {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", ca)
+			}
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	}
+
+	log.Debugf("connecting to %s", addr)
+	return grpc.Dial(addr, opts...)
+}
+
+// configuration returns the peer connection configuration from the flags
+func configuration() webrtc.Configuration {
+	var config webrtc.Configuration
+	for _, url := range viper.GetStringSlice("ice-servers") {
+		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{URLs: []string{url}})
+	}
+	return config
+}
+
+// interruptContext returns a context canceled on Ctrl+C or SIGTERM, so
+// commands can close their peer connection and files
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigs)
+		select {
+		case <-sigs:
+			log.Infof("interrupted")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
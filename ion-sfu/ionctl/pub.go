@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/webrtc/v3"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/sfuclient"
+	"github.com/pion/ion-examples/ion-sfu/internal/tracks"
+	sfu "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+func pubCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pub [sid]",
+		Short: "Publish a VP8 ivf and/or Opus ogg file",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sid, err := sid(args)
+			if err != nil {
+				return err
+			}
+			return pub(sid, viper.GetString("video"), viper.GetString("audio"))
+		},
+	}
+	cmd.Flags().StringP("video", "v", "output.ivf", "VP8 ivf file to publish")
+	cmd.Flags().StringP("audio", "o", "output.ogg", "Opus ogg file to publish")
+	return cmd
+}
+
+// pub publishes the files that exist until they're sent or the sfu closes
+// the transport
+func pub(sid, videoFile, audioFile string) error {
+	mediaEngine := webrtc.MediaEngine{}
+	mediaEngine.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	peerConnection, err := api.NewPeerConnection(configuration())
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+
+	publisher, err := tracks.NewPublisher(peerConnection, videoFile, audioFile)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	connected := make(chan struct{})
+	var once sync.Once
+
+	// The first file to be sent, or to fail, ends the publish
+	sent := make(chan error, 1)
+	go func() {
+		sent <- publisher.Run(ctx, connected)
+		cancel()
+	}()
+
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Debugf("Connection State has changed %s", connectionState.String())
+		if connectionState == webrtc.ICEConnectionStateConnected {
+			once.Do(func() {
+				close(connected)
+			})
+		}
+	})
+
+	client := sfuclient.New(sfu.NewSFUClient(conn))
+	client.Events.OnJoin = func(pid string) {
+		log.Infof("joined %s as %s", sid, pid)
+	}
+	client.Events.OnError = func(err error) {
+		log.Errorf("signal error %s", err)
+	}
+
+	err = client.Join(ctx, sid, peerConnection)
+	cancel()
+	if sendErr := <-sent; err == context.Canceled {
+		err = sendErr
+	}
+	return err
+}
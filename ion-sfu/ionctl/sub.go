@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/sfuclient"
+	"github.com/pion/ion-examples/ion-sfu/internal/tracks"
+	sfu "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+func subCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sub [sid]",
+		Short: "Subscribe to a session and save its VP8 and Opus tracks to disk",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sid, err := sid(args)
+			if err != nil {
+				return err
+			}
+			return sub(sid, viper.GetString("video"), viper.GetString("audio"))
+		},
+	}
+	cmd.Flags().StringP("video", "v", "output.ivf", "ivf file VP8 video is saved to")
+	cmd.Flags().StringP("audio", "o", "output.ogg", "ogg file Opus audio is saved to")
+	return cmd
+}
+
+// sub saves one audio and one video track of a session until their
+// publisher leaves or the connection fails
+func sub(sid, videoFile, audioFile string) error {
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	oggFile, err := oggwriter.New(audioFile, 48000, 2)
+	if err != nil {
+		return err
+	}
+	defer oggFile.Close()
+
+	ivfFile, err := ivfwriter.New(videoFile)
+	if err != nil {
+		return err
+	}
+	defer ivfFile.Close()
+
+	m := webrtc.MediaEngine{}
+	m.RegisterCodec(webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000))
+	m.RegisterCodec(webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000))
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+
+	peerConnection, err := api.NewPeerConnection(configuration())
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+
+	// Allow us to receive 1 audio track, and 1 video track
+	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		return err
+	} else if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	// One Opus and one VP8 track are saved, each written until the peer
+	// connection is closed, before the files are. Both are added to wg
+	// before OnTrack can fire, the ones that never arrive are released
+	// once the peer connection is closed.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	pending := map[string]bool{webrtc.Opus: true, webrtc.VP8: true}
+	wg.Add(len(pending))
+	claim := func(codec string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		ok := pending[codec]
+		delete(pending, codec)
+		return ok
+	}
+
+	peerConnection.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		var write func(pkt *rtp.Packet) error
+		var name string
+		switch track.Codec().Name {
+		case webrtc.Opus:
+			write, name = oggFile.WriteRTP, audioFile
+		case webrtc.VP8:
+			write = func(pkt *rtp.Packet) error {
+				if len(pkt.Payload) < 4 {
+					// payload is not large enough to ivf container header
+					return nil
+				}
+				return ivfFile.WriteRTP(pkt)
+			}
+			name = videoFile
+		default:
+			log.Warnf("Ignoring %s track", track.Codec().Name)
+			return
+		}
+		if !claim(track.Codec().Name) {
+			log.Warnf("Ignoring %s track %s, one is saved already", track.Codec().Name, track.ID())
+			return
+		}
+
+		log.Infof("Got %s track, saving to disk as %s", track.Codec().Name, name)
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			// Request keyframes so that the publisher is pushing one every tracks.PLIInterval
+			go tracks.RequestKeyframes(peerConnection, track, ctx.Done())
+		}
+		go saveTrack(track, &wg, cancel, write)
+	})
+
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Debugf("Connection State has changed %s", connectionState.String())
+		if connectionState == webrtc.ICEConnectionStateFailed ||
+			connectionState == webrtc.ICEConnectionStateDisconnected {
+			cancel()
+		}
+	})
+
+	client := sfuclient.New(sfu.NewSFUClient(conn))
+	client.Events.OnJoin = func(pid string) {
+		log.Infof("joined %s as %s, Ctrl+C to stop", sid, pid)
+	}
+	client.Events.OnError = func(err error) {
+		log.Errorf("signal error %s", err)
+	}
+
+	err = client.Join(ctx, sid, peerConnection)
+	if err == context.Canceled {
+		err = nil
+	}
+	_ = peerConnection.Close()
+	mu.Lock()
+	for codec := range pending {
+		delete(pending, codec)
+		wg.Done()
+	}
+	mu.Unlock()
+	wg.Wait()
+	log.Infof("Done writing media files")
+	return err
+}
+
+// saveTrack writes the packets of a track until it ends, then calls done
+func saveTrack(track *webrtc.Track, wg *sync.WaitGroup, done func(), write func(pkt *rtp.Packet) error) {
+	defer wg.Done()
+	defer done()
+	for {
+		pkt, err := track.ReadRTP()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Error reading %s track: %v", track.Kind(), err)
+			}
+			return
+		}
+		if err = write(pkt); err != nil {
+			log.Errorf("Error writing %s track: %v", track.Kind(), err)
+			return
+		}
+	}
+}
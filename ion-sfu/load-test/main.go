@@ -0,0 +1,402 @@
+// Package load-test spawns publishers and subscribers against an ion-sfu,
+// over custom-signaling's json-rpc or the grpc Signal api, and reports
+// join latency, ICE connect time, packet loss and bitrate.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"google.golang.org/grpc"
+)
+
+var (
+	mode      string
+	addr      string
+	insecure  bool
+	sidPrefix string
+	sessions  int
+	pubs      int
+	subs      int
+	ramp      time.Duration
+	duration  time.Duration
+	videoFile string
+	audioFile string
+	jsonFile  string
+)
+
+func parse() {
+	flag.StringVar(&mode, "mode", "jsonrpc", "signaling to use, jsonrpc or grpc")
+	flag.StringVar(&addr, "a", "wss://localhost:7000/ws", "custom-signaling websocket url, or grpc address")
+	flag.BoolVar(&insecure, "insecure", true, "skip verifying the custom-signaling certificate")
+	flag.StringVar(&sidPrefix, "sid", "load", "session id prefix, sessions are named prefix-N")
+	flag.IntVar(&sessions, "sessions", 1, "number of sessions")
+	flag.IntVar(&pubs, "pubs", 1, "publishers per session")
+	flag.IntVar(&subs, "subs", 1, "subscribers per session")
+	flag.DurationVar(&ramp, "ramp", 10*time.Second, "time over which peers are started")
+	flag.DurationVar(&duration, "d", 30*time.Second, "how long to run once all peers are started")
+	flag.StringVar(&videoFile, "video", "output.ivf", "VP8 ivf file publishers send")
+	flag.StringVar(&audioFile, "audio", "output.ogg", "Opus ogg file publishers send")
+	flag.StringVar(&jsonFile, "json", "", "write the report as json to this file")
+	flag.Parse()
+}
+
+// PeerResult is the outcome of a single publisher or subscriber
+type PeerResult struct {
+	Sid          string  `json:"sid"`
+	Role         string  `json:"role"`
+	Error        string  `json:"error,omitempty"`
+	JoinMs       float64 `json:"joinMs"`
+	ICEConnectMs float64 `json:"iceConnectMs"`
+	Connected    bool    `json:"connected"`
+	Kbps         float64 `json:"kbps"`
+	Lost         uint64  `json:"lost"`
+	Expected     uint64  `json:"expected"`
+
+	join time.Duration
+	ice  time.Duration
+}
+
+// Report summarizes a load test run
+type Report struct {
+	Mode        string       `json:"mode"`
+	Sessions    int          `json:"sessions"`
+	Pubs        int          `json:"pubs"`
+	Subs        int          `json:"subs"`
+	Failed      int          `json:"failed"`
+	Join        Percentiles  `json:"joinMs"`
+	ICEConnect  Percentiles  `json:"iceConnectMs"`
+	LossPercent float64      `json:"lossPercent"`
+	PubKbps     float64      `json:"pubKbps"`
+	SubKbps     float64      `json:"subKbps"`
+	Peers       []PeerResult `json:"peers"`
+}
+
+// runner starts peers and collects their results
+type runner struct {
+	signal signaler
+	api    *webrtc.API
+	video  []frame
+	audio  []frame
+
+	mu      sync.Mutex
+	results []PeerResult
+}
+
+func (r *runner) newPeerConnection() (*webrtc.PeerConnection, error) {
+	return r.api.NewPeerConnection(webrtc.Configuration{})
+}
+
+// run joins one peer and keeps it connected until ctx is done
+func (r *runner) run(ctx context.Context, sid string, publish bool) {
+	res := PeerResult{Sid: sid, Role: "sub"}
+	if publish {
+		res.Role = "pub"
+	}
+	defer func() {
+		r.mu.Lock()
+		r.results = append(r.results, res)
+		r.mu.Unlock()
+	}()
+
+	pc, err := r.newPeerConnection()
+	if err != nil {
+		res.Error = err.Error()
+		return
+	}
+	defer pc.Close()
+
+	start := time.Now()
+	connected := make(chan time.Time, 1)
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			select {
+			case connected <- time.Now():
+			default:
+			}
+		}
+	})
+
+	var (
+		sent   uint64
+		sentMu sync.Mutex
+		stats  []*trackStats
+		statMu sync.Mutex
+	)
+
+	if publish {
+		tracks := map[uint8][]frame{}
+		if len(r.video) > 0 {
+			tracks[webrtc.DefaultPayloadTypeVP8] = r.video
+		}
+		if len(r.audio) > 0 {
+			tracks[webrtc.DefaultPayloadTypeOpus] = r.audio
+		}
+		streamID := fmt.Sprintf("%s-%d", sid, rand.Uint32())
+		for pt, frames := range tracks {
+			track, err := pc.NewTrack(pt, rand.Uint32(), fmt.Sprintf("%s-%d", streamID, pt), streamID)
+			if err != nil {
+				res.Error = err.Error()
+				return
+			}
+			if _, err = pc.AddTrack(track); err != nil {
+				res.Error = err.Error()
+				return
+			}
+			go func(track *webrtc.Track, frames []frame) {
+				if err := send(ctx, track, frames, func(n int) {
+					sentMu.Lock()
+					sent += uint64(n)
+					sentMu.Unlock()
+				}); err != nil {
+					log.Debugf("send error: %v", err)
+				}
+			}(track, frames)
+		}
+	} else {
+		for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+			if _, err = pc.AddTransceiverFromKind(kind, webrtc.RtpTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+				res.Error = err.Error()
+				return
+			}
+		}
+		pc.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+			s := &trackStats{}
+			statMu.Lock()
+			stats = append(stats, s)
+			statMu.Unlock()
+			for {
+				pkt, err := track.ReadRTP()
+				if err != nil {
+					return
+				}
+				s.add(pkt)
+			}
+		})
+	}
+
+	if err = r.signal.join(ctx, sid, pc); err != nil {
+		res.Error = err.Error()
+		return
+	}
+	res.join = time.Since(start)
+	res.JoinMs = float64(res.join) / float64(time.Millisecond)
+
+	var connectedAt time.Time
+	select {
+	case <-ctx.Done():
+		res.Error = "ice did not connect"
+		return
+	case connectedAt = <-connected:
+	}
+	res.Connected = true
+	res.ice = connectedAt.Sub(start)
+	res.ICEConnectMs = float64(res.ice) / float64(time.Millisecond)
+
+	<-ctx.Done()
+	elapsed := time.Since(connectedAt).Seconds()
+
+	if publish {
+		sentMu.Lock()
+		res.Kbps = float64(sent*8) / elapsed / 1000
+		sentMu.Unlock()
+		return
+	}
+
+	statMu.Lock()
+	defer statMu.Unlock()
+	var bytes uint64
+	for _, s := range stats {
+		lost, expected := s.lost()
+		res.Lost += lost
+		res.Expected += expected
+		s.mu.Lock()
+		bytes += s.bytes
+		s.mu.Unlock()
+	}
+	res.Kbps = float64(bytes*8) / elapsed / 1000
+}
+
+// send writes frames to track paced at their playback speed, looping
+// until ctx is done.
+func send(ctx context.Context, track *webrtc.Track, frames []frame, sent func(int)) error {
+	for {
+		for _, f := range frames {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(f.duration):
+			}
+			if err := track.WriteSample(media.Sample{Data: f.data, Samples: f.samples}); err != nil {
+				return err
+			}
+			sent(len(f.data))
+		}
+	}
+}
+
+func (r *runner) report() Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rep := Report{
+		Mode:     mode,
+		Sessions: sessions,
+		Pubs:     pubs,
+		Subs:     subs,
+		Peers:    r.results,
+	}
+
+	var (
+		joins, ices        []time.Duration
+		lost, expected     uint64
+		pubKbps, subKbps   float64
+		pubCount, subCount int
+	)
+	for _, res := range r.results {
+		if res.Error != "" {
+			rep.Failed++
+		}
+		if res.join > 0 {
+			joins = append(joins, res.join)
+		}
+		if res.Connected {
+			ices = append(ices, res.ice)
+			if res.Role == "pub" {
+				pubKbps += res.Kbps
+				pubCount++
+			} else {
+				subKbps += res.Kbps
+				subCount++
+			}
+		}
+		lost += res.Lost
+		expected += res.Expected
+	}
+
+	rep.Join = percentiles(joins)
+	rep.ICEConnect = percentiles(ices)
+	if expected > 0 {
+		rep.LossPercent = float64(lost) / float64(expected) * 100
+	}
+	if pubCount > 0 {
+		rep.PubKbps = pubKbps / float64(pubCount)
+	}
+	if subCount > 0 {
+		rep.SubKbps = subKbps / float64(subCount)
+	}
+	return rep
+}
+
+func printReport(rep Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "mode\t%s\n", rep.Mode)
+	fmt.Fprintf(w, "peers\t%d sessions x (%d pubs + %d subs), %d failed\n", rep.Sessions, rep.Pubs, rep.Subs, rep.Failed)
+	fmt.Fprintf(w, "\tcount\tp50\tp90\tp99\tmax\n")
+	for _, row := range []struct {
+		name string
+		p    Percentiles
+	}{{"join (ms)", rep.Join}, {"ice connect (ms)", rep.ICEConnect}} {
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\n", row.name, row.p.Count, row.p.P50, row.p.P90, row.p.P99, row.p.Max)
+	}
+	fmt.Fprintf(w, "packet loss\t%.2f%%\n", rep.LossPercent)
+	fmt.Fprintf(w, "avg pub bitrate\t%.1f kbps\n", rep.PubKbps)
+	fmt.Fprintf(w, "avg sub bitrate\t%.1f kbps\n", rep.SubKbps)
+	_ = w.Flush()
+}
+
+func main() {
+	parse()
+	log.Init("info", []string{"proc.go", "asm_amd64.s", "jsonrpc2.go"})
+
+	r := &runner{}
+
+	var err error
+	if _, statErr := os.Stat(videoFile); statErr == nil {
+		if r.video, err = loadIVF(videoFile); err != nil {
+			log.Panicf("Error loading %s: %v", videoFile, err)
+		}
+	}
+	if _, statErr := os.Stat(audioFile); statErr == nil {
+		if r.audio, err = loadOgg(audioFile); err != nil {
+			log.Panicf("Error loading %s: %v", audioFile, err)
+		}
+	}
+	if pubs > 0 && len(r.video) == 0 && len(r.audio) == 0 {
+		log.Panicf("Could not find `%s` or `%s`", videoFile, audioFile)
+	}
+
+	switch mode {
+	case "jsonrpc":
+		r.signal = &jsonrpcSignal{url: addr, insecure: insecure}
+	case "grpc":
+		conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock())
+		if err != nil {
+			log.Panicf("did not connect: %v", err)
+		}
+		defer conn.Close()
+		r.signal = &grpcSignal{conn: conn}
+	default:
+		log.Panicf("unknown mode %s", mode)
+	}
+
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	r.api = webrtc.NewAPI(webrtc.WithMediaEngine(m))
+
+	total := sessions * (pubs + subs)
+	if total == 0 {
+		log.Panicf("no peers to start")
+	}
+	interval := ramp / time.Duration(total)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	started := 0
+	for s := 0; s < sessions; s++ {
+		sid := fmt.Sprintf("%s-%d", sidPrefix, s)
+		// Publishers first so subscribers get tracks from their join answer
+		for i := 0; i < pubs+subs; i++ {
+			wg.Add(1)
+			go func(publish bool) {
+				defer wg.Done()
+				r.run(ctx, sid, publish)
+			}(i < pubs)
+
+			started++
+			log.Infof("started %d/%d peers", started, total)
+			time.Sleep(interval)
+		}
+	}
+
+	log.Infof("all peers started, running for %s", duration)
+	time.Sleep(duration)
+	cancel()
+	wg.Wait()
+
+	rep := r.report()
+	printReport(rep)
+
+	if jsonFile != "" {
+		b, err := json.MarshalIndent(rep, "", "  ")
+		if err != nil {
+			log.Panicf("Error marshaling report: %v", err)
+		}
+		if err = ioutil.WriteFile(jsonFile, b, 0644); err != nil {
+			log.Panicf("Error writing %s: %v", jsonFile, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// frame is a single media sample and how long it plays for
+type frame struct {
+	data     []byte
+	samples  uint32
+	duration time.Duration
+}
+
+// loadIVF reads all VP8 frames of an ivf file into memory, so every
+// publisher can send them without touching the disk.
+func loadIVF(name string) ([]frame, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ivf, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+
+	duration := time.Millisecond * time.Duration((float32(header.TimebaseNumerator)/float32(header.TimebaseDenominator))*1000)
+	var frames []frame
+	for {
+		data, _, err := ivf.ParseNextFrame()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame{data: data, samples: uint32(duration.Seconds() * 90000), duration: duration})
+	}
+}
+
+// loadOgg reads all Opus pages of an ogg file into memory
+func loadOgg(name string) ([]frame, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ogg, _, err := oggreader.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep track of last granule, the difference is the amount of samples in the buffer
+	var lastGranule uint64
+	var frames []frame
+	for {
+		data, header, err := ogg.ParseNextPage()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sampleCount := header.GranulePosition - lastGranule
+		lastGranule = header.GranulePosition
+		frames = append(frames, frame{
+			data:     data,
+			samples:  uint32(sampleCount),
+			duration: time.Duration(float64(sampleCount)/48000*1000) * time.Millisecond,
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"github.com/sourcegraph/jsonrpc2"
+	websocketjsonrpc2 "github.com/sourcegraph/jsonrpc2/websocket"
+	"google.golang.org/grpc"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/candidates"
+	"github.com/pion/ion-examples/ion-sfu/internal/sfuclient"
+	sfu "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+// signaler joins a peer connection to a session, it returns once the
+// join answer is applied and keeps handling renegotiation until ctx is done.
+type signaler interface {
+	join(ctx context.Context, sid string, pc *webrtc.PeerConnection) error
+}
+
+var errClosedBeforeJoin = errors.New("signal closed before join")
+
+// answerOffer applies a renegotiation offer and returns the answer
+func answerOffer(pc *webrtc.PeerConnection, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	return answer, pc.SetLocalDescription(answer)
+}
+
+// jsonrpcSignal signals with custom-signaling's json-rpc protocol
+type jsonrpcSignal struct {
+	url      string
+	insecure bool
+}
+
+type jsonrpcHandler struct {
+	pc         *webrtc.PeerConnection
+	candidates *candidates.Buffer
+}
+
+func (h *jsonrpcHandler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Params == nil {
+		return
+	}
+
+	switch req.Method {
+	case "offer":
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(*req.Params, &offer); err != nil {
+			return
+		}
+		answer, err := answerOffer(h.pc, offer)
+		if err != nil {
+			return
+		}
+		_ = conn.Notify(ctx, "answer", map[string]interface{}{"desc": answer})
+
+	case "trickle":
+		var candidate webrtc.ICECandidateInit
+		if err := json.Unmarshal(*req.Params, &candidate); err != nil {
+			return
+		}
+		_ = h.candidates.Add(candidate)
+	}
+}
+
+func (s *jsonrpcSignal) join(ctx context.Context, sid string, pc *webrtc.PeerConnection) error {
+	dialer := websocket.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: s.insecure}, // nolint: gosec
+	}
+	ws, _, err := dialer.DialContext(ctx, s.url, nil)
+	if err != nil {
+		return err
+	}
+
+	h := &jsonrpcHandler{pc: pc, candidates: candidates.New(pc)}
+	conn := jsonrpc2.NewConn(ctx, websocketjsonrpc2.NewObjectStream(ws), h)
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		_ = conn.Notify(ctx, "trickle", map[string]interface{}{"candidate": c.ToJSON()})
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err = pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	var answer webrtc.SessionDescription
+	if err = conn.Call(ctx, "join", map[string]interface{}{"sid": sid, "offer": offer}, &answer); err != nil {
+		return err
+	}
+	if err = pc.SetRemoteDescription(answer); err != nil {
+		return err
+	}
+	return h.candidates.Flush()
+}
+
+// grpcSignal signals with the ion-sfu grpc Signal api
+type grpcSignal struct {
+	conn *grpc.ClientConn
+}
+
+func (s *grpcSignal) join(ctx context.Context, sid string, pc *webrtc.PeerConnection) error {
+	joined := make(chan struct{})
+	done := make(chan error, 1)
+
+	client := sfuclient.New(sfu.NewSFUClient(s.conn))
+	client.Events.OnJoin = func(string) {
+		close(joined)
+	}
+	go func() {
+		done <- client.Join(ctx, sid, pc)
+	}()
+
+	select {
+	case <-joined:
+		return nil
+	case err := <-done:
+		if err == nil {
+			err = errClosedBeforeJoin
+		}
+		return err
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// trackStats counts the packets received on a track, loss is derived
+// from gaps in the extended sequence numbers.
+type trackStats struct {
+	mu       sync.Mutex
+	started  bool
+	first    uint32
+	highest  uint32
+	cycles   uint32
+	lastSeq  uint16
+	received uint64
+	bytes    uint64
+}
+
+func (s *trackStats) add(pkt *rtp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.received++
+	s.bytes += uint64(len(pkt.Payload))
+
+	if !s.started {
+		s.started = true
+		s.first = uint32(pkt.SequenceNumber)
+		s.highest = s.first
+		s.lastSeq = pkt.SequenceNumber
+		return
+	}
+
+	// Only packets newer than the highest one move it, late and
+	// duplicate ones are counted as received
+	if int16(pkt.SequenceNumber-s.lastSeq) <= 0 {
+		return
+	}
+	// Sequence numbers wrapped around
+	if pkt.SequenceNumber < s.lastSeq {
+		s.cycles += 1 << 16
+	}
+	s.highest = s.cycles | uint32(pkt.SequenceNumber)
+	s.lastSeq = pkt.SequenceNumber
+}
+
+// lost returns the number of packets expected but not received
+func (s *trackStats) lost() (lost, expected uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return 0, 0
+	}
+	expected = uint64(s.highest-s.first) + 1
+	if s.received >= expected {
+		return 0, expected
+	}
+	return expected - s.received, expected
+}
+
+// Percentiles summarizes a set of durations in milliseconds
+type Percentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+func percentiles(d []time.Duration) Percentiles {
+	if len(d) == 0 {
+		return Percentiles{}
+	}
+	sorted := append([]time.Duration{}, d...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	at := func(p float64) float64 {
+		i := int(p * float64(len(sorted)-1))
+		return float64(sorted[i]) / float64(time.Millisecond)
+	}
+	return Percentiles{
+		Count: len(sorted),
+		P50:   at(0.5),
+		P90:   at(0.9),
+		P99:   at(0.99),
+		Max:   float64(sorted[len(sorted)-1]) / float64(time.Millisecond),
+	}
+}
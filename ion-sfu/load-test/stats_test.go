@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestTrackStatsLost(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		seqs     []uint16
+		lost     uint64
+		expected uint64
+	}{
+		{"in order", []uint16{1, 2, 3, 4}, 0, 4},
+		{"gap", []uint16{1, 2, 5}, 2, 5},
+		{"reordered", []uint16{1, 3, 2, 4}, 0, 4},
+		{"duplicate", []uint16{1, 2, 2, 3}, 0, 3},
+		{"wrap", []uint16{65534, 65535, 0, 1}, 0, 4},
+		{"gap across wrap", []uint16{65534, 1}, 2, 4},
+		{"late before wrap", []uint16{65533, 65535, 0, 65534, 1}, 0, 5},
+		{"late after wrap", []uint16{65535, 1, 0, 2}, 0, 4},
+	} {
+		var s trackStats
+		for _, seq := range tt.seqs {
+			s.add(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}})
+		}
+		if lost, expected := s.lost(); lost != tt.lost || expected != tt.expected {
+			t.Errorf("%s: got %d lost of %d, want %d of %d", tt.name, lost, expected, tt.lost, tt.expected)
+		}
+	}
+}
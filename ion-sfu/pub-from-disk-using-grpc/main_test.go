@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"google.golang.org/grpc"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/harness"
+	sfu "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+// writeIVF writes an ivf file of frames synthetic VP8 keyframes, at 30fps
+func writeIVF(t *testing.T, name string, frames int) {
+	t.Helper()
+	w, err := ivfwriter.New(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a payload descriptor starting a partition, then a keyframe
+	payload := append([]byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}, make([]byte, 500)...)
+	for i := 0; i < frames; i++ {
+		if err = w.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Marker:         true,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 3000),
+			},
+			Payload: payload,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeOgg writes an ogg file of pages synthetic 20ms Opus packets
+func writeOgg(t *testing.T, name string, pages int) {
+	t.Helper()
+	w, err := oggwriter.New(name, 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := append([]byte{0xfc}, make([]byte, 80)...)
+	for i := 0; i < pages; i++ {
+		if err = w.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 960),
+			},
+			Payload: payload,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	addr := harness.StartGRPC(t, harness.SFUConfig)
+
+	// Ten seconds of media, the publish ends once the first file is sent
+	dir := t.TempDir()
+	videoFile, audioFile := filepath.Join(dir, videoFileName), filepath.Join(dir, audioFileName)
+	writeIVF(t, videoFile, 300)
+	writeOgg(t, audioFile, 500)
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	published := make(chan error, 1)
+	go func() {
+		published <- publish(ctx, sfu.NewSFUClient(conn), "test", videoFile, audioFile)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-published; err != nil {
+			t.Errorf("publish: %v", err)
+		}
+	})
+
+	sub := harness.NewPeer(t)
+	sub.Receive(t)
+	harness.DialGRPC(t, addr, sub).Join(t, "test")
+
+	sub.WaitForPackets(t, 2, 50, 20*time.Second)
+}
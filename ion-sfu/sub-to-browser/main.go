@@ -4,77 +4,41 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"os"
 
-	sfu "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+	"github.com/pion/ion-examples/ion-sfu/internal/sfuclient"
 	"github.com/pion/ion-examples/ion-sfu/internal/signal"
+	sfu "github.com/pion/ion-sfu/cmd/server/grpc/proto"
 	"github.com/pion/webrtc/v3"
 	"google.golang.org/grpc"
 )
 
-const (
-	address = "localhost:50051"
-)
-
 func main() {
+	address := flag.String("addr", "localhost:50051", "ion-sfu grpc address")
+	flag.Parse()
+
 	// Set up a connection to the server.
-	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithBlock())
+	conn, err := grpc.Dial(*address, grpc.WithInsecure(), grpc.WithBlock())
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
 	defer conn.Close()
-	c := sfu.NewSFUClient(conn)
+	c := sfuclient.New(sfu.NewSFUClient(conn))
 
 	subOffer := webrtc.SessionDescription{}
 	signal.Decode(signal.MustReadStdin(), &subOffer)
 
-	sid := os.Args[1]
-
-	ctx := context.Background()
-	client, err := c.Signal(ctx)
-
+	sid := flag.Arg(0)
+	err = c.JoinOffer(context.Background(), sid, subOffer, func(pid string, answer webrtc.SessionDescription) {
+		// Output the pid and answer in base64 so we can paste it in browser
+		fmt.Printf("\npid: %s", pid)
+		fmt.Printf("\nsub answer: %s", signal.Encode(answer))
+	})
 	if err != nil {
-		log.Panicf("Error subscribing: %v", err)
-	}
-
-	err = client.Send(&sfu.SignalRequest{
-		Payload: &sfu.SignalRequest_Join{
-			Join: &sfu.JoinRequest{
-				Sid: sid,
-				Offer: &sfu.SessionDescription{
-					Type: subOffer.Type.String(),
-					Sdp:  []byte(subOffer.SDP),
-				},
-			},
-		}})
-
-	if err != nil {
-		log.Fatalf("Error sending subscribe request: %v", err)
-	}
-
-	for {
-		reply, err := client.Recv()
-		if err == io.EOF {
-			// WebRTC Transport closed
-			fmt.Println("WebRTC Transport Closed")
-			return
-		}
-
-		if err != nil {
-			log.Fatalf("Error receiving publish response: %v", err)
-		}
-
-		if payload, ok := reply.Payload.(*sfu.SignalReply_Join); ok {
-			// Output the mid and answer in base64 so we can paste it in browser
-			fmt.Printf("\npid: %s", payload.Join.Pid)
-			fmt.Printf("\nsub answer: %s", signal.Encode(
-				webrtc.SessionDescription{
-					Type: webrtc.SDPTypeAnswer,
-					SDP:  string(payload.Join.Answer.Sdp),
-				}))
-		}
+		log.Fatalf("Error signaling: %v", err)
 	}
+	// WebRTC Transport closed
+	fmt.Println("WebRTC Transport Closed")
 }
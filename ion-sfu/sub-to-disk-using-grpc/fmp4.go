@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Fragmented MP4 of ISO/IEC 14496-12, with H264 in avc1 sample entries of
+// ISO/IEC 14496-15 and Opus in Opus sample entries of the Encapsulation of
+// Opus in ISO Base Media File Format.
+
+const (
+	// sample flags of trun, a keyframe doesn't depend on other samples,
+	// other frames do and aren't sync samples
+	sampleFlagsKeyframe = 0x02000000
+	sampleFlagsDelta    = 0x01010000
+
+	trunDataOffset   = 0x000001
+	trunDuration     = 0x000100
+	trunSize         = 0x000200
+	trunFlags        = 0x000400
+	tfhdBaseIsMoof   = 0x020000
+	movieTimescale   = 1000
+	opusSampleRate   = 48000
+	opusChannels     = 2
+	videoTimescale   = 90000
+	trackEnabledFlag = 0x000003
+)
+
+// unityMatrix is the transformation matrix of mvhd and tkhd
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// mp4Track describes a track of the init segment
+type mp4Track struct {
+	id        uint32
+	timescale uint32
+	video     bool
+	// width and height of a video track, with its SPS and PPS
+	width, height int
+	sps, pps      []byte
+}
+
+// mp4Sample is a frame of a fragment
+type mp4Sample struct {
+	data     []byte
+	duration uint32
+	keyframe bool
+}
+
+// mp4Fragment holds the samples of a track in a fragment, starting at
+// decodeTime in the track's timescale
+type mp4Fragment struct {
+	track      uint32
+	decodeTime uint64
+	samples    []mp4Sample
+}
+
+// box writes the size and type of a box in front of its payload
+func box(typ string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+	copy(b[4:], typ)
+	return append(b, payload...)
+}
+
+// fullBox writes a box with a version and flags
+func fullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payloads...)...)
+}
+
+// be writes big endian fields, the size of each given by its type
+func be(fields ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		_ = binary.Write(&buf, binary.BigEndian, f)
+	}
+	return buf.Bytes()
+}
+
+// mp4Init returns the init segment of tracks, with no samples in moov so
+// they all come in fragments
+func mp4Init(tracks []mp4Track) []byte {
+	ftyp := box("ftyp", []byte("iso5"), be(uint32(512)), []byte("iso5iso6mp41"))
+
+	var nextID uint32
+	traks := make([][]byte, 0, len(tracks))
+	trexs := make([][]byte, 0, len(tracks))
+	for _, t := range tracks {
+		traks = append(traks, t.trak())
+		trexs = append(trexs, fullBox("trex", 0, 0, be(t.id, uint32(1), uint32(0), uint32(0), uint32(0))))
+		if t.id >= nextID {
+			nextID = t.id + 1
+		}
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		be(uint32(0), uint32(0), uint32(movieTimescale), uint32(0)), // times, timescale, duration
+		be(uint32(0x00010000), uint16(0x0100), make([]byte, 10)),    // rate, volume, reserved
+		be(unityMatrix),
+		make([]byte, 24), // pre_defined
+		be(nextID),
+	)
+	moov := box("moov", append([][]byte{mvhd}, append(traks, box("mvex", trexs...))...)...)
+	return append(ftyp, moov...)
+}
+
+func (t mp4Track) trak() []byte {
+	volume, handler, name := uint16(0x0100), "soun", "SoundHandler"
+	header := fullBox("smhd", 0, 0, be(uint16(0), uint16(0)))
+	if t.video {
+		volume, handler, name = 0, "vide", "VideoHandler"
+		header = fullBox("vmhd", 0, 1, be(uint16(0), uint16(0), uint16(0), uint16(0)))
+	}
+
+	tkhd := fullBox("tkhd", 0, trackEnabledFlag,
+		// times, track_ID, reserved, duration, reserved
+		be(uint32(0), uint32(0), t.id, uint32(0), uint32(0), make([]byte, 8)),
+		// layer, alternate_group, volume, reserved
+		be(uint16(0), uint16(0), volume, uint16(0)),
+		be(unityMatrix),
+		be(uint32(t.width)<<16, uint32(t.height)<<16),
+	)
+	mdhd := fullBox("mdhd", 0, 0,
+		be(uint32(0), uint32(0), t.timescale, uint32(0)),
+		be(uint16(0x55c4), uint16(0)), // language und, pre_defined
+	)
+	hdlr := fullBox("hdlr", 0, 0, be(uint32(0)), []byte(handler), make([]byte, 12), []byte(name+"\x00"))
+	dinf := box("dinf", fullBox("dref", 0, 0, be(uint32(1)), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, be(uint32(1)), t.sampleEntry()),
+		fullBox("stts", 0, 0, be(uint32(0))),
+		fullBox("stsc", 0, 0, be(uint32(0))),
+		fullBox("stsz", 0, 0, be(uint32(0), uint32(0))),
+		fullBox("stco", 0, 0, be(uint32(0))),
+	)
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", header, dinf, stbl)))
+}
+
+func (t mp4Track) sampleEntry() []byte {
+	// reserved and data_reference_index
+	entry := be(make([]byte, 6), uint16(1))
+	if !t.video {
+		// Version, OutputChannelCount, PreSkip, InputSampleRate,
+		// OutputGain and ChannelMappingFamily
+		dOps := box("dOps", be(uint8(0), uint8(opusChannels), uint16(0), uint32(opusSampleRate), int16(0), uint8(0)))
+		// reserved, channelcount, samplesize, pre_defined, reserved and
+		// samplerate
+		return box("Opus", entry,
+			be(make([]byte, 8), uint16(opusChannels), uint16(16), uint32(0), uint32(opusSampleRate)<<16),
+			dOps,
+		)
+	}
+
+	// version, profile, compatibility and level, 4 byte NAL unit
+	// lengths, then the one SPS and PPS
+	avcC := box("avcC",
+		[]byte{1, t.sps[1], t.sps[2], t.sps[3], 0xff, 0xe1},
+		be(uint16(len(t.sps))), t.sps,
+		[]byte{1}, be(uint16(len(t.pps))), t.pps,
+	)
+	// pre_defined and reserved, width, height, resolution, reserved,
+	// frame_count, compressorname, depth and pre_defined
+	return box("avc1", entry,
+		make([]byte, 16),
+		be(uint16(t.width), uint16(t.height)),
+		be(uint32(0x00480000), uint32(0x00480000), uint32(0), uint16(1)),
+		make([]byte, 32),
+		be(uint16(0x0018), int16(-1)),
+		avcC,
+	)
+}
+
+// mp4Segment returns the moof and mdat of a fragment holding the samples
+// of every track
+func mp4Segment(sequence uint32, fragments []mp4Fragment) []byte {
+	// the data offsets depend on the size of moof, which they don't change
+	moof := mp4Moof(sequence, fragments, nil)
+	offsets := make([]uint32, len(fragments))
+	offset := uint32(len(moof) + 8)
+	var mdat [][]byte
+	for i, f := range fragments {
+		offsets[i] = offset
+		for _, s := range f.samples {
+			mdat = append(mdat, s.data)
+			offset += uint32(len(s.data))
+		}
+	}
+	return append(mp4Moof(sequence, fragments, offsets), box("mdat", mdat...)...)
+}
+
+func mp4Moof(sequence uint32, fragments []mp4Fragment, offsets []uint32) []byte {
+	trafs := [][]byte{fullBox("mfhd", 0, 0, be(sequence))}
+	for i, f := range fragments {
+		var offset uint32
+		if offsets != nil {
+			offset = offsets[i]
+		}
+		trun := [][]byte{be(uint32(len(f.samples)), offset)}
+		for _, s := range f.samples {
+			flags := uint32(sampleFlagsDelta)
+			if s.keyframe {
+				flags = sampleFlagsKeyframe
+			}
+			trun = append(trun, be(s.duration, uint32(len(s.data)), flags))
+		}
+		trafs = append(trafs, box("traf",
+			fullBox("tfhd", 0, tfhdBaseIsMoof, be(f.track)),
+			fullBox("tfdt", 1, 0, be(f.decodeTime)),
+			fullBox("trun", 0, trunDataOffset|trunDuration|trunSize|trunFlags, trun...),
+		))
+	}
+	return box("moof", trafs...)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/rtp"
+)
+
+// H264 NAL unit types, https://tools.ietf.org/html/rfc6184#section-5.4
+const (
+	naluTypeIDR   = 5
+	naluTypeSPS   = 7
+	naluTypePPS   = 8
+	naluTypeSTAPA = 24
+	naluTypeFUA   = 28
+
+	naluTypeBitmask   = 0x1f
+	naluRefIdcBitmask = 0x60
+	fuaStartBitmask   = 0x80
+	fuaEndBitmask     = 0x40
+)
+
+var (
+	annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+	errShortPacket = errors.New("packet too short")
+	errInvalidSPS  = errors.New("invalid SPS")
+)
+
+// h264Depacketizer returns the NAL units of H264 rtp packets, dropping
+// fragmented ones that lost a packet
+type h264Depacketizer struct {
+	// fragments of the FU-A NAL unit being reassembled
+	fua     []byte
+	lastSeq uint16
+	started bool
+}
+
+// push adds a packet, returning the NAL units it completes
+func (d *h264Depacketizer) push(pkt *rtp.Packet) ([][]byte, error) {
+	payload := pkt.Payload
+	if len(payload) < 1 {
+		return nil, nil
+	}
+
+	gap := d.started && pkt.SequenceNumber != d.lastSeq+1
+	d.started = true
+	d.lastSeq = pkt.SequenceNumber
+
+	switch naluType := payload[0] & naluTypeBitmask; {
+	case naluType > 0 && naluType < naluTypeSTAPA:
+		d.fua = nil
+		return [][]byte{payload}, nil
+
+	case naluType == naluTypeSTAPA:
+		d.fua = nil
+		var nalus [][]byte
+		for offset := 1; offset < len(payload); {
+			if offset+2 > len(payload) {
+				return nalus, errShortPacket
+			}
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			offset += 2
+			if offset+size > len(payload) {
+				return nalus, errShortPacket
+			}
+			nalus = append(nalus, payload[offset:offset+size])
+			offset += size
+		}
+		return nalus, nil
+
+	case naluType == naluTypeFUA:
+		if len(payload) < 2 {
+			return nil, errShortPacket
+		}
+		header := payload[1]
+		if header&fuaStartBitmask != 0 {
+			// the NAL unit header is rebuilt from the indicator and FU header
+			d.fua = append(d.fua[:0], payload[0]&(0x80|naluRefIdcBitmask)|header&naluTypeBitmask)
+		} else if d.fua == nil || gap {
+			// the start or a middle fragment was lost
+			d.fua = nil
+			return nil, nil
+		}
+		d.fua = append(d.fua, payload[2:]...)
+		if header&fuaEndBitmask == 0 {
+			return nil, nil
+		}
+		nalu := d.fua
+		d.fua = nil
+		return [][]byte{nalu}, nil
+
+	default:
+		log.Debugf("Ignoring H264 NAL unit type %d", naluType)
+		return nil, nil
+	}
+}
+
+// h264Writer depacketizes H264 into an Annex-B byte stream. It starts on
+// the first IDR it has a SPS and PPS for, and puts the last SPS and PPS
+// in front of every IDR that doesn't come with its own, so the file can
+// be played from any keyframe.
+type h264Writer struct {
+	file *os.File
+
+	nalus   h264Depacketizer
+	started bool
+
+	sps, pps []byte
+	// whether the access unit being written has its own SPS and PPS
+	auSPS, auPPS bool
+	seenIDR      bool
+	timestamp    uint32
+}
+
+func newH264Writer(name string) (*h264Writer, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &h264Writer{file: f}, nil
+}
+
+// continueFrom starts the writer with the SPS and PPS of the previous
+// segment of the track, so the segment can be decoded on its own when the
+// publisher sent them once or out of band
+func (w *h264Writer) continueFrom(prev *h264Writer) {
+	w.sps = append([]byte(nil), prev.sps...)
+	w.pps = append([]byte(nil), prev.pps...)
+	if len(w.sps) == 0 || len(w.pps) == 0 {
+		w.sps, w.pps = nil, nil
+	}
+}
+
+// WriteRTP depacketizes a packet, writing the NAL units it completes
+func (w *h264Writer) WriteRTP(pkt *rtp.Packet) error {
+	if !w.started || pkt.Timestamp != w.timestamp {
+		w.auSPS, w.auPPS = false, false
+	}
+	w.started = true
+	w.timestamp = pkt.Timestamp
+
+	nalus, err := w.nalus.push(pkt)
+	for _, nalu := range nalus {
+		if werr := w.writeNALU(nalu); werr != nil {
+			return werr
+		}
+	}
+	return err
+}
+
+// writeNALU writes a complete NAL unit once the stream can be decoded
+func (w *h264Writer) writeNALU(nalu []byte) error {
+	if len(nalu) == 0 {
+		return nil
+	}
+
+	switch nalu[0] & naluTypeBitmask {
+	case naluTypeSPS:
+		w.sps = append(w.sps[:0], nalu...)
+		w.auSPS = true
+	case naluTypePPS:
+		w.pps = append(w.pps[:0], nalu...)
+		w.auPPS = true
+	case naluTypeIDR:
+		if w.sps == nil || w.pps == nil {
+			// can't decode without them, wait for the next keyframe
+			return nil
+		}
+		if !w.seenIDR || !w.auSPS || !w.auPPS {
+			if err := w.write(w.sps); err != nil {
+				return err
+			}
+			if err := w.write(w.pps); err != nil {
+				return err
+			}
+			w.auSPS, w.auPPS = true, true
+		}
+		w.seenIDR = true
+	}
+
+	if !w.seenIDR {
+		return nil
+	}
+	return w.write(nalu)
+}
+
+func (w *h264Writer) write(nalu []byte) error {
+	if _, err := w.file.Write(annexBStartCode); err != nil {
+		return err
+	}
+	_, err := w.file.Write(nalu)
+	return err
+}
+
+// Close the file
+func (w *h264Writer) Close() error {
+	return w.file.Close()
+}
+
+// h264FrameStart reports whether a packet starts a NAL unit, the start of
+// an access unit can't be told apart
+func h264FrameStart(pkt *rtp.Packet) bool {
+	if len(pkt.Payload) < 2 {
+		return false
+	}
+	if pkt.Payload[0]&naluTypeBitmask == naluTypeFUA {
+		return pkt.Payload[1]&fuaStartBitmask != 0
+	}
+	return true
+}
+
+// h264Keyframe reports whether an access unit has an IDR
+func h264Keyframe(frame []*rtp.Packet) bool {
+	for _, pkt := range frame {
+		payload := pkt.Payload
+		if len(payload) < 2 {
+			continue
+		}
+		switch payload[0] & naluTypeBitmask {
+		case naluTypeIDR:
+			return true
+		case naluTypeFUA:
+			if payload[1]&naluTypeBitmask == naluTypeIDR {
+				return true
+			}
+		case naluTypeSTAPA:
+			for offset := 1; offset+2 < len(payload); {
+				size := int(binary.BigEndian.Uint16(payload[offset:]))
+				offset += 2
+				if payload[offset]&naluTypeBitmask == naluTypeIDR {
+					return true
+				}
+				offset += size
+			}
+		}
+	}
+	return false
+}
+
+// h264Resolution reads the picture size from a SPS, ITU-T H.264 section
+// 7.3.2.1.1, after the frame cropping
+func h264Resolution(sps []byte) (width, height int, err error) {
+	// emulation prevention bytes aren't part of the syntax
+	rbsp := make([]byte, 0, len(sps))
+	for i := 0; i < len(sps); i++ {
+		if i >= 2 && sps[i] == 0x03 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+	if len(rbsp) < 4 {
+		return 0, 0, errShortPacket
+	}
+
+	r := &bitReader{data: rbsp[4:]}
+	profile := rbsp[1]
+	r.ue() // seq_parameter_set_id
+
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		// seq_scaling_matrix_present_flag
+		if r.bit() == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	// pic_order_cnt_type
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bit())
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	width = widthMbs * 16
+	height = (2 - frameMbsOnly) * heightMapUnits * 16
+	// frame_cropping_flag
+	if r.bit() == 1 {
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		cropX, cropY := 1, 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		width -= cropX * (left + right)
+		height -= cropY * (top + bottom)
+	}
+	if r.err != nil {
+		return 0, 0, r.err
+	}
+	if width <= 0 || height <= 0 {
+		return 0, 0, errInvalidSPS
+	}
+	return width, height, nil
+}
+
+// bitReader reads the bits and Exp-Golomb codes of a RBSP
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bit() uint {
+	if r.pos >= len(r.data)*8 {
+		r.err = errShortPacket
+		return 0
+	}
+	b := uint(r.data[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return b
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 {
+		if r.err != nil || zeros == 31 {
+			r.err = errShortPacket
+			return 0
+		}
+		zeros++
+	}
+	v := uint(1)
+	for i := 0; i < zeros; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v - 1
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
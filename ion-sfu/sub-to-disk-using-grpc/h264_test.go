@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestH264Writer(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	pps := []byte{0x68, 0xce}
+	packets := []struct {
+		seq     uint16
+		ts      uint32
+		payload []byte
+	}{
+		// a slice before the first keyframe is skipped
+		{1, 0, []byte{0x41, 0x9a}},
+		// SPS and PPS in a STAP-A, then an IDR in two FU-A fragments
+		{2, 3000, append(append([]byte{0x78, 0x00, 0x04}, sps...), append([]byte{0x00, 0x02}, pps...)...)},
+		{3, 3000, []byte{0x7c, 0x85, 0xb8, 0x01}},
+		{4, 3000, []byte{0x7c, 0x45, 0x02, 0x03}},
+		{5, 6000, []byte{0x41, 0x9b}},
+		// an IDR without its own SPS and PPS gets the last ones
+		{6, 9000, []byte{0x65, 0x88}},
+		// a fragmented slice that lost its middle is dropped
+		{7, 12000, []byte{0x5c, 0x81, 0xaa}},
+		{9, 12000, []byte{0x5c, 0x41, 0xbb}},
+		{10, 15000, []byte{0x41, 0x9c}},
+	}
+
+	name := filepath.Join(t.TempDir(), "test.h264")
+	w, err := newH264Writer(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range packets {
+		if err = w.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts},
+			Payload: p.payload,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0x00, 0x1f,
+		0x00, 0x00, 0x00, 0x01, 0x68, 0xce,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0xb8, 0x01, 0x02, 0x03,
+		0x00, 0x00, 0x00, 0x01, 0x41, 0x9b,
+		0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0x00, 0x1f,
+		0x00, 0x00, 0x00, 0x01, 0x68, 0xce,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x88,
+		0x00, 0x00, 0x00, 0x01, 0x41, 0x9c,
+	}
+	got, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got\n% x\nwant\n% x", got, want)
+	}
+}
+
+func TestH264WriterFixtures(t *testing.T) {
+	testFixtures(t, ".h264", func(name string) (trackWriter, error) {
+		return newH264Writer(name)
+	})
+}
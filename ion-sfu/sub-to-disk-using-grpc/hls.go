@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// segments are cut on the first video keyframe after this long, the
+	// publisher's keyframe interval can make them longer
+	hlsSegmentDuration = 2 * time.Second
+	// segments listed in index.m3u8
+	hlsPlaylistSize = 6
+	// segments kept after they left the playlist, for players still
+	// fetching them
+	hlsKeepSegments = 2
+	// how long an audio only stream waits for a video track, like WebM
+	hlsVideoWait = webmJoinWait
+
+	naluTypeAUD = 9
+)
+
+var (
+	errHLSStarted = errors.New("hls stream already started")
+	errHLSCodec   = errors.New("codec can't be packaged for hls")
+	errHLSVideo   = errors.New("hls stream already has a video track")
+	errHLSStream  = errors.New("stream id doesn't name a hls directory")
+)
+
+// hlsMuxer packages the H264 and Opus tracks of a stream into fragmented
+// MP4 segments with a rolling index.m3u8, in a directory of the stream.
+// Tracks are added until the stream starts, on the first H264 keyframe
+// with a SPS and PPS, or on the first Opus frame after hlsVideoWait
+// without a video track. Frames before that are dropped.
+//
+// Decode times come from the rtp timestamps of a track, offset by when
+// its first frame arrived after the stream started, like the WebM muxer.
+// A segment holds one fragment, cut on a video keyframe, with the samples
+// whose duration is known by then.
+type hlsMuxer struct {
+	mu      sync.Mutex
+	root    string
+	dir     string
+	created time.Time
+
+	tracks  []*hlsTrack
+	open    int
+	started time.Time
+	running bool
+	closed  bool
+
+	sequence uint32
+	playlist []hlsSegment
+	expired  []string
+}
+
+type hlsSegment struct {
+	name     string
+	duration float64
+}
+
+func newHLSMuxer(root, stream string) (*hlsMuxer, error) {
+	dir, err := hlsStreamDir(root, stream)
+	if err != nil {
+		return nil, err
+	}
+	return &hlsMuxer{root: root, dir: dir, created: time.Now()}, nil
+}
+
+// hlsStreamDir returns the directory of a stream in root. The stream id
+// comes from the publisher, so ids naming root or its parent, like . and
+// .., are refused.
+func hlsStreamDir(root, stream string) (string, error) {
+	name := unsafeChars.ReplaceAllString(stream, "_")
+	if name == "" || name == "." || name == ".." {
+		return "", errHLSStream
+	}
+	dir := filepath.Join(root, name)
+	if !inDir(root, dir) {
+		return "", errHLSStream
+	}
+	return dir, nil
+}
+
+// inDir reports whether path is a file or directory below dir
+func inDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// hlsTrack is the trackWriter of a track packaged by a hlsMuxer
+type hlsTrack struct {
+	m         *hlsMuxer
+	id        uint32
+	video     bool
+	timescale uint32
+
+	// the access unit being assembled, as length prefixed NAL units
+	nalus    h264Depacketizer
+	au       []byte
+	keyframe bool
+	sps, pps []byte
+
+	begun   bool
+	base    int64
+	firstTS int64
+	lastTS  uint32
+	ts      int64
+
+	// the last sample waits for the next one to know its duration
+	pending     *mp4Sample
+	pendingTime int64
+	samples     []mp4Sample
+	// decode time of the first of samples
+	fragmentTime int64
+}
+
+// addTrack adds a track to the stream, it fails once the stream started
+// or the last track closed
+func (m *hlsMuxer) addTrack(track *webrtc.Track) (*hlsTrack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running || m.closed {
+		return nil, errHLSStarted
+	}
+
+	t := &hlsTrack{m: m, id: uint32(len(m.tracks) + 1)}
+	switch track.Codec().Name {
+	case webrtc.H264:
+		for _, other := range m.tracks {
+			if other.video {
+				return nil, errHLSVideo
+			}
+		}
+		t.video, t.timescale = true, videoTimescale
+	case webrtc.Opus:
+		t.timescale = opusSampleRate
+	default:
+		return nil, errHLSCodec
+	}
+	m.tracks = append(m.tracks, t)
+	m.open++
+	return t, nil
+}
+
+// isClosed reports whether the last track ended the stream
+func (m *hlsMuxer) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// WriteRTP depacketizes a packet, writing the sample it ends
+func (t *hlsTrack) WriteRTP(pkt *rtp.Packet) error {
+	if !t.video {
+		if len(pkt.Payload) == 0 {
+			return nil
+		}
+		data := append([]byte(nil), pkt.Payload...)
+		return t.m.writeSample(t, data, true, pkt.Timestamp)
+	}
+
+	nalus, err := t.nalus.push(pkt)
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & naluTypeBitmask {
+		case naluTypeSPS:
+			t.sps = append(t.sps[:0], nalu...)
+		case naluTypePPS:
+			t.pps = append(t.pps[:0], nalu...)
+		case naluTypeAUD:
+			// samples are delimited by the container
+		case naluTypeIDR:
+			t.keyframe = true
+			fallthrough
+		default:
+			size := len(nalu)
+			t.au = append(t.au, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+			t.au = append(t.au, nalu...)
+		}
+	}
+	if err != nil || !pkt.Marker {
+		return err
+	}
+
+	au, keyframe := t.au, t.keyframe
+	t.au, t.keyframe = nil, false
+	if len(au) == 0 {
+		return nil
+	}
+	return t.m.writeSample(t, au, keyframe, pkt.Timestamp)
+}
+
+// Close the track, the last one to close ends the playlist
+func (t *hlsTrack) Close() error {
+	return t.m.closeTrack()
+}
+
+// hasVideo reports whether a video track was added
+func (m *hlsMuxer) hasVideo() bool {
+	for _, t := range m.tracks {
+		if t.video {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *hlsMuxer) writeSample(t *hlsTrack, data []byte, keyframe bool, ts uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.running {
+		if m.closed {
+			return nil
+		}
+		if t.video && (!keyframe || len(t.sps) < 4 || t.pps == nil) {
+			return nil
+		}
+		if !t.video && (m.hasVideo() || time.Since(m.created) < hlsVideoWait) {
+			return nil
+		}
+		if err := m.start(); err != nil {
+			return err
+		}
+	}
+
+	// extend the rtp timestamp so it doesn't wrap
+	if !t.begun {
+		t.begun = true
+		t.base = int64(time.Since(m.started)) * int64(t.timescale) / int64(time.Second)
+		t.lastTS = ts
+		t.firstTS, t.ts = int64(ts), int64(ts)
+	}
+	t.ts += int64(int32(ts - t.lastTS))
+	t.lastTS = ts
+	decodeTime := t.base + t.ts - t.firstTS
+
+	if t.pending != nil {
+		t.pending.duration = uint32(max64(decodeTime-t.pendingTime, 0))
+		if len(t.samples) == 0 {
+			t.fragmentTime = t.pendingTime
+		}
+		t.samples = append(t.samples, *t.pending)
+	}
+	t.pending = &mp4Sample{data: data, keyframe: keyframe}
+	t.pendingTime = decodeTime
+
+	cut := (t.video && keyframe) || !m.hasVideo()
+	if cut && len(t.samples) > 0 &&
+		time.Duration(decodeTime-t.fragmentTime)*time.Second/time.Duration(t.timescale) >= hlsSegmentDuration {
+		if err := m.writeSegment(t, false); err != nil {
+			return err
+		}
+		return m.writePlaylist(false)
+	}
+	return nil
+}
+
+// start clears the directory of the stream and writes the init segment
+func (m *hlsMuxer) start() error {
+	if !inDir(m.root, m.dir) {
+		return errHLSStream
+	}
+	if err := os.RemoveAll(m.dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+
+	var tracks []mp4Track
+	for _, t := range m.tracks {
+		mt := mp4Track{id: t.id, timescale: t.timescale, video: t.video}
+		if t.video {
+			mt.sps, mt.pps = t.sps, t.pps
+			width, height, err := h264Resolution(t.sps)
+			if err != nil {
+				log.Warnf("Error reading the resolution of the SPS: %v", err)
+				width, height = 640, 480
+			}
+			mt.width, mt.height = width, height
+		}
+		tracks = append(tracks, mt)
+	}
+	if err := ioutil.WriteFile(filepath.Join(m.dir, "init.mp4"), mp4Init(tracks), 0644); err != nil {
+		return err
+	}
+
+	m.running = true
+	m.started = time.Now()
+	return nil
+}
+
+// writeSegment writes the samples of every track to the next segment and
+// adds it to the playlist, its duration is the one of the clock track. At
+// the end, the pending samples go too, lasting as long as the one before.
+func (m *hlsMuxer) writeSegment(clock *hlsTrack, end bool) error {
+	var fragments []mp4Fragment
+	for _, t := range m.tracks {
+		if end && t.pending != nil {
+			if len(t.samples) == 0 {
+				t.fragmentTime = t.pendingTime
+			} else {
+				t.pending.duration = t.samples[len(t.samples)-1].duration
+			}
+			t.samples = append(t.samples, *t.pending)
+			t.pending = nil
+		}
+		if len(t.samples) == 0 {
+			continue
+		}
+		fragments = append(fragments, mp4Fragment{
+			track:      t.id,
+			decodeTime: uint64(t.fragmentTime),
+			samples:    t.samples,
+		})
+	}
+	if len(fragments) == 0 {
+		return nil
+	}
+
+	var duration uint64
+	for _, s := range clock.samples {
+		duration += uint64(s.duration)
+	}
+	for _, t := range m.tracks {
+		t.samples = nil
+	}
+
+	m.sequence++
+	name := fmt.Sprintf("segment_%05d.m4s", m.sequence)
+	if err := ioutil.WriteFile(filepath.Join(m.dir, name), mp4Segment(m.sequence, fragments), 0644); err != nil {
+		return err
+	}
+	m.playlist = append(m.playlist, hlsSegment{name: name, duration: float64(duration) / float64(clock.timescale)})
+
+	// segments leaving the playlist are removed a few segments later
+	for len(m.playlist) > hlsPlaylistSize {
+		m.expired = append(m.expired, m.playlist[0].name)
+		m.playlist = m.playlist[1:]
+	}
+	for len(m.expired) > hlsKeepSegments {
+		if err := os.Remove(filepath.Join(m.dir, m.expired[0])); err != nil {
+			log.Errorf("Error removing segment %s: %v", m.expired[0], err)
+		}
+		m.expired = m.expired[1:]
+	}
+	return nil
+}
+
+// writePlaylist writes index.m3u8 to a temporary file renamed over the
+// old one, so players never fetch it half written
+func (m *hlsMuxer) writePlaylist(end bool) error {
+	target := math.Ceil(hlsSegmentDuration.Seconds())
+	for _, s := range m.playlist {
+		target = math.Max(target, math.Ceil(s.duration))
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", int(m.sequence)-len(m.playlist)+1)
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-MAP:URI=\"init.mp4\"\n")
+	for _, s := range m.playlist {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", s.duration, s.name)
+	}
+	if end {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	name := filepath.Join(m.dir, "index.m3u8")
+	if err := ioutil.WriteFile(name+".tmp", []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (m *hlsMuxer) closeTrack() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.open--; m.open > 0 {
+		return nil
+	}
+	m.closed = true
+	if !m.running {
+		return nil
+	}
+
+	// the clock of the last segment is the video track, if it has samples
+	var clock *hlsTrack
+	for _, t := range m.tracks {
+		if t.pending != nil || len(t.samples) > 0 {
+			if clock == nil || t.video {
+				clock = t
+			}
+		}
+	}
+	if clock == nil {
+		return m.writePlaylist(true)
+	}
+	if err := m.writeSegment(clock, true); err != nil {
+		return err
+	}
+	return m.writePlaylist(true)
+}
+
+// serveHLS serves the playlists and segments of the streams in dir, at
+// /<stream id>/index.m3u8
+func serveHLS(addr, dir string) {
+	files := http.FileServer(http.Dir(dir))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		switch path.Ext(r.URL.Path) {
+		case ".m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+		case ".m4s":
+			w.Header().Set("Content-Type", "video/iso.segment")
+		case ".mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+		}
+		files.ServeHTTP(w, r)
+	})
+
+	log.Infof("Serving HLS at http://%s/<stream id>/index.m3u8", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Errorf("HLS server error: %v", err)
+	}
+}
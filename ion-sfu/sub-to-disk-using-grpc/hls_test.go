@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHLSStreamDir(t *testing.T) {
+	root := filepath.Join("recordings", "hls")
+	for _, stream := range []string{"", ".", ".."} {
+		if dir, err := hlsStreamDir(root, stream); err != errHLSStream {
+			t.Errorf("stream %q: got %q, %v, want %v", stream, dir, err, errHLSStream)
+		}
+	}
+
+	for stream, want := range map[string]string{
+		"room":      "room",
+		"../room":   ".._room",
+		"...":       "...",
+		"a/../../b": "a_.._.._b",
+	} {
+		dir, err := hlsStreamDir(root, stream)
+		if err != nil {
+			t.Errorf("stream %q: %v", stream, err)
+			continue
+		}
+		if dir != filepath.Join(root, want) {
+			t.Errorf("stream %q: got %q, want %q", stream, dir, filepath.Join(root, want))
+		}
+	}
+}
+
+func TestHLSStartOutsideRoot(t *testing.T) {
+	root := t.TempDir()
+	m := &hlsMuxer{root: root, dir: filepath.Dir(root)}
+	if err := m.start(); err != errHLSStream {
+		t.Fatalf("start outside root: got %v, want %v", err, errHLSStream)
+	}
+}
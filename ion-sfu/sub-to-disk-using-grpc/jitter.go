@@ -0,0 +1,246 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// how long a missing packet is waited for before it's counted lost
+	jitterLatency = 300 * time.Millisecond
+	// the most packets held waiting for a missing one
+	maxJitterPackets = 500
+	// keyframes are requested at most this often while one is waited for
+	keyframeRequestInterval = 500 * time.Millisecond
+	// the counters of a recording track are logged this often while they
+	// change
+	jitterStatsInterval = 10 * time.Second
+)
+
+// frameCodec tells the jitter buffer where the frames of a codec start
+// and which of them can be decoded on their own
+type frameCodec struct {
+	// start reports whether a packet is the first of its frame
+	start func(pkt *rtp.Packet) bool
+	// end reports whether a packet is the last of its frame
+	end func(pkt *rtp.Packet) bool
+	// keyframe reports whether a complete frame is a keyframe, nil when
+	// every frame decodes without the ones before it
+	keyframe func(frame []*rtp.Packet) bool
+}
+
+var frameCodecs = map[string]frameCodec{
+	webrtc.Opus: {start: everyPacket, end: everyPacket},
+	webrtc.VP8:  {start: vp8FrameStart, end: markerPacket, keyframe: vp8Keyframe},
+	webrtc.VP9:  {start: vp9FrameStart, end: markerPacket, keyframe: vp9Keyframe},
+	webrtc.H264: {start: h264FrameStart, end: markerPacket, keyframe: h264Keyframe},
+}
+
+func everyPacket(*rtp.Packet) bool { return true }
+
+func markerPacket(pkt *rtp.Packet) bool { return pkt.Marker }
+
+// jitterStats counts the packets a jitterBuffer didn't pass on
+type jitterStats struct {
+	// Late packets arrived after the buffer moved past them
+	Late uint64
+	// Lost packets never arrived in time
+	Lost uint64
+	// Discarded packets belonged to an incomplete frame, or to a frame
+	// received while waiting for a keyframe
+	Discarded uint64
+}
+
+type jitterPacket struct {
+	pkt     *rtp.Packet
+	arrived time.Time
+}
+
+// jitterBuffer reorders the packets of a track by sequence number and
+// passes on complete frames only. A missing packet is waited for up to
+// jitterLatency, then the frame it belonged to is dropped. After a loss,
+// video frames are dropped until the next keyframe, which is requested
+// with requestKeyframe.
+type jitterBuffer struct {
+	codec           frameCodec
+	requestKeyframe func()
+
+	packets map[int64]jitterPacket
+	// extended sequence number of the next packet to pass on
+	next    int64
+	highest int64
+	started bool
+
+	// dropping the rest of a frame that lost its start
+	dropping bool
+	// waiting for a keyframe since the start or a loss
+	waitKeyframe  bool
+	lastRequested time.Time
+
+	stats jitterStats
+}
+
+func newJitterBuffer(codec frameCodec, requestKeyframe func()) *jitterBuffer {
+	return &jitterBuffer{
+		codec:           codec,
+		requestKeyframe: requestKeyframe,
+		packets:         make(map[int64]jitterPacket),
+		waitKeyframe:    codec.keyframe != nil,
+	}
+}
+
+// push adds a packet that arrived at now, returning the packets of the
+// frames it completed in order
+func (j *jitterBuffer) push(pkt *rtp.Packet, now time.Time) []*rtp.Packet {
+	// extend the sequence number so it doesn't wrap
+	seq := int64(pkt.SequenceNumber)
+	if j.started {
+		seq = j.highest + int64(int16(pkt.SequenceNumber-uint16(j.highest)))
+	} else {
+		j.started = true
+		j.next, j.highest = seq, seq
+		j.dropping = !j.codec.start(pkt)
+	}
+
+	if seq < j.next {
+		j.stats.Late++
+		return nil
+	}
+	if _, ok := j.packets[seq]; ok {
+		// a retransmission of a packet already held
+		return nil
+	}
+	if seq > j.highest {
+		j.highest = seq
+	}
+	j.packets[seq] = jitterPacket{pkt: pkt, arrived: now}
+	return j.drain(now, false)
+}
+
+// flush returns the complete frames still held, once the track ended
+func (j *jitterBuffer) flush() []*rtp.Packet {
+	return j.drain(time.Now(), true)
+}
+
+// drain passes on the frames that are complete, giving up on missing
+// packets once they're overdue, or on all of them with force
+func (j *jitterBuffer) drain(now time.Time, force bool) []*rtp.Packet {
+	var out []*rtp.Packet
+	for len(j.packets) > 0 {
+		if _, ok := j.packets[j.next]; !ok {
+			if !force && !j.overdue(now) {
+				break
+			}
+			j.skipGap(now)
+			continue
+		}
+
+		if j.dropping {
+			p := j.packets[j.next].pkt
+			delete(j.packets, j.next)
+			j.next++
+			j.stats.Discarded++
+			j.dropping = !j.codec.end(p)
+			continue
+		}
+
+		frame := j.frame()
+		if frame == nil {
+			if !force && !j.overdue(now) {
+				break
+			}
+			j.skipGap(now)
+			continue
+		}
+		for range frame {
+			delete(j.packets, j.next)
+			j.next++
+		}
+
+		if j.waitKeyframe {
+			if !j.codec.keyframe(frame) {
+				j.stats.Discarded += uint64(len(frame))
+				j.keyframeNeeded(now)
+				continue
+			}
+			j.waitKeyframe = false
+		}
+		out = append(out, frame...)
+	}
+	return out
+}
+
+// frame returns the packets of the frame starting at next, nil while it
+// has a packet missing
+func (j *jitterBuffer) frame() []*rtp.Packet {
+	var frame []*rtp.Packet
+	for seq := j.next; ; seq++ {
+		p, ok := j.packets[seq]
+		if !ok {
+			return nil
+		}
+		frame = append(frame, p.pkt)
+		if j.codec.end(p.pkt) {
+			return frame
+		}
+	}
+}
+
+// overdue reports whether the buffer waited long enough for the packet
+// at next
+func (j *jitterBuffer) overdue(now time.Time) bool {
+	if len(j.packets) > maxJitterPackets {
+		return true
+	}
+	for _, p := range j.packets {
+		if now.Sub(p.arrived) > jitterLatency {
+			return true
+		}
+	}
+	return false
+}
+
+// skipGap gives up on the first missing packet, dropping the start of
+// the frame it's in, and moves next to the packet after the gap, where
+// the rest of that frame is dropped too
+func (j *jitterBuffer) skipGap(now time.Time) {
+	for {
+		if _, ok := j.packets[j.next]; !ok {
+			break
+		}
+		delete(j.packets, j.next)
+		j.next++
+		j.stats.Discarded++
+	}
+
+	after := int64(-1)
+	for seq := range j.packets {
+		if after < 0 || seq < after {
+			after = seq
+		}
+	}
+	if after < 0 {
+		// the packets after the gap haven't arrived yet
+		return
+	}
+	j.stats.Lost += uint64(after - j.next)
+	j.next = after
+	j.dropping = !j.codec.start(j.packets[after].pkt)
+	if j.codec.keyframe != nil {
+		j.keyframeNeeded(now)
+	}
+}
+
+// keyframeNeeded drops frames until a keyframe, requesting one
+func (j *jitterBuffer) keyframeNeeded(now time.Time) {
+	j.waitKeyframe = true
+	if now.Sub(j.lastRequested) < keyframeRequestInterval {
+		return
+	}
+	j.lastRequested = now
+	if j.requestKeyframe != nil {
+		j.requestKeyframe()
+	}
+}
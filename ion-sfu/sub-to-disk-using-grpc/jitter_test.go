@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// flags of the test codec in the first payload byte
+	frameStart    = 0x01
+	frameKeyframe = 0x02
+)
+
+// testCodec reads where frames start and whether they're keyframes from
+// the first payload byte, frames end on the marker
+var testCodec = frameCodec{
+	start: func(pkt *rtp.Packet) bool { return pkt.Payload[0]&frameStart != 0 },
+	end:   markerPacket,
+	keyframe: func(frame []*rtp.Packet) bool {
+		return frame[0].Payload[0]&frameKeyframe != 0
+	},
+}
+
+func TestJitterBuffer(t *testing.T) {
+	type packet struct {
+		seq    uint16
+		flags  byte
+		marker bool
+		// when the packet arrives after the first one
+		at time.Duration
+	}
+	// a keyframe and an inter frame of a single packet
+	key, inter := byte(frameStart|frameKeyframe), byte(frameStart)
+
+	tests := []struct {
+		name     string
+		packets  []packet
+		want     []uint16
+		stats    jitterStats
+		requests int
+	}{
+		{
+			name: "reordered",
+			packets: []packet{
+				{1, key, false, 0},
+				{3, inter, true, 0},
+				{2, 0, true, 0},
+				{5, 0, true, 0},
+				{4, inter, false, 0},
+			},
+			want: []uint16{1, 2, 3, 4, 5},
+		},
+		{
+			name: "sequence wrap",
+			packets: []packet{
+				{65534, key, true, 0},
+				{0, inter, true, 0},
+				{65535, inter, true, 0},
+				{1, inter, true, 0},
+			},
+			want: []uint16{65534, 65535, 0, 1},
+		},
+		{
+			name: "late duplicates",
+			packets: []packet{
+				{1, key, true, 0},
+				{2, inter, true, 0},
+				{4, inter, true, 0},
+				// a retransmission of a packet still held
+				{4, inter, true, 0},
+				{2, inter, true, 0},
+				{3, inter, true, 0},
+				{1, key, true, 0},
+			},
+			want:  []uint16{1, 2, 3, 4},
+			stats: jitterStats{Late: 2},
+		},
+		{
+			name: "overdue gap drops the partial frame",
+			packets: []packet{
+				{1, key, true, 0},
+				{2, inter, false, 0},
+				// 3 is lost, the rest of its frame and the next inter
+				// frame are dropped until a keyframe
+				{4, 0, true, 0},
+				{5, inter, true, 0},
+				{6, key, true, 400 * time.Millisecond},
+				{7, inter, true, 400 * time.Millisecond},
+			},
+			want:     []uint16{1, 6, 7},
+			stats:    jitterStats{Lost: 1, Discarded: 3},
+			requests: 1,
+		},
+		{
+			name: "waits for a keyframe",
+			packets: []packet{
+				// starting in the middle of a frame
+				{1, 0, true, 0},
+				{2, inter, true, 0},
+				{3, inter, true, 100 * time.Millisecond},
+				{4, inter, true, 600 * time.Millisecond},
+				{5, key, true, 700 * time.Millisecond},
+				{6, inter, true, 700 * time.Millisecond},
+			},
+			want:     []uint16{5, 6},
+			stats:    jitterStats{Discarded: 4},
+			requests: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			j := newJitterBuffer(testCodec, func() { requests++ })
+
+			start := time.Now()
+			var got []uint16
+			for _, p := range tt.packets {
+				out := j.push(&rtp.Packet{
+					Header:  rtp.Header{SequenceNumber: p.seq, Marker: p.marker},
+					Payload: []byte{p.flags},
+				}, start.Add(p.at))
+				for _, pkt := range out {
+					got = append(got, pkt.SequenceNumber)
+				}
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got packets %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got packets %v, want %v", got, tt.want)
+				}
+			}
+			if j.stats != tt.stats {
+				t.Errorf("got stats %+v, want %+v", j.stats, tt.stats)
+			}
+			if requests != tt.requests {
+				t.Errorf("got %d keyframe requests, want %d", requests, tt.requests)
+			}
+		})
+	}
+}
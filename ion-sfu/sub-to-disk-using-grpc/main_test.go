@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/harness"
+)
+
+// recorded returns whether a file with extension ext in dir holds at
+// least size bytes
+func recorded(t *testing.T, dir, ext string, size int64) bool {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if info, err := os.Stat(name); err == nil && info.Size() >= size {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRecord(t *testing.T) {
+	addr := harness.StartGRPC(t, harness.SFUConfig)
+
+	pub := harness.NewPeer(t)
+	pub.Publish(t, "pub")
+	harness.DialGRPC(t, addr, pub).Join(t, "test")
+
+	dir := t.TempDir()
+	sub := harness.NewPeer(t)
+	sub.Receive(t)
+	rec, err := newRecorder(dir, sub.PC, recorderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	harness.DialGRPC(t, addr, sub).Join(t, "test")
+
+	// Each track is saved to its own file, growing as packets arrive
+	deadline := time.Now().Add(20 * time.Second)
+	for !recorded(t, dir, ".ivf", 10000) || !recorded(t, dir, ".ogg", 2000) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the ivf and ogg files to grow")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Closing the peer connection ends its tracks, and the files
+	if err = sub.PC.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rec.wait()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/ion-log"
+)
+
+// segmentInfo describes a segment file in the manifest
+type segmentInfo struct {
+	// File is the name of the segment, in the directory of the manifest
+	File string `json:"file"`
+	// Recording names the series of segments the file belongs to, the
+	// stream and track, or the stream for WebM files
+	Recording string         `json:"recording"`
+	Stream    string         `json:"stream"`
+	Tracks    []segmentTrack `json:"tracks"`
+	Start     time.Time      `json:"start"`
+	// End is set once the file is finished and can be uploaded
+	End   *time.Time `json:"end,omitempty"`
+	Bytes int64      `json:"bytes"`
+}
+
+// segmentTrack holds the rtp timestamps of the first and last frame of a
+// track in a segment
+type segmentTrack struct {
+	ID                string `json:"id"`
+	Codec             string `json:"codec"`
+	StartRTPTimestamp uint32 `json:"startRtpTimestamp"`
+	EndRTPTimestamp   uint32 `json:"endRtpTimestamp"`
+}
+
+// manifest lists the segments in a directory, rewritten whenever one
+// starts or finishes. Finished segments beyond the retention of the
+// policy are deleted along with their entry.
+type manifest struct {
+	mu       sync.Mutex
+	dir      string
+	path     string
+	policy   segmentPolicy
+	Segments []segmentInfo `json:"segments"`
+}
+
+// loadManifest reads the manifest of a directory, so the segments of
+// earlier runs are kept to the retention policy too, and expires them
+func loadManifest(dir string, policy segmentPolicy) (*manifest, error) {
+	m := &manifest{dir: dir, path: filepath.Join(dir, "manifest.json"), policy: policy}
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	m.recover()
+	m.expire(time.Now())
+	m.save()
+	return m, nil
+}
+
+// recover finishes the segments an earlier run left unfinished when it
+// crashed, ending them when their file was last written, so they expire
+// like the others. Entries of files that are gone are dropped.
+func (m *manifest) recover() {
+	segments := m.Segments[:0]
+	for _, seg := range m.Segments {
+		if seg.End != nil {
+			segments = append(segments, seg)
+			continue
+		}
+		info, err := os.Stat(filepath.Join(m.dir, seg.File))
+		if err != nil {
+			log.Warnf("Dropping unfinished segment %s: %v", seg.File, err)
+			continue
+		}
+		end := info.ModTime()
+		seg.End = &end
+		seg.Bytes = info.Size()
+		log.Infof("Finished segment %s left by an earlier run", seg.File)
+		segments = append(segments, seg)
+	}
+	m.Segments = segments
+}
+
+// started adds a segment being written
+func (m *manifest) started(seg segmentInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Segments = append(m.Segments, seg)
+	m.save()
+}
+
+// finished updates the entry of a segment that was closed, and expires
+// the segments past the retention
+func (m *manifest) finished(seg segmentInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.Segments {
+		if m.Segments[i].File == seg.File {
+			m.Segments[i] = seg
+		}
+	}
+	m.expire(time.Now())
+	m.save()
+}
+
+// expire deletes the finished segments of a recording beyond the newest
+// RetainCount, or that ended more than RetainAge ago
+func (m *manifest) expire(now time.Time) {
+	if m.policy.RetainCount <= 0 && m.policy.RetainAge <= 0 {
+		return
+	}
+
+	// newest first, so the count of a recording's segments kept so far
+	// decides whether the next one goes
+	order := make([]int, len(m.Segments))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return m.Segments[order[a]].Start.After(m.Segments[order[b]].Start)
+	})
+
+	kept := make(map[string]int)
+	remove := make(map[int]bool)
+	for _, i := range order {
+		seg := m.Segments[i]
+		if seg.End == nil {
+			continue
+		}
+		kept[seg.Recording]++
+		if (m.policy.RetainCount > 0 && kept[seg.Recording] > m.policy.RetainCount) ||
+			(m.policy.RetainAge > 0 && now.Sub(*seg.End) > m.policy.RetainAge) {
+			remove[i] = true
+		}
+	}
+	if len(remove) == 0 {
+		return
+	}
+
+	segments := m.Segments[:0]
+	for i, seg := range m.Segments {
+		if !remove[i] {
+			segments = append(segments, seg)
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.dir, seg.File)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error removing expired segment %s: %v", seg.File, err)
+			segments = append(segments, seg)
+			continue
+		}
+		log.Infof("Removed expired segment %s", seg.File)
+	}
+	m.Segments = segments
+}
+
+// save writes the manifest to a temporary file renamed over the old one,
+// so readers never see it half written
+func (m *manifest) save() {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		log.Errorf("Error encoding manifest: %v", err)
+		return
+	}
+	tmp := m.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Error writing manifest: %v", err)
+		return
+	}
+	if err = os.Rename(tmp, m.path); err != nil {
+		log.Errorf("Error writing manifest: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifestRetention(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		end := now.Add(-d)
+		return &end
+	}
+	// the segments of two recordings, oldest first, the last of a still
+	// being written
+	segments := []segmentInfo{
+		{File: "a_001.ivf", Recording: "a", Start: now.Add(-4 * time.Hour), End: ago(3 * time.Hour)},
+		{File: "b_001.ivf", Recording: "b", Start: now.Add(-4 * time.Hour), End: ago(3 * time.Hour)},
+		{File: "a_002.ivf", Recording: "a", Start: now.Add(-3 * time.Hour), End: ago(2 * time.Hour)},
+		{File: "a_003.ivf", Recording: "a", Start: now.Add(-2 * time.Hour), End: ago(30 * time.Minute)},
+		{File: "a_004.ivf", Recording: "a", Start: now.Add(-30 * time.Minute)},
+	}
+
+	tests := []struct {
+		name   string
+		policy segmentPolicy
+		want   []string
+	}{
+		{
+			name:   "count",
+			policy: segmentPolicy{RetainCount: 1},
+			want:   []string{"b_001.ivf", "a_003.ivf", "a_004.ivf"},
+		},
+		{
+			name:   "age",
+			policy: segmentPolicy{RetainAge: time.Hour},
+			want:   []string{"a_003.ivf", "a_004.ivf"},
+		},
+		{
+			name:   "count and age",
+			policy: segmentPolicy{RetainCount: 2, RetainAge: 150 * time.Minute},
+			want:   []string{"a_002.ivf", "a_003.ivf", "a_004.ivf"},
+		},
+		{
+			name:   "keep all",
+			policy: segmentPolicy{},
+			want:   []string{"a_001.ivf", "b_001.ivf", "a_002.ivf", "a_003.ivf", "a_004.ivf"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, seg := range segments {
+				if err := ioutil.WriteFile(filepath.Join(dir, seg.File), []byte("segment"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m := &manifest{dir: dir, path: filepath.Join(dir, "manifest.json"), policy: tt.policy}
+			m.Segments = append(m.Segments, segments...)
+			m.expire(now)
+
+			var got []string
+			for _, seg := range m.Segments {
+				got = append(got, seg.File)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got segments %v, want %v", got, tt.want)
+			}
+
+			kept := make(map[string]bool)
+			for _, file := range tt.want {
+				kept[file] = true
+			}
+			for _, seg := range segments {
+				_, err := os.Stat(filepath.Join(dir, seg.File))
+				if kept[seg.File] && err != nil {
+					t.Errorf("kept segment %s: %v", seg.File, err)
+				} else if !kept[seg.File] && !os.IsNotExist(err) {
+					t.Errorf("expired segment %s wasn't removed", seg.File)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestCrashedRun(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	written := now.Add(-2 * time.Hour)
+
+	// segments an earlier run left unfinished, one written to two hours
+	// ago, one a minute ago and one whose file is gone
+	for _, file := range []string{"old_001.ivf", "recent_001.ivf"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("segment"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(dir, "old_001.ivf"), written, written); err != nil {
+		t.Fatal(err)
+	}
+	recent := now.Add(-time.Minute).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "recent_001.ivf"), recent, recent); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&manifest{Segments: []segmentInfo{
+		{File: "old_001.ivf", Recording: "old", Start: now.Add(-3 * time.Hour)},
+		{File: "recent_001.ivf", Recording: "recent", Start: now.Add(-time.Hour)},
+		{File: "gone_001.ivf", Recording: "gone", Start: now.Add(-time.Hour)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "manifest.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := loadManifest(dir, segmentPolicy{RetainAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Segments) != 1 || m.Segments[0].File != "recent_001.ivf" {
+		t.Fatalf("got segments %+v, want recent_001.ivf only", m.Segments)
+	}
+	seg := m.Segments[0]
+	if seg.End == nil || !seg.End.Equal(recent) {
+		t.Errorf("got end %v, want when the file was last written %v", seg.End, recent)
+	}
+	if seg.Bytes != int64(len("segment")) {
+		t.Errorf("got %d bytes, want the file size %d", seg.Bytes, len("segment"))
+	}
+	if _, err = os.Stat(filepath.Join(dir, "old_001.ivf")); !os.IsNotExist(err) {
+		t.Error("expired segment old_001.ivf wasn't removed")
+	}
+
+	// the recovered manifest was saved
+	loaded, err := loadManifest(dir, segmentPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Segments) != 1 || loaded.Segments[0].End == nil {
+		t.Errorf("got saved segments %+v, want recent_001.ivf finished", loaded.Segments)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+
+	"github.com/pion/ion-examples/ion-sfu/internal/tracks"
+)
+
+// unsafeChars are replaced in stream and track ids to name files with them
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// trackWriter saves the packets of a track to a file
+type trackWriter interface {
+	WriteRTP(pkt *rtp.Packet) error
+	Close() error
+}
+
+// recorderOptions are how a recorder saves tracks
+type recorderOptions struct {
+	// WebM muxes the Opus, VP8 and VP9 tracks of a stream into one file
+	WebM bool
+	// Segments splits recordings in files listed in a manifest, when
+	// enabled
+	Segments segmentPolicy
+	// HLS packages the H264 and Opus tracks of a stream as live HLS, in
+	// the hls directory
+	HLS bool
+}
+
+// recorder saves every track a peer connection receives to its own file,
+// named after its stream, track and when it started. With WebM set, the
+// Opus, VP8 and VP9 tracks of a stream are muxed into one WebM file
+// instead. With segments, recordings are split in numbered files, listed
+// in the manifest.json of the directory.
+type recorder struct {
+	dir      string
+	pc       *webrtc.PeerConnection
+	wg       sync.WaitGroup
+	opts     recorderOptions
+	manifest *manifest
+
+	mu sync.Mutex
+	// muxers of the streams being recorded to WebM, and of the HLS
+	// directories being written
+	muxers    map[string]*webmMuxer
+	hlsMuxers map[string]*hlsMuxer
+}
+
+func newRecorder(dir string, pc *webrtc.PeerConnection, opts recorderOptions) (*recorder, error) {
+	r := &recorder{
+		dir:       dir,
+		pc:        pc,
+		opts:      opts,
+		muxers:    make(map[string]*webmMuxer),
+		hlsMuxers: make(map[string]*hlsMuxer),
+	}
+	if opts.Segments.enabled() {
+		m, err := loadManifest(dir, opts.Segments)
+		if err != nil {
+			return nil, err
+		}
+		r.manifest = m
+	}
+	pc.OnTrack(r.onTrack)
+	return r, nil
+}
+
+// fileName returns the path a track, or a segment of it when segment
+// isn't 0, is saved to
+func (r *recorder) fileName(track *webrtc.Track, ext string, segment int) string {
+	name := fmt.Sprintf("%s_%s_%s",
+		unsafeChars.ReplaceAllString(track.Label(), "_"),
+		unsafeChars.ReplaceAllString(track.ID(), "_"),
+		time.Now().Format("20060102-150405"))
+	if segment > 0 {
+		name += fmt.Sprintf("_%03d", segment)
+	}
+	return filepath.Join(r.dir, name+"."+ext)
+}
+
+// newWriter returns the writer for the codec of a track, nil when the
+// codec can't be saved
+func (r *recorder) newWriter(track *webrtc.Track) (trackWriter, string, error) {
+	if r.opts.HLS {
+		if w, name := r.hlsWriter(track); w != nil {
+			return w, name, nil
+		}
+	}
+	if r.opts.WebM {
+		if w, name := r.webmWriter(track); w != nil {
+			return w, name, nil
+		}
+	}
+
+	if r.manifest != nil {
+		if _, ok := frameCodecs[track.Codec().Name]; !ok {
+			return nil, "", nil
+		}
+		w := newSegmentWriter(track, func(segment int) (trackWriter, string, error) {
+			return r.openWriter(track, segment)
+		}, r.opts.Segments, r.manifest)
+		return w, filepath.Join(r.dir, fmt.Sprintf("%s_%s_*",
+			unsafeChars.ReplaceAllString(track.Label(), "_"),
+			unsafeChars.ReplaceAllString(track.ID(), "_"))), nil
+	}
+	return r.openWriter(track, 0)
+}
+
+// openWriter creates the file of a track, or of a segment of it, in the
+// format of its codec
+func (r *recorder) openWriter(track *webrtc.Track, segment int) (trackWriter, string, error) {
+	switch track.Codec().Name {
+	case webrtc.Opus:
+		name := r.fileName(track, "ogg", segment)
+		w, err := oggwriter.New(name, 48000, 2)
+		if err != nil {
+			return nil, name, err
+		}
+		return w, name, nil
+	case webrtc.VP8:
+		name := r.fileName(track, "ivf", segment)
+		w, err := ivfwriter.New(name)
+		if err != nil {
+			return nil, name, err
+		}
+		return &vp8Writer{w}, name, nil
+	case webrtc.VP9:
+		name := r.fileName(track, "ivf", segment)
+		w, err := newVP9Writer(name)
+		if err != nil {
+			return nil, name, err
+		}
+		return w, name, nil
+	case webrtc.H264:
+		name := r.fileName(track, "h264", segment)
+		w, err := newH264Writer(name)
+		if err != nil {
+			return nil, name, err
+		}
+		return w, name, nil
+	default:
+		return nil, "", nil
+	}
+}
+
+// webmWriter adds a track to the WebM file of its stream, starting a new
+// file when the stream has none or its recording ended. It returns nil
+// for codecs WebM can't hold, and tracks arriving once the recording
+// started, which are saved to files instead.
+func (r *recorder) webmWriter(track *webrtc.Track) (trackWriter, string) {
+	switch track.Codec().Name {
+	case webrtc.Opus, webrtc.VP8, webrtc.VP9:
+	default:
+		return nil, ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream := track.Label()
+	if m, ok := r.muxers[stream]; ok {
+		t, err := m.addTrack(track)
+		if err == nil {
+			return r.webmTrack(stream, m, t), m.path()
+		}
+		if !m.isClosed() {
+			log.Warnf("Track %s can't join %s: %v", track.ID(), m.path(), err)
+			return nil, ""
+		}
+	}
+
+	segmented := r.manifest != nil
+	m := newWebMMuxer(stream, func(segment int) string {
+		name := fmt.Sprintf("%s_%s",
+			unsafeChars.ReplaceAllString(stream, "_"),
+			time.Now().Format("20060102-150405"))
+		if segmented {
+			name += fmt.Sprintf("_%03d", segment)
+		}
+		return filepath.Join(r.dir, name+".webm")
+	}, r.opts.Segments, r.manifest)
+	t, err := m.addTrack(track)
+	if err != nil {
+		return nil, ""
+	}
+	r.muxers[stream] = m
+	return r.webmTrack(stream, m, t), m.path()
+}
+
+// webmTrack returns the writer of a track in a WebM file, that forgets the
+// file once its last track closed it
+func (r *recorder) webmTrack(stream string, m *webmMuxer, t *webmTrack) trackWriter {
+	return &muxedTrack{trackWriter: t, closed: func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.muxers[stream] == m && m.isClosed() {
+			delete(r.muxers, stream)
+		}
+	}}
+}
+
+func (r *recorder) onTrack(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+	w, name, err := r.newWriter(track)
+	if err != nil {
+		log.Errorf("Error creating %s: %v", name, err)
+		return
+	}
+	if w == nil {
+		log.Warnf("Ignoring %s track %s, %s can't be saved", track.Kind(), track.ID(), track.Codec().Name)
+		return
+	}
+	log.Infof("Got %s track %s of stream %s, saving to %s", track.Codec().Name, track.ID(), track.Label(), name)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.save(track, w)
+		if err := w.Close(); err != nil {
+			log.Errorf("Error closing %s: %v", name, err)
+		}
+		log.Infof("Track %s ended, closed %s", track.ID(), name)
+	}()
+}
+
+// save writes the frames of a track until it ends, reordered and freed
+// of incomplete ones by a jitter buffer, requesting keyframes from video
+// publishers meanwhile
+func (r *recorder) save(track *webrtc.Track, w trackWriter) {
+	done := make(chan struct{})
+	defer close(done)
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		go tracks.RequestKeyframes(r.pc, track, done)
+	}
+
+	jb := newJitterBuffer(frameCodecs[track.Codec().Name], func() {
+		log.Debugf("Requesting a keyframe of track %s", track.ID())
+		tracks.RequestKeyframe(r.pc, track)
+	})
+	defer logJitterStats(track, jb.stats)
+
+	logged, reported := time.Now(), jitterStats{}
+	for {
+		pkt, err := track.ReadRTP()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Error reading track %s: %v", track.ID(), err)
+			}
+			_ = r.write(track, w, jb.flush())
+			return
+		}
+		now := time.Now()
+		if err = r.write(track, w, jb.push(pkt, now)); err != nil {
+			return
+		}
+		if jb.stats != reported && now.Sub(logged) >= jitterStatsInterval {
+			logged, reported = now, jb.stats
+			logJitterStats(track, reported)
+		}
+	}
+}
+
+// logJitterStats logs the packets of a track the jitter buffer didn't
+// pass on so far
+func logJitterStats(track *webrtc.Track, stats jitterStats) {
+	log.Infof("Track %s: %d late, %d lost and %d discarded packets", track.ID(), stats.Late, stats.Lost, stats.Discarded)
+}
+
+// write the packets a jitter buffer passed on
+func (r *recorder) write(track *webrtc.Track, w trackWriter, pkts []*rtp.Packet) error {
+	for _, pkt := range pkts {
+		if err := w.WriteRTP(pkt); err != nil {
+			log.Errorf("Error writing track %s: %v", track.ID(), err)
+			return err
+		}
+	}
+	return nil
+}
+
+// wait until every track ended and its file is closed
+func (r *recorder) wait() {
+	r.wg.Wait()
+}
+
+// hlsRoot returns the directory the HLS streams are written to
+func (r *recorder) hlsRoot() string {
+	return filepath.Join(r.dir, "hls")
+}
+
+// hlsWriter adds a track to the HLS stream of its stream, starting a new
+// one when the stream has none or it ended. It returns nil for codecs HLS
+// isn't packaged with, and tracks arriving once it started, which are
+// saved to files instead.
+func (r *recorder) hlsWriter(track *webrtc.Track) (trackWriter, string) {
+	switch track.Codec().Name {
+	case webrtc.H264, webrtc.Opus:
+	default:
+		return nil, ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream := track.Label()
+	dir, err := hlsStreamDir(r.hlsRoot(), stream)
+	if err != nil {
+		log.Warnf("Stream %q can't be served as HLS: %v", stream, err)
+		return nil, ""
+	}
+	name := filepath.Join(dir, "index.m3u8")
+	// keyed by directory, so ids sanitized to the same name share it
+	if m, ok := r.hlsMuxers[dir]; ok {
+		t, err := m.addTrack(track)
+		if err == nil {
+			return r.hlsTrack(dir, m, t), name
+		}
+		if !m.isClosed() {
+			// a new stream would clear the directory of the running one
+			log.Warnf("Track %s can't join %s: %v", track.ID(), name, err)
+			return nil, ""
+		}
+	}
+
+	m, err := newHLSMuxer(r.hlsRoot(), stream)
+	if err != nil {
+		return nil, ""
+	}
+	t, err := m.addTrack(track)
+	if err != nil {
+		return nil, ""
+	}
+	r.hlsMuxers[dir] = m
+	return r.hlsTrack(dir, m, t), name
+}
+
+// hlsTrack returns the writer of a track in a HLS stream, that forgets
+// the stream once its last track closed it
+func (r *recorder) hlsTrack(dir string, m *hlsMuxer, t *hlsTrack) trackWriter {
+	return &muxedTrack{trackWriter: t, closed: func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.hlsMuxers[dir] == m && m.isClosed() {
+			delete(r.hlsMuxers, dir)
+		}
+	}}
+}
+
+// muxedTrack calls closed after closing its track
+type muxedTrack struct {
+	trackWriter
+	closed func()
+}
+
+func (t *muxedTrack) Close() error {
+	err := t.trackWriter.Close()
+	t.closed()
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// readRTPDump returns the rtp packets of a file in the rtpdump format of
+// rtptools, skipping the rtcp ones
+func readRTPDump(t *testing.T, name string) []*rtp.Packet {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "#!rtpplay1.0 ") {
+		t.Fatalf("%s isn't an rtpdump", name)
+	}
+	// the start time, source address and port
+	if _, err = io.ReadFull(r, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	var packets []*rtp.Packet
+	header := make([]byte, 8)
+	for {
+		if _, err = io.ReadFull(r, header); err == io.EOF {
+			return packets
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		length := int(binary.BigEndian.Uint16(header[0:]))
+		rtpLength := binary.BigEndian.Uint16(header[2:])
+		if length < len(header) {
+			t.Fatalf("invalid packet length %d in %s", length, name)
+		}
+		data := make([]byte, length-len(header))
+		if _, err = io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		if rtpLength == 0 {
+			continue
+		}
+		pkt := &rtp.Packet{}
+		if err = pkt.Unmarshal(data); err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, pkt)
+	}
+}
+
+// testFixtures writes the packets of each rtpdump in testdata that has an
+// expected file with ext next to it, and compares the files
+func testFixtures(t *testing.T, ext string, open func(name string) (trackWriter, error)) {
+	expected, err := filepath.Glob(filepath.Join("testdata", "*"+ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) == 0 {
+		t.Fatalf("no %s fixtures in testdata", ext)
+	}
+	for _, want := range expected {
+		base := strings.TrimSuffix(filepath.Base(want), ext)
+		t.Run(base, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), base+ext)
+			w, err := open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pkt := range readRTPDump(t, filepath.Join("testdata", base+".rtpdump")) {
+				if err = w.WriteRTP(pkt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantBytes, err := ioutil.ReadFile(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, wantBytes) {
+				at := 0
+				for at < len(got) && at < len(wantBytes) && got[at] == wantBytes[at] {
+					at++
+				}
+				t.Errorf("got %d bytes, want the %d of %s, differing from offset %d", len(got), len(wantBytes), want, at)
+			}
+		})
+	}
+}
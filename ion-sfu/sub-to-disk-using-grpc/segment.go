@@ -0,0 +1,143 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// segmentPolicy decides when a recording moves on to a new file, and how
+// many of the finished ones are kept
+type segmentPolicy struct {
+	// Duration and Size of a segment, in media bytes, rotate the
+	// recording once either is reached, zero doesn't limit it
+	Duration time.Duration
+	Size     int64
+	// RetainCount keeps the newest finished segments of each recording,
+	// RetainAge the ones that ended in that window, zero keeps all
+	RetainCount int
+	RetainAge   time.Duration
+}
+
+// enabled reports whether recordings are split in segments
+func (p segmentPolicy) enabled() bool {
+	return p.Duration > 0 || p.Size > 0
+}
+
+// due reports whether a segment that started at start and holds size
+// bytes is finished
+func (p segmentPolicy) due(start time.Time, size int64) bool {
+	return (p.Duration > 0 && time.Since(start) >= p.Duration) ||
+		(p.Size > 0 && size >= p.Size)
+}
+
+// segmentWriter splits a track into segment files, each opened by open.
+// Frames are collected until their last packet, so video segments are
+// rotated on a keyframe.
+type segmentWriter struct {
+	track    *webrtc.Track
+	codec    frameCodec
+	open     func(segment int) (trackWriter, string, error)
+	policy   segmentPolicy
+	manifest *manifest
+
+	w trackWriter
+	// the writer of the previous segment, whose codec state the next
+	// one continues from
+	prev  trackWriter
+	seg   segmentInfo
+	index int
+	frame []*rtp.Packet
+}
+
+func newSegmentWriter(track *webrtc.Track, open func(segment int) (trackWriter, string, error),
+	policy segmentPolicy, m *manifest) *segmentWriter {
+	return &segmentWriter{
+		track:    track,
+		codec:    frameCodecs[track.Codec().Name],
+		open:     open,
+		policy:   policy,
+		manifest: m,
+	}
+}
+
+// WriteRTP writes the frame a packet ends, to a new segment when the
+// current one is due and the frame is a keyframe
+func (s *segmentWriter) WriteRTP(pkt *rtp.Packet) error {
+	s.frame = append(s.frame, pkt)
+	if !s.codec.end(pkt) {
+		return nil
+	}
+	frame := s.frame
+	s.frame = nil
+
+	keyframe := s.codec.keyframe == nil || s.codec.keyframe(frame)
+	if s.w != nil && keyframe && s.policy.due(s.seg.Start, s.seg.Bytes) {
+		if err := s.finish(); err != nil {
+			return err
+		}
+	}
+	if s.w == nil {
+		if err := s.next(frame[0].Timestamp); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range frame {
+		if err := s.w.WriteRTP(p); err != nil {
+			return err
+		}
+		s.seg.Bytes += int64(len(p.Payload))
+	}
+	s.seg.Tracks[0].EndRTPTimestamp = frame[0].Timestamp
+	return nil
+}
+
+// next opens the following segment
+func (s *segmentWriter) next(timestamp uint32) error {
+	s.index++
+	w, name, err := s.open(s.index)
+	if err != nil {
+		return err
+	}
+	if h, ok := w.(*h264Writer); ok {
+		if prev, ok := s.prev.(*h264Writer); ok {
+			h.continueFrom(prev)
+		}
+	}
+	s.w = w
+	s.seg = segmentInfo{
+		File:      filepath.Base(name),
+		Recording: unsafeChars.ReplaceAllString(s.track.Label(), "_") + "_" + unsafeChars.ReplaceAllString(s.track.ID(), "_"),
+		Stream:    s.track.Label(),
+		Tracks: []segmentTrack{{
+			ID:                s.track.ID(),
+			Codec:             s.track.Codec().Name,
+			StartRTPTimestamp: timestamp,
+			EndRTPTimestamp:   timestamp,
+		}},
+		Start: time.Now(),
+	}
+	s.manifest.started(s.seg)
+	return nil
+}
+
+// finish closes the current segment and records its end
+func (s *segmentWriter) finish() error {
+	err := s.w.Close()
+	s.prev, s.w = s.w, nil
+	end := time.Now()
+	s.seg.End = &end
+	s.manifest.finished(s.seg)
+	return err
+}
+
+// Close finishes the last segment
+func (s *segmentWriter) Close() error {
+	if s.w == nil {
+		return nil
+	}
+	return s.finish()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// packetsWriter keeps the sequence numbers written to a segment
+type packetsWriter struct {
+	seqs   []uint16
+	closed bool
+}
+
+func (w *packetsWriter) WriteRTP(pkt *rtp.Packet) error {
+	w.seqs = append(w.seqs, pkt.SequenceNumber)
+	return nil
+}
+
+func (w *packetsWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestSegmentWriter(t *testing.T) {
+	track, err := webrtc.NewTrack(webrtc.DefaultPayloadTypeVP8, 1, "video", "stream",
+		webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// VP8 frames of a single packet, with 4 bytes of payload each
+	key, inter := []byte{0x10, 0x50, 0x01, 0x00}, []byte{0x10, 0x01, 0xbb, 0xcc}
+	frames := [][]byte{key, inter, inter, key, inter, key}
+
+	tests := []struct {
+		name   string
+		policy segmentPolicy
+		want   [][]uint16
+	}{
+		{
+			name:   "duration rotates on keyframes",
+			policy: segmentPolicy{Duration: time.Nanosecond},
+			want:   [][]uint16{{1, 2, 3}, {4, 5}, {6}},
+		},
+		{
+			name:   "size rotates on keyframes",
+			policy: segmentPolicy{Size: 10},
+			want:   [][]uint16{{1, 2, 3}, {4, 5, 6}},
+		},
+		{
+			name:   "unlimited",
+			policy: segmentPolicy{},
+			want:   [][]uint16{{1, 2, 3, 4, 5, 6}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			m, err := loadManifest(dir, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var writers []*packetsWriter
+			s := newSegmentWriter(track, func(segment int) (trackWriter, string, error) {
+				w := &packetsWriter{}
+				writers = append(writers, w)
+				return w, filepath.Join(dir, fmt.Sprintf("stream_video_%03d.ivf", segment)), nil
+			}, tt.policy, m)
+
+			for i, payload := range frames {
+				if err = s.WriteRTP(&rtp.Packet{
+					Header:  rtp.Header{SequenceNumber: uint16(i + 1), Timestamp: uint32(i * 3000), Marker: true},
+					Payload: payload,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(writers) != len(tt.want) {
+				t.Fatalf("got %d segments, want %d", len(writers), len(tt.want))
+			}
+			for i, w := range writers {
+				if fmt.Sprint(w.seqs) != fmt.Sprint(tt.want[i]) {
+					t.Errorf("got segment %d packets %v, want %v", i+1, w.seqs, tt.want[i])
+				}
+				if !w.closed {
+					t.Errorf("segment %d wasn't closed", i+1)
+				}
+			}
+
+			// the manifest as a later run reads it
+			loaded, err := loadManifest(dir, segmentPolicy{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded.Segments) != len(tt.want) {
+				t.Fatalf("got %d segments in the manifest, want %d", len(loaded.Segments), len(tt.want))
+			}
+			for i, seg := range loaded.Segments {
+				want := tt.want[i]
+				if file := fmt.Sprintf("stream_video_%03d.ivf", i+1); seg.File != file {
+					t.Errorf("got segment %d file %s, want %s", i+1, seg.File, file)
+				}
+				if seg.Recording != "stream_video" || seg.Stream != "stream" {
+					t.Errorf("got segment %d of recording %s stream %s, want stream_video of stream", i+1, seg.Recording, seg.Stream)
+				}
+				if seg.End == nil || seg.End.Before(seg.Start) {
+					t.Errorf("got segment %d ending %v, want after its start %v", i+1, seg.End, seg.Start)
+				}
+				if size := int64(4 * len(want)); seg.Bytes != size {
+					t.Errorf("got segment %d of %d bytes, want %d", i+1, seg.Bytes, size)
+				}
+				if len(seg.Tracks) != 1 {
+					t.Fatalf("got %d tracks in segment %d, want 1", len(seg.Tracks), i+1)
+				}
+				tr := seg.Tracks[0]
+				start, end := uint32(want[0]-1)*3000, uint32(want[len(want)-1]-1)*3000
+				if tr.ID != "video" || tr.Codec != webrtc.VP8 || tr.StartRTPTimestamp != start || tr.EndRTPTimestamp != end {
+					t.Errorf("got segment %d track %+v, want video VP8 from %d to %d", i+1, tr, start, end)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentH264ParameterSets(t *testing.T) {
+	track, err := webrtc.NewTrack(webrtc.DefaultPayloadTypeH264, 1, "video", "stream",
+		webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, 90000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	m, err := loadManifest(dir, segmentPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := segmentPolicy{Duration: time.Nanosecond}
+	s := newSegmentWriter(track, func(segment int) (trackWriter, string, error) {
+		name := filepath.Join(dir, fmt.Sprintf("stream_video_%03d.h264", segment))
+		w, err := newH264Writer(name)
+		return w, name, err
+	}, policy, m)
+
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	pps := []byte{0x68, 0xce}
+	packets := []struct {
+		seq     uint16
+		ts      uint32
+		marker  bool
+		payload []byte
+	}{
+		// the only SPS and PPS the publisher sends
+		{1, 0, false, append(append([]byte{0x78, 0x00, 0x04}, sps...), append([]byte{0x00, 0x02}, pps...)...)},
+		{2, 0, true, []byte{0x65, 0x88}},
+		// the next keyframe starts the second segment
+		{3, 3000, true, []byte{0x65, 0x89}},
+	}
+	for _, p := range packets {
+		if err = s.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts, Marker: p.marker},
+			Payload: p.payload,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "stream_video_002.h264"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0x00, 0x1f,
+		0x00, 0x00, 0x00, 0x01, 0x68, 0xce,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x89,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got second segment % x, want % x", got, want)
+	}
+}
@@ -0,0 +1,441 @@
+//go:build ignore
+// +build ignore
+
+// generate writes the rtp fixtures of the H264 and VP9 writers, run from
+// the package directory with go run testdata/generate.go
+//
+// Each stream is packetized the way libwebrtc sends it, in 1200 byte
+// packets with the abs-send-time and transport-wide sequence number
+// header extensions, and saved in the rtpdump format of rtptools, which
+// Wireshark exports too. The expected file is built from the frames the
+// stream was packetized from, not by depacketizing it.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	maxPacketSize = 1200
+	// the extensions take 12 bytes, the one byte header and two elements
+	// padded to 4 bytes
+	maxPayloadSize = maxPacketSize - 12 - 12
+	frameTicks     = 3000
+)
+
+// stream packetizes frames into an rtpdump
+type stream struct {
+	ssrc uint32
+	pt   uint8
+	seq  uint16
+	twcc uint16
+	ms   uint32
+	dump bytes.Buffer
+	lost map[int]bool
+	sent int
+}
+
+func newStream(ssrc uint32, pt uint8, seq uint16) *stream {
+	s := &stream{ssrc: ssrc, pt: pt, seq: seq, twcc: seq + 1000, lost: map[int]bool{}}
+	s.dump.WriteString("#!rtpplay1.0 127.0.0.1/5004\n")
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint32(header[0:], 1600000000) // start seconds
+	binary.BigEndian.PutUint32(header[8:], 0x7f000001) // source address
+	binary.BigEndian.PutUint16(header[12:], 5004)      // source port
+	s.dump.Write(header)
+	return s
+}
+
+// send writes a packet to the dump, unless it is one of the lost ones
+func (s *stream) send(ts uint32, marker bool, payload []byte) {
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			PayloadType:    s.pt,
+			SequenceNumber: s.seq,
+			Timestamp:      ts,
+			SSRC:           s.ssrc,
+		},
+		Payload: payload,
+	}
+	abs := s.ms << 18 / 1000
+	check(pkt.Header.SetExtension(2, []byte{byte(abs >> 16), byte(abs >> 8), byte(abs)}))
+	check(pkt.Header.SetExtension(3, []byte{byte(s.twcc >> 8), byte(s.twcc)}))
+	s.seq++
+	s.twcc++
+
+	b, err := pkt.Marshal()
+	check(err)
+	if len(b) > maxPacketSize {
+		panic("packet too large")
+	}
+	if !s.lost[s.sent] {
+		entry := make([]byte, 8)
+		binary.BigEndian.PutUint16(entry[0:], uint16(8+len(b)))
+		binary.BigEndian.PutUint16(entry[2:], uint16(len(b)))
+		binary.BigEndian.PutUint32(entry[4:], s.ms)
+		s.dump.Write(entry)
+		s.dump.Write(b)
+	}
+	s.sent++
+}
+
+// split divides n bytes in the fewest parts of at most max bytes, of
+// sizes as equal as possible, like libwebrtc does
+func split(n, max int) []int {
+	parts := (n + max - 1) / max
+	sizes := make([]int, parts)
+	for i := range sizes {
+		sizes[i] = n / parts
+		if i < n%parts {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+// frameData returns a frame starting with header, the rest random bytes
+// that never form a start code
+func frameData(header []byte, size int) []byte {
+	b := append([]byte(nil), header...)
+	for len(b) < size {
+		b = append(b, byte(1+rand.Intn(255)))
+	}
+	return b
+}
+
+// bitWriter writes the bits and Exp-Golomb codes of a RBSP
+type bitWriter struct {
+	b    []byte
+	bits int
+}
+
+func (w *bitWriter) u(n int, v uint) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << uint(7-w.bits%8)
+		w.bits++
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	n := 0
+	for (v+1)>>uint(n+1) != 0 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v+1)
+}
+
+// nalu returns the NAL unit of a RBSP, with its trailing bits and
+// emulation prevention bytes
+func (w *bitWriter) nalu(header byte) []byte {
+	w.u(1, 1)
+	for w.bits%8 != 0 {
+		w.u(1, 0)
+	}
+	out := []byte{header}
+	zeros := 0
+	for _, c := range w.b {
+		if zeros == 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// h264 writes a 320x240 constrained baseline stream of 30 fps
+func h264() {
+	sps := &bitWriter{}
+	sps.u(8, 66)   // profile_idc
+	sps.u(8, 0xe0) // constraint_set0..2_flag
+	sps.u(8, 31)   // level_idc
+	sps.ue(0)      // seq_parameter_set_id
+	sps.ue(0)      // log2_max_frame_num_minus4
+	sps.ue(2)      // pic_order_cnt_type
+	sps.ue(1)      // max_num_ref_frames
+	sps.u(1, 0)    // gaps_in_frame_num_value_allowed_flag
+	sps.ue(19)     // pic_width_in_mbs_minus1
+	sps.ue(14)     // pic_height_in_map_units_minus1
+	sps.u(1, 1)    // frame_mbs_only_flag
+	sps.u(1, 1)    // direct_8x8_inference_flag
+	sps.u(1, 0)    // frame_cropping_flag
+	sps.u(1, 0)    // vui_parameters_present_flag
+	pps := &bitWriter{}
+	pps.ue(0)   // pic_parameter_set_id
+	pps.ue(0)   // seq_parameter_set_id
+	pps.u(1, 0) // entropy_coding_mode_flag
+	pps.u(1, 0) // bottom_field_pic_order_in_frame_present_flag
+	pps.ue(0)   // num_slice_groups_minus1
+	pps.ue(0)   // num_ref_idx_l0_default_active_minus1
+	pps.ue(0)   // num_ref_idx_l1_default_active_minus1
+	pps.u(1, 0) // weighted_pred_flag
+	pps.u(2, 0) // weighted_bipred_idc
+	pps.ue(0)   // pic_init_qp_minus26
+	pps.ue(0)   // pic_init_qs_minus26
+	pps.ue(0)   // chroma_qp_index_offset
+	pps.u(1, 1) // deblocking_filter_control_present_flag
+	pps.u(1, 0) // constrained_intra_pred_flag
+	pps.u(1, 0) // redundant_pic_cnt_present_flag
+	spsNALU, ppsNALU := sps.nalu(0x67), pps.nalu(0x68)
+
+	// access units by the size of their slice
+	type accessUnit struct {
+		idr   bool
+		size  int
+		lossy bool
+	}
+	aus := []accessUnit{
+		// a slice of a picture before the first keyframe
+		{false, 180, false},
+		// an IDR fragmented in 3 FU-A packets after a STAP-A of its
+		// SPS and PPS
+		{true, 3000, false},
+		{false, 140, false},
+		{false, 1500, false},
+		{false, 210, false},
+		// a slice that loses its middle fragment
+		{false, 2600, true},
+		{false, 190, false},
+		// an IDR small enough for the STAP-A of its SPS and PPS
+		{true, 700, false},
+		{false, 160, false},
+		{false, 1300, false},
+	}
+
+	s := newStream(0x1a2b3c4d, 102, 65531)
+	ts := uint32(0xffffa000)
+	var want bytes.Buffer
+	started := false
+	for _, au := range aus {
+		header := byte(0x41)
+		if au.idr {
+			header = 0x65
+		}
+		slice := frameData([]byte{header, 0x88, 0x84}, au.size)
+
+		nalus := [][]byte{slice}
+		if au.idr {
+			nalus = [][]byte{spsNALU, ppsNALU, slice}
+			started = true
+		}
+		if started && !au.lossy {
+			for _, n := range nalus {
+				want.Write([]byte{0, 0, 0, 1})
+				want.Write(n)
+			}
+		}
+
+		// aggregate the NAL units that fit in a STAP-A, fragment the rest
+		for len(nalus) > 0 {
+			size, n := 1, 0
+			for n < len(nalus) && size+2+len(nalus[n]) <= maxPayloadSize {
+				size += 2 + len(nalus[n])
+				n++
+			}
+			switch {
+			case n > 1:
+				stap := []byte{0x78}
+				for _, nalu := range nalus[:n] {
+					stap = append(stap, byte(len(nalu)>>8), byte(len(nalu)))
+					stap = append(stap, nalu...)
+				}
+				s.send(ts, n == len(nalus), stap)
+				nalus = nalus[n:]
+			case n == 1:
+				s.send(ts, len(nalus) == 1, nalus[0])
+				nalus = nalus[1:]
+			default:
+				nalu := nalus[0]
+				sizes := split(len(nalu)-1, maxPayloadSize-2)
+				offset := 1
+				for i, size := range sizes {
+					fu := []byte{nalu[0]&0xe0 | 28, nalu[0] & 0x1f}
+					if i == 0 {
+						fu[1] |= 0x80
+					}
+					if i == len(sizes)-1 {
+						fu[1] |= 0x40
+					}
+					if au.lossy && i == 1 {
+						s.lost[s.sent] = true
+					}
+					s.send(ts, len(nalus) == 1 && i == len(sizes)-1, append(fu, nalu[offset:offset+size]...))
+					offset += size
+				}
+				nalus = nalus[1:]
+			}
+		}
+		ts += frameTicks
+		s.ms += 33
+	}
+
+	check(ioutil.WriteFile(filepath.Join("testdata", "h264.rtpdump"), s.dump.Bytes(), 0644))
+	check(ioutil.WriteFile(filepath.Join("testdata", "h264.h264"), want.Bytes(), 0644))
+}
+
+// vp9 writes a stream of two spatial layers, 320x180 and 640x360, with
+// 15 bit picture ids, in the non-flexible mode with a scalability
+// structure on keyframes
+func vp9() {
+	type picture struct {
+		keyframe bool
+		sizes    [2]int
+		lossy    bool
+	}
+	pictures := []picture{
+		// a picture before the first keyframe
+		{false, [2]int{300, 700}, false},
+		// a keyframe of a 2 and a 3 packet layer frame
+		{true, [2]int{2000, 3200}, false},
+		{false, [2]int{320, 800}, false},
+		{false, [2]int{280, 1400}, false},
+		// the upper layer frame loses its middle packet
+		{false, [2]int{310, 2500}, true},
+		{false, [2]int{290, 760}, false},
+		{true, [2]int{1800, 2900}, false},
+		{false, [2]int{300, 820}, false},
+	}
+
+	s := newStream(0x5e6f7081, 98, 65533)
+	ts := uint32(0x7ffff000)
+	var frames bytes.Buffer
+	count := 0
+	firstTS, started := uint32(0), false
+	tl0 := byte(200)
+	for i, p := range pictures {
+		pid := uint16(32760 + i)
+		var layers [][]byte
+		for sid, size := range p.sizes {
+			// frame_marker, profile 0, the frame type, and show_frame on
+			// the top layer, then the sync code of keyframes, whose upper
+			// layer is predicted from the base one
+			header := []byte{0x80 | byte(sid)<<1}
+			if p.keyframe && sid == 0 {
+				header = append(header, 0x49, 0x83, 0x42, 0x00)
+			} else {
+				header[0] |= 0x04
+			}
+			layers = append(layers, frameData(header, size))
+		}
+
+		if p.keyframe && !started {
+			started = true
+			firstTS = ts
+		}
+		if started && !p.lossy {
+			frame := superframe(layers)
+			header := make([]byte, 12)
+			binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+			binary.LittleEndian.PutUint64(header[4:], uint64(ts-firstTS))
+			frames.Write(header)
+			frames.Write(frame)
+			count++
+		}
+
+		for sid, layer := range layers {
+			descriptor := func(first, last bool) []byte {
+				// I, L, B, E, V and P bits, the picture id, layer indices
+				// and TL0PICIDX
+				b := byte(0xa0)
+				if !p.keyframe {
+					b |= 0x40
+				}
+				if first {
+					b |= 0x08
+				}
+				if last {
+					b |= 0x04
+				}
+				ss := p.keyframe && sid == 0 && first
+				if ss {
+					b |= 0x02
+				}
+				layer := byte(sid) << 1
+				if sid > 0 {
+					layer |= 0x01
+				}
+				d := []byte{b, 0x80 | byte(pid>>8), byte(pid), layer, tl0}
+				if ss {
+					// N_S, Y and G, the size of each layer and a group
+					// of one picture
+					d = append(d, 0x38,
+						0x01, 0x40, 0x00, 0xb4,
+						0x02, 0x80, 0x01, 0x68,
+						0x01, 0x04, 0x01)
+				}
+				return d
+			}
+			sizes := split(len(layer), maxPayloadSize-len(descriptor(true, false)))
+			offset := 0
+			for j, size := range sizes {
+				first, last := j == 0, j == len(sizes)-1
+				if p.lossy && sid == 1 && j == 1 {
+					s.lost[s.sent] = true
+				}
+				payload := append(descriptor(first, last), layer[offset:offset+size]...)
+				s.send(ts, last && sid == len(layers)-1, payload)
+				offset += size
+			}
+		}
+		ts += frameTicks
+		s.ms += 33
+		tl0++
+	}
+
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], "VP90")
+	binary.LittleEndian.PutUint16(header[12:], 640)
+	binary.LittleEndian.PutUint16(header[14:], 360)
+	binary.LittleEndian.PutUint32(header[16:], 90000)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(count))
+
+	check(ioutil.WriteFile(filepath.Join("testdata", "vp9.rtpdump"), s.dump.Bytes(), 0644))
+	check(ioutil.WriteFile(filepath.Join("testdata", "vp9.ivf"), append(header, frames.Bytes()...), 0644))
+}
+
+// superframe packs the frames of a picture with the index of the VP9
+// bitstream spec, annex B, with 2 byte sizes
+func superframe(frames [][]byte) []byte {
+	marker := byte(0xc0 | 1<<3 | (len(frames) - 1))
+	var out []byte
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	out = append(out, marker)
+	for _, f := range frames {
+		out = append(out, byte(len(f)), byte(len(f)>>8))
+	}
+	return append(out, marker)
+}
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+	rand.Seed(1)
+	h264()
+	vp9()
+}
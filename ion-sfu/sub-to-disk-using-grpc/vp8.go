@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/pion/ion-log"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+)
+
+// vp8Writer skips packets too small for the ivf writer to parse
+type vp8Writer struct {
+	*ivfwriter.IVFWriter
+}
+
+func (w *vp8Writer) WriteRTP(pkt *rtp.Packet) error {
+	if len(pkt.Payload) < 4 {
+		log.Debugf("Ignore packet: payload is not large enough to ivf container header, %v", pkt)
+		return nil
+	}
+	return w.IVFWriter.WriteRTP(pkt)
+}
+
+// vp8Frames assembles the frames of a VP8 rtp stream, starting on the
+// first keyframe and dropping frames that lost a packet.
+type vp8Frames struct {
+	seenKeyFrame bool
+	lastSeq      uint16
+	started      bool
+
+	frame   []byte
+	inFrame bool
+
+	// resolution from the last keyframe header
+	width, height uint16
+}
+
+// push adds a packet, returning the frame it ends and whether that frame
+// is a keyframe
+func (a *vp8Frames) push(pkt *rtp.Packet) ([]byte, bool, error) {
+	if len(pkt.Payload) < 4 {
+		return nil, false, nil
+	}
+	vp8 := codecs.VP8Packet{}
+	if _, err := vp8.Unmarshal(pkt.Payload); err != nil {
+		return nil, false, err
+	}
+
+	gap := a.started && pkt.SequenceNumber != a.lastSeq+1
+	a.started = true
+	a.lastSeq = pkt.SequenceNumber
+	if gap {
+		// a frame with a lost packet can't be decoded
+		a.frame, a.inFrame = nil, false
+	}
+
+	if vp8.S == 1 && vp8.PID == 0 {
+		a.frame = append([]byte(nil), vp8.Payload...)
+		a.inFrame = true
+	} else if a.inFrame {
+		a.frame = append(a.frame, vp8.Payload...)
+	}
+	if !pkt.Marker || !a.inFrame {
+		return nil, false, nil
+	}
+
+	frame := a.frame
+	a.frame, a.inFrame = nil, false
+	// the P bit of the frame tag is clear for keyframes, RFC 6386 section 9.1
+	keyframe := len(frame) > 0 && frame[0]&0x01 == 0
+	if !keyframe && !a.seenKeyFrame {
+		return nil, false, nil
+	}
+	if keyframe {
+		a.seenKeyFrame = true
+		// a keyframe's tag is followed by the start code and resolution
+		if len(frame) >= 10 && frame[3] == 0x9d && frame[4] == 0x01 && frame[5] == 0x2a {
+			a.width = binary.LittleEndian.Uint16(frame[6:]) & 0x3fff
+			a.height = binary.LittleEndian.Uint16(frame[8:]) & 0x3fff
+		}
+	}
+	return frame, keyframe, nil
+}
+
+// vp8FrameStart reports whether a packet starts the first partition of
+// a frame
+func vp8FrameStart(pkt *rtp.Packet) bool {
+	vp8 := codecs.VP8Packet{}
+	if _, err := vp8.Unmarshal(pkt.Payload); err != nil {
+		return false
+	}
+	return vp8.S == 1 && vp8.PID == 0
+}
+
+// vp8Keyframe reports whether the P bit of a frame's tag is clear
+func vp8Keyframe(frame []*rtp.Packet) bool {
+	vp8 := codecs.VP8Packet{}
+	if _, err := vp8.Unmarshal(frame[0].Payload); err != nil {
+		return false
+	}
+	return len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	// ivf timestamps are in the 90kHz clock of the rtp timestamps
+	ivfTimebase = 90000
+	// maxSuperframeFrames is the most frames a superframe index holds
+	maxSuperframeFrames = 8
+)
+
+// vp9Writer depacketizes VP9 into an IVF file with the VP90 fourcc. It
+// starts on the first keyframe, and packs the frames of the spatial
+// layers of a picture into a superframe.
+type vp9Writer struct {
+	file *os.File
+
+	frames  vp9Frames
+	count   uint32
+	firstTS uint32
+}
+
+func newVP9Writer(name string) (*vp9Writer, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	w := &vp9Writer{file: f}
+	if err = w.writeHeader(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *vp9Writer) writeHeader() error {
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")                                // DKIF
+	binary.LittleEndian.PutUint16(header[4:], 0)            // Version
+	binary.LittleEndian.PutUint16(header[6:], 32)           // Header size
+	copy(header[8:], "VP90")                                // FOURCC
+	binary.LittleEndian.PutUint16(header[12:], 640)         // Width in pixels, set on the first picture
+	binary.LittleEndian.PutUint16(header[14:], 480)         // Height in pixels, set on the first picture
+	binary.LittleEndian.PutUint32(header[16:], ivfTimebase) // Timebase denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)           // Timebase numerator
+	binary.LittleEndian.PutUint32(header[24:], 0)           // Frame count, updated on Close
+	binary.LittleEndian.PutUint32(header[28:], 0)           // Unused
+	_, err := w.file.Write(header)
+	return err
+}
+
+// WriteRTP depacketizes a packet, writing the picture it ends
+func (w *vp9Writer) WriteRTP(pkt *rtp.Packet) error {
+	frame, _, err := w.frames.push(pkt)
+	if err != nil || frame == nil {
+		return err
+	}
+	if w.count == 0 {
+		// the first picture is a keyframe, which carries the resolution
+		w.firstTS = pkt.Timestamp
+		if err = w.writeSize(); err != nil {
+			return err
+		}
+	}
+	return w.writeFrame(frame, pkt.Timestamp-w.firstTS)
+}
+
+// writeSize sets the resolution in the header to the one of the stream,
+// when its scalability structure gave one
+func (w *vp9Writer) writeSize() error {
+	if w.frames.width == 0 || w.frames.height == 0 {
+		return nil
+	}
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint16(size[0:], w.frames.width)
+	binary.LittleEndian.PutUint16(size[2:], w.frames.height)
+	_, err := w.file.WriteAt(size, 12)
+	return err
+}
+
+func (w *vp9Writer) writeFrame(frame []byte, pts uint32) error {
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame))) // Frame length
+	binary.LittleEndian.PutUint64(header[4:], uint64(pts))        // PTS
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(frame); err != nil {
+		return err
+	}
+	w.count++
+	return nil
+}
+
+// Close updates the frame count and closes the file
+func (w *vp9Writer) Close() error {
+	if _, err := w.file.Seek(24, io.SeekStart); err == nil {
+		count := make([]byte, 4)
+		binary.LittleEndian.PutUint32(count, w.count)
+		if _, err = w.file.Write(count); err != nil {
+			_ = w.file.Close()
+			return err
+		}
+	}
+	return w.file.Close()
+}
+
+// vp9Frames assembles the pictures of a VP9 rtp stream, starting on the
+// first keyframe and dropping pictures that lost a packet.
+type vp9Frames struct {
+	seenKeyFrame bool
+	lastSeq      uint16
+	started      bool
+
+	// frames of the picture being assembled, the last one incomplete
+	frames   [][]byte
+	inFrame  bool
+	keyframe bool
+
+	// resolution of the top spatial layer, the one superframes are
+	// shown at, from the scalability structure
+	width, height uint16
+}
+
+// push adds a packet, returning the picture it ends packed in a
+// superframe, and whether that picture is a keyframe
+func (a *vp9Frames) push(pkt *rtp.Packet) ([]byte, bool, error) {
+	vp9 := codecs.VP9Packet{}
+	if _, err := vp9.Unmarshal(pkt.Payload); err != nil {
+		return nil, false, err
+	}
+	if vp9.V && vp9.Y && len(vp9.Width) > 0 {
+		top := len(vp9.Width) - 1
+		a.width, a.height = vp9.Width[top], vp9.Height[top]
+	}
+
+	gap := a.started && pkt.SequenceNumber != a.lastSeq+1
+	a.started = true
+	a.lastSeq = pkt.SequenceNumber
+	if gap {
+		// a frame with a lost packet can't be decoded
+		a.frames, a.inFrame = nil, false
+	}
+
+	if vp9.B {
+		// the base layer frame of a keyframe isn't inter predicted
+		keyframe := !vp9.P && vp9.SID == 0
+		if !a.seenKeyFrame && !keyframe {
+			return nil, false, nil
+		}
+		a.seenKeyFrame = true
+		if len(a.frames) == 0 {
+			a.keyframe = keyframe
+		}
+		a.frames = append(a.frames, nil)
+		a.inFrame = true
+	}
+	if !a.inFrame {
+		return nil, false, nil
+	}
+	last := len(a.frames) - 1
+	a.frames[last] = append(a.frames[last], vp9.Payload...)
+	if vp9.E {
+		a.inFrame = false
+	}
+
+	if !pkt.Marker {
+		return nil, false, nil
+	}
+	frames := a.frames
+	a.frames = nil
+	if a.inFrame {
+		// the picture ended in the middle of a frame
+		a.inFrame = false
+		frames = frames[:len(frames)-1]
+	}
+	if len(frames) == 0 {
+		return nil, false, nil
+	}
+	return superframe(frames), a.keyframe, nil
+}
+
+// superframe packs the frames of a picture with the superframe index of
+// the VP9 bitstream spec, annex B, a single frame is returned as is.
+func superframe(frames [][]byte) []byte {
+	if len(frames) == 1 {
+		return frames[0]
+	}
+	if len(frames) > maxSuperframeFrames {
+		frames = frames[:maxSuperframeFrames]
+	}
+
+	// bytes needed for the largest frame size
+	mag := 1
+	for _, f := range frames {
+		for mag < 4 && len(f) >= 1<<(8*uint(mag)) {
+			mag++
+		}
+	}
+
+	marker := byte(0xc0 | (mag-1)<<3 | (len(frames) - 1))
+	var out []byte
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	out = append(out, marker)
+	for _, f := range frames {
+		size := len(f)
+		for i := 0; i < mag; i++ {
+			out = append(out, byte(size>>(8*uint(i))))
+		}
+	}
+	return append(out, marker)
+}
+
+// vp9FrameStart reports whether a packet starts a picture
+func vp9FrameStart(pkt *rtp.Packet) bool {
+	vp9 := codecs.VP9Packet{}
+	if _, err := vp9.Unmarshal(pkt.Payload); err != nil {
+		return false
+	}
+	return vp9.B
+}
+
+// vp9Keyframe reports whether the base layer of a picture isn't inter
+// predicted
+func vp9Keyframe(frame []*rtp.Packet) bool {
+	vp9 := codecs.VP9Packet{}
+	if _, err := vp9.Unmarshal(frame[0].Payload); err != nil {
+		return false
+	}
+	return vp9.B && !vp9.P && vp9.SID == 0
+}
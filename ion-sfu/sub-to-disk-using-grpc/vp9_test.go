@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestVP9Writer(t *testing.T) {
+	packets := []struct {
+		seq     uint16
+		ts      uint32
+		marker  bool
+		payload []byte
+	}{
+		// an inter picture before the first keyframe is skipped
+		{9, 87000, true, []byte{0xec, 0x04, 0x00, 0x00, 0x99}},
+		// a keyframe of two spatial layers, the first packet with the
+		// scalability structure of 320x240 and 640x360 layers
+		{10, 90000, false, []byte{0xaa, 0x05, 0x00, 0x00, 0x30, 0x01, 0x40, 0x00, 0xf0, 0x02, 0x80, 0x01, 0x68, 0x82, 0x49, 0x83}},
+		{11, 90000, false, []byte{0xa4, 0x05, 0x00, 0x00, 0x11, 0x12}},
+		{12, 90000, true, []byte{0xac, 0x05, 0x02, 0x00, 0x21, 0x22, 0x23}},
+		// an inter picture of the base layer only
+		{13, 93000, true, []byte{0xec, 0x06, 0x00, 0x00, 0x31}},
+	}
+
+	name := filepath.Join(t.TempDir(), "test.ivf")
+	w, err := newVP9Writer(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range packets {
+		if err = w.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts, Marker: p.marker},
+			Payload: p.payload,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		// the file header, with the size of the top layer and 2 frames
+		'D', 'K', 'I', 'F', 0x00, 0x00, 0x20, 0x00,
+		'V', 'P', '9', '0', 0x80, 0x02, 0x68, 0x01,
+		0x90, 0x5f, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// the keyframe, a superframe of the 5 and 3 byte layer frames
+		0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x82, 0x49, 0x83, 0x11, 0x12, 0x21, 0x22, 0x23, 0xc1, 0x05, 0x03, 0xc1,
+		// the inter frame, 3000 ticks later
+		0x01, 0x00, 0x00, 0x00, 0xb8, 0x0b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x31,
+	}
+	got, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got\n% x\nwant\n% x", got, want)
+	}
+}
+
+func TestVP9WriterFixtures(t *testing.T) {
+	testFixtures(t, ".ivf", func(name string) (trackWriter, error) {
+		return newVP9Writer(name)
+	})
+}
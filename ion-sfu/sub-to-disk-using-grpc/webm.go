@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Matroska element ids, https://www.matroska.org/technical/elements.html
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+	idVoid               = 0xEC
+
+	idSegment            = 0x18538067
+	idSeekHead           = 0x114D9B74
+	idSeek               = 0x4DBB
+	idSeekID             = 0x53AB
+	idSeekPosition       = 0x53AC
+	idInfo               = 0x1549A966
+	idTimecodeScale      = 0x2AD7B1
+	idDuration           = 0x4489
+	idMuxingApp          = 0x4D80
+	idWritingApp         = 0x5741
+	idTracks             = 0x1654AE6B
+	idTrackEntry         = 0xAE
+	idTrackNumber        = 0xD7
+	idTrackUID           = 0x73C5
+	idTrackType          = 0x83
+	idCodecID            = 0x86
+	idCodecPrivate       = 0x63A2
+	idSeekPreRoll        = 0x56BB
+	idVideo              = 0xE0
+	idPixelWidth         = 0xB0
+	idPixelHeight        = 0xBA
+	idAudio              = 0xE1
+	idSamplingFrequency  = 0xB5
+	idChannels           = 0x9F
+	idCluster            = 0x1F43B675
+	idTimecode           = 0xE7
+	idSimpleBlock        = 0xA3
+	idCues               = 0x1C53BB6B
+	idCuePoint           = 0xBB
+	idCueTime            = 0xB3
+	idCueTrackPositions  = 0xB7
+	idCueTrack           = 0xF7
+	idCueClusterPosition = 0xF1
+)
+
+const (
+	// block timecodes are in milliseconds
+	webmTimecodeScale = 1000000
+	// the longest a cluster runs without a video keyframe, well within the
+	// int16 milliseconds of a block's relative timecode
+	maxClusterDuration = 5000
+	// how long the tracks of a stream are waited for before the tracks
+	// that joined are written and the recording starts, without video
+	// for an audio only stream
+	webmJoinWait = time.Second
+	// space kept after the segment header for the seek head written on
+	// Close, large enough for the Info, Tracks and Cues entries
+	seekHeadSpace = 100
+	// the Duration float and unknown Segment size are patched on Close
+	durationSize = 8
+	segmentSize  = 8
+
+	trackTypeVideo = 1
+	trackTypeAudio = 2
+
+	simpleBlockKeyframe = 0x80
+
+	// the highest number createFile gives a name taken by other files
+	maxFileNumber = 1000
+)
+
+var (
+	// unknownSegmentSize is an 8 byte vint with every value bit set
+	unknownSegmentSize = []byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	errWebMStarted = errors.New("webm recording already started")
+	errWebMCodec   = errors.New("codec can't be muxed into webm")
+)
+
+// frameAssembler turns the packets of a track into the frames stored in
+// a block
+type frameAssembler interface {
+	push(pkt *rtp.Packet) (frame []byte, keyframe bool, err error)
+}
+
+// opusFrames passes on Opus packets, each is a frame
+type opusFrames struct{}
+
+func (opusFrames) push(pkt *rtp.Packet) ([]byte, bool, error) {
+	if len(pkt.Payload) == 0 {
+		return nil, false, nil
+	}
+	return pkt.Payload, true, nil
+}
+
+// webmMuxer writes the Opus, VP8 and VP9 tracks of a stream to one WebM
+// file. Tracks are added until the recording starts, once the stream has
+// an audio and a video track or webmJoinWait passed, on the first video
+// keyframe, or the first audio frame without a video track. Frames before
+// that are dropped.
+//
+// Block timecodes come from the rtp timestamps of a track, offset by when
+// its first frame arrived after the recording started, so tracks with
+// unrelated rtp clocks line up. Clusters start on video keyframes, which
+// get a cue point, and are written whole, with their size, once the next
+// one starts.
+//
+// With a segment policy, the file is finalized once a segment is due,
+// and the next one started on a video keyframe, or any audio frame
+// without video, each listed in the manifest.
+type webmMuxer struct {
+	mu       sync.Mutex
+	name     string
+	created  time.Time
+	stream   string
+	fileName func(segment int) string
+	policy   segmentPolicy
+	manifest *manifest
+	segment  int
+
+	file    *os.File
+	tracks  []*webmTrack
+	open    int
+	started time.Time
+	closed  bool
+
+	// bytes written since the segment data started
+	offset      int64
+	segmentData int64
+	durationPos int64
+	infoPos     int64
+	tracksPos   int64
+
+	cluster     bytes.Buffer
+	clusterTime int64
+	inCluster   bool
+	cues        []webmCue
+	duration    int64
+}
+
+type webmCue struct {
+	time     int64
+	track    int
+	position int64
+}
+
+// newWebMMuxer returns the muxer of a stream, saved to the files fileName
+// returns for each segment, numbered from 1
+func newWebMMuxer(stream string, fileName func(segment int) string, policy segmentPolicy, m *manifest) *webmMuxer {
+	return &webmMuxer{
+		name:     fileName(1),
+		created:  time.Now(),
+		stream:   stream,
+		fileName: fileName,
+		policy:   policy,
+		manifest: m,
+		segment:  1,
+	}
+}
+
+// webmTrack is the trackWriter of a track muxed into a webmMuxer
+type webmTrack struct {
+	m      *webmMuxer
+	id     string
+	name   string
+	number int
+	codec  string
+	video  bool
+	clock  uint32
+	frames frameAssembler
+
+	begun   bool
+	base    int64
+	firstTS int64
+	lastTS  uint32
+	ts      int64
+}
+
+// addTrack adds a track to the recording, it fails once the tracks were
+// written or the last track closed
+func (m *webmMuxer) addTrack(track *webrtc.Track) (*webmTrack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file != nil || m.closed {
+		return nil, errWebMStarted
+	}
+
+	t := &webmTrack{
+		m:      m,
+		id:     track.ID(),
+		name:   track.Codec().Name,
+		number: len(m.tracks) + 1,
+		clock:  track.Codec().ClockRate,
+	}
+	switch track.Codec().Name {
+	case webrtc.Opus:
+		t.codec, t.frames = "A_OPUS", opusFrames{}
+	case webrtc.VP8:
+		t.codec, t.frames, t.video = "V_VP8", &vp8Frames{}, true
+	case webrtc.VP9:
+		t.codec, t.frames, t.video = "V_VP9", &vp9Frames{}, true
+	default:
+		return nil, errWebMCodec
+	}
+	if t.clock == 0 {
+		t.clock = 90000
+		if !t.video {
+			t.clock = 48000
+		}
+	}
+	m.tracks = append(m.tracks, t)
+	m.open++
+	return t, nil
+}
+
+// isClosed reports whether the last track closed the file
+func (m *webmMuxer) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// WriteRTP depacketizes a packet, writing the frame it ends
+func (t *webmTrack) WriteRTP(pkt *rtp.Packet) error {
+	frame, keyframe, err := t.frames.push(pkt)
+	if err != nil || frame == nil {
+		return err
+	}
+	return t.m.writeFrame(t, frame, keyframe, pkt.Timestamp)
+}
+
+// Close the track, the last one to close finalizes the file
+func (t *webmTrack) Close() error {
+	return t.m.closeTrack()
+}
+
+// hasVideo reports whether a video track was added
+func (m *webmMuxer) hasVideo() bool {
+	for _, t := range m.tracks {
+		if t.video {
+			return true
+		}
+	}
+	return false
+}
+
+// joined reports whether the tracks of the stream were waited for, they
+// can't be added once the recording started
+func (m *webmMuxer) joined() bool {
+	if time.Since(m.created) >= webmJoinWait {
+		return true
+	}
+	audio, video := false, false
+	for _, t := range m.tracks {
+		audio = audio || !t.video
+		video = video || t.video
+	}
+	return audio && video
+}
+
+// path returns the file being written
+func (m *webmMuxer) path() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.name
+}
+
+func (m *webmMuxer) writeFrame(t *webmTrack, frame []byte, keyframe bool, ts uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		if m.closed {
+			return nil
+		}
+		if !m.joined() || t.video && !keyframe || !t.video && m.hasVideo() {
+			return nil
+		}
+		if err := m.start(); err != nil {
+			return err
+		}
+	} else if m.policy.due(m.started, m.offset+int64(m.cluster.Len())) && (t.video && keyframe || !m.hasVideo()) {
+		if err := m.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// extend the rtp timestamp so it doesn't wrap
+	if !t.begun {
+		t.begun = true
+		t.base = int64(time.Since(m.started) / time.Millisecond)
+		t.lastTS = ts
+		t.firstTS, t.ts = int64(ts), int64(ts)
+	}
+	t.ts += int64(int32(ts - t.lastTS))
+	t.lastTS = ts
+	timecode := t.base + (t.ts-t.firstTS)*1000/int64(t.clock)
+
+	videoKeyframe := t.video && keyframe
+	rel := timecode - m.clusterTime
+	if !m.inCluster || videoKeyframe || rel > maxClusterDuration || rel < math.MinInt16 {
+		if err := m.flushCluster(); err != nil {
+			return err
+		}
+		m.inCluster = true
+		m.clusterTime = max64(timecode, 0)
+		m.cluster.Write(uintElement(idTimecode, uint64(m.clusterTime)))
+		rel = timecode - m.clusterTime
+		if videoKeyframe {
+			m.cues = append(m.cues, webmCue{time: m.clusterTime, track: t.number, position: m.offset})
+		}
+	}
+
+	flags := byte(0)
+	if keyframe {
+		flags = simpleBlockKeyframe
+	}
+	block := make([]byte, 0, 4+len(frame))
+	block = append(block, vint(uint64(t.number))...)
+	block = append(block, byte(uint16(int16(rel))>>8), byte(uint16(int16(rel))))
+	block = append(block, flags)
+	block = append(block, frame...)
+	m.cluster.Write(element(idSimpleBlock, block))
+
+	if timecode > m.duration {
+		m.duration = timecode
+	}
+	return nil
+}
+
+// start creates the file and writes the headers and tracks
+func (m *webmMuxer) start() error {
+	f, name, err := createFile(m.name)
+	if err != nil {
+		return err
+	}
+	m.file, m.name = f, name
+	m.started = time.Now()
+	m.offset = 0
+	m.cluster.Reset()
+	m.inCluster = false
+	m.cues = nil
+	m.duration = 0
+	for _, t := range m.tracks {
+		t.begun = false
+	}
+	if m.manifest != nil {
+		m.manifest.started(m.info())
+	}
+
+	header := master(idEBML,
+		uintElement(idEBMLVersion, 1),
+		uintElement(idEBMLReadVersion, 1),
+		uintElement(idEBMLMaxIDLength, 4),
+		uintElement(idEBMLMaxSizeLength, 8),
+		stringElement(idDocType, "webm"),
+		uintElement(idDocTypeVersion, 4),
+		uintElement(idDocTypeReadVersion, 2),
+	)
+	header = append(header, ebmlID(idSegment)...)
+	header = append(header, unknownSegmentSize...)
+	if err = m.write(header); err != nil {
+		return err
+	}
+	m.segmentData = m.offset
+	m.offset = 0
+
+	if err = m.write(void(seekHeadSpace)); err != nil {
+		return err
+	}
+
+	m.infoPos = m.offset
+	info := master(idInfo,
+		uintElement(idTimecodeScale, webmTimecodeScale),
+		stringElement(idMuxingApp, "ion-examples"),
+		stringElement(idWritingApp, "sub-to-disk-using-grpc"),
+		floatElement(idDuration, 0),
+	)
+	// the duration is the last element, its float is the end of Info
+	m.durationPos = m.offset + int64(len(info)) - durationSize
+	if err = m.write(info); err != nil {
+		return err
+	}
+
+	m.tracksPos = m.offset
+	var entries [][]byte
+	for _, t := range m.tracks {
+		entries = append(entries, t.entry())
+	}
+	return m.write(master(idTracks, entries...))
+}
+
+// entry returns the TrackEntry of a track
+func (t *webmTrack) entry() []byte {
+	children := [][]byte{
+		uintElement(idTrackNumber, uint64(t.number)),
+		uintElement(idTrackUID, uint64(t.number)),
+		stringElement(idCodecID, t.codec),
+	}
+	if !t.video {
+		return master(idTrackEntry, append(children,
+			uintElement(idTrackType, trackTypeAudio),
+			element(idCodecPrivate, opusHead()),
+			uintElement(idSeekPreRoll, 80000000),
+			master(idAudio,
+				floatElement(idSamplingFrequency, 48000),
+				uintElement(idChannels, 2),
+			),
+		)...)
+	}
+
+	width, height := uint16(640), uint16(480)
+	switch f := t.frames.(type) {
+	case *vp8Frames:
+		if f.width != 0 && f.height != 0 {
+			width, height = f.width, f.height
+		}
+	case *vp9Frames:
+		if f.width != 0 && f.height != 0 {
+			width, height = f.width, f.height
+		}
+	}
+	return master(idTrackEntry, append(children,
+		uintElement(idTrackType, trackTypeVideo),
+		master(idVideo,
+			uintElement(idPixelWidth, uint64(width)),
+			uintElement(idPixelHeight, uint64(height)),
+		),
+	)...)
+}
+
+// opusHead is the identification header of RFC 7845 section 5.1, the
+// CodecPrivate of an Opus track
+func opusHead() []byte {
+	head := make([]byte, 19)
+	copy(head[0:], "OpusHead")
+	head[8] = 1                                     // Version
+	head[9] = 2                                     // Channel count
+	binary.LittleEndian.PutUint16(head[10:], 0)     // Pre-skip
+	binary.LittleEndian.PutUint32(head[12:], 48000) // Input sample rate
+	binary.LittleEndian.PutUint16(head[16:], 0)     // Output gain
+	head[18] = 0                                    // Channel mapping family
+	return head
+}
+
+func (m *webmMuxer) write(b []byte) error {
+	n, err := m.file.Write(b)
+	m.offset += int64(n)
+	return err
+}
+
+// flushCluster writes the cluster being filled
+func (m *webmMuxer) flushCluster() error {
+	if !m.inCluster {
+		return nil
+	}
+	m.inCluster = false
+	err := m.write(element(idCluster, m.cluster.Bytes()))
+	m.cluster.Reset()
+	return err
+}
+
+func (m *webmMuxer) closeTrack() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.open--; m.open > 0 {
+		return nil
+	}
+	m.closed = true
+	if m.file == nil {
+		return nil
+	}
+	return m.closeFile()
+}
+
+// rotate finishes the segment being written and starts the next one
+func (m *webmMuxer) rotate() error {
+	if err := m.closeFile(); err != nil {
+		return err
+	}
+	m.segment++
+	m.name = m.fileName(m.segment)
+	return m.start()
+}
+
+// closeFile finalizes and closes the file, recording its end in the
+// manifest
+func (m *webmMuxer) closeFile() error {
+	err := m.finalize()
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	m.file = nil
+	if m.manifest != nil {
+		seg := m.info()
+		end := time.Now()
+		seg.End = &end
+		m.manifest.finished(seg)
+	}
+	return err
+}
+
+// info describes the file being written for the manifest
+func (m *webmMuxer) info() segmentInfo {
+	seg := segmentInfo{
+		File:      filepath.Base(m.name),
+		Recording: unsafeChars.ReplaceAllString(m.stream, "_"),
+		Stream:    m.stream,
+		Tracks:    []segmentTrack{},
+		Start:     m.started,
+		Bytes:     m.offset,
+	}
+	for _, t := range m.tracks {
+		if !t.begun {
+			continue
+		}
+		seg.Tracks = append(seg.Tracks, segmentTrack{
+			ID:                t.id,
+			Codec:             t.name,
+			StartRTPTimestamp: uint32(t.firstTS),
+			EndRTPTimestamp:   t.lastTS,
+		})
+	}
+	return seg
+}
+
+// finalize writes the last cluster and the cues, then fills in the seek
+// head, duration and segment size
+func (m *webmMuxer) finalize() error {
+	if err := m.flushCluster(); err != nil {
+		return err
+	}
+
+	seeks := [][]byte{seekEntry(idInfo, m.infoPos), seekEntry(idTracks, m.tracksPos)}
+	if len(m.cues) > 0 {
+		seeks = append(seeks, seekEntry(idCues, m.offset))
+		var points [][]byte
+		for _, c := range m.cues {
+			points = append(points, master(idCuePoint,
+				uintElement(idCueTime, uint64(c.time)),
+				master(idCueTrackPositions,
+					uintElement(idCueTrack, uint64(c.track)),
+					uintElement(idCueClusterPosition, uint64(c.position)),
+				),
+			))
+		}
+		if err := m.write(master(idCues, points...)); err != nil {
+			return err
+		}
+	}
+
+	seekHead := master(idSeekHead, seeks...)
+	seekHead = append(seekHead, void(seekHeadSpace-len(seekHead))...)
+	if _, err := m.file.WriteAt(seekHead, m.segmentData); err != nil {
+		return err
+	}
+
+	duration := make([]byte, durationSize)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(float64(m.duration)))
+	if _, err := m.file.WriteAt(duration, m.segmentData+m.durationPos); err != nil {
+		return err
+	}
+
+	size := make([]byte, segmentSize)
+	binary.BigEndian.PutUint64(size, uint64(m.offset))
+	size[0] = 0x01
+	_, err := m.file.WriteAt(size, m.segmentData-segmentSize)
+	return err
+}
+
+// createFile creates a file that doesn't exist yet, numbering its name
+// when one does, so recordings starting within the same second don't
+// truncate each other
+func createFile(name string) (*os.File, string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		n := name
+		if i > 1 {
+			n = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		f, err := os.OpenFile(n, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil || !os.IsExist(err) || i == maxFileNumber {
+			return f, n, err
+		}
+	}
+}
+
+// seekEntry points the seek head at a top level element, with a fixed
+// size position so the seek head size is known up front
+func seekEntry(id uint32, position int64) []byte {
+	pos := make([]byte, 8)
+	binary.BigEndian.PutUint64(pos, uint64(position))
+	return master(idSeek,
+		element(idSeekID, ebmlID(id)),
+		element(idSeekPosition, pos),
+	)
+}
+
+// ebmlID returns the bytes of an element id, which carries its own length
+func ebmlID(id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<16:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<8:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// vint encodes an element size or track number in the fewest bytes, the
+// value with every bit set is reserved for unknown sizes
+func vint(n uint64) []byte {
+	length := 1
+	for length < 8 && n >= 1<<(7*uint(length))-1 {
+		length++
+	}
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	b[0] |= 1 << (8 - uint(length))
+	return b
+}
+
+func element(id uint32, data []byte) []byte {
+	b := append(ebmlID(id), vint(uint64(len(data)))...)
+	return append(b, data...)
+}
+
+func master(id uint32, children ...[]byte) []byte {
+	return element(id, bytes.Join(children, nil))
+}
+
+func uintElement(id uint32, v uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, v)
+	for len(data) > 1 && data[0] == 0 {
+		data = data[1:]
+	}
+	return element(id, data)
+}
+
+func floatElement(id uint32, f float64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(f))
+	return element(id, data)
+}
+
+func stringElement(id uint32, s string) []byte {
+	return element(id, []byte(s))
+}
+
+// void returns a Void element taking up size bytes, from 2 to 128
+func void(size int) []byte {
+	return element(idVoid, make([]byte, size-2))
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
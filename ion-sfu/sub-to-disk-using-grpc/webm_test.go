@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// ebmlElement is an element parsed back from a WebM file, its offset is
+// from the start of the data of its parent
+type ebmlElement struct {
+	id       uint32
+	offset   int64
+	data     []byte
+	children []ebmlElement
+}
+
+// ebmlMasters are the elements parsed into children
+var ebmlMasters = map[uint32]bool{
+	idEBML: true, idSegment: true, idSeekHead: true, idSeek: true,
+	idInfo: true, idTracks: true, idTrackEntry: true, idVideo: true,
+	idAudio: true, idCluster: true, idCues: true, idCuePoint: true,
+	idCueTrackPositions: true,
+}
+
+func parseEBML(t *testing.T, b []byte) []ebmlElement {
+	t.Helper()
+	var elements []ebmlElement
+	for pos := 0; pos < len(b); {
+		idLen := vintLength(t, b[pos])
+		var id uint32
+		for _, c := range b[pos : pos+idLen] {
+			id = id<<8 | uint32(c)
+		}
+		sizeLen := vintLength(t, b[pos+idLen])
+		size := uint64(b[pos+idLen] & (0xff >> uint(sizeLen)))
+		for _, c := range b[pos+idLen+1 : pos+idLen+sizeLen] {
+			size = size<<8 | uint64(c)
+		}
+		start := pos + idLen + sizeLen
+		if size > uint64(len(b)-start) {
+			t.Fatalf("element %x at %d overruns its parent by %d bytes", id, pos, size-uint64(len(b)-start))
+		}
+		e := ebmlElement{id: id, offset: int64(pos), data: b[start : start+int(size)]}
+		if ebmlMasters[id] {
+			e.children = parseEBML(t, e.data)
+		}
+		elements = append(elements, e)
+		pos = start + int(size)
+	}
+	return elements
+}
+
+func vintLength(t *testing.T, b byte) int {
+	t.Helper()
+	for n := 1; n <= 8; n++ {
+		if b&(0x80>>uint(n-1)) != 0 {
+			return n
+		}
+	}
+	t.Fatal("invalid vint")
+	return 0
+}
+
+func (e ebmlElement) all(id uint32) []ebmlElement {
+	var found []ebmlElement
+	for _, c := range e.children {
+		if c.id == id {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+func (e ebmlElement) child(t *testing.T, id uint32) ebmlElement {
+	t.Helper()
+	found := e.all(id)
+	if len(found) != 1 {
+		t.Fatalf("element %x has %d children %x, want 1", e.id, len(found), id)
+	}
+	return found[0]
+}
+
+func (e ebmlElement) uint() uint64 {
+	var v uint64
+	for _, c := range e.data {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func TestWebMMuxer(t *testing.T) {
+	audio, err := webrtc.NewTrack(webrtc.DefaultPayloadTypeOpus, 1, "audio", "stream",
+		webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := webrtc.NewTrack(webrtc.DefaultPayloadTypeVP8, 2, "video", "stream",
+		webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(t.TempDir(), "test.webm")
+	m := newWebMMuxer("stream", func(int) string { return name }, segmentPolicy{}, nil)
+	a, err := m.addTrack(audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := m.addTrack(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a 320x240 keyframe, split in two packets
+	keyframe := [][]byte{
+		{0x10, 0x50, 0x01, 0x00, 0x9d, 0x01, 0x2a},
+		{0x00, 0x40, 0x01, 0xf0, 0x00, 0xaa, 0xab},
+	}
+	packets := []struct {
+		w       trackWriter
+		seq     uint16
+		ts      uint32
+		marker  bool
+		payload []byte
+	}{
+		// audio before the video keyframe is dropped
+		{a, 1, 48000, false, []byte{0xfc, 0x01}},
+		// the keyframe starts the file and the first cluster
+		{v, 1, 90000, false, keyframe[0]},
+		{v, 2, 90000, true, keyframe[1]},
+		{a, 2, 48960, false, []byte{0xfc, 0x02}},
+		{a, 3, 49920, false, []byte{0xfc, 0x03}},
+		{v, 3, 93000, true, []byte{0x10, 0x01, 0xbb, 0xcc}},
+		// the next keyframe, 2 seconds later, starts a cluster
+		{v, 4, 270000, false, keyframe[0]},
+		{v, 5, 270000, true, keyframe[1]},
+		{a, 4, 144960, false, []byte{0xfc, 0x04}},
+	}
+	for _, p := range packets {
+		if err = p.w.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts, Marker: p.marker},
+			Payload: p.payload,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := parseEBML(t, b)
+	if len(top) != 2 || top[0].id != idEBML || top[1].id != idSegment {
+		t.Fatalf("got %d top level elements, want the EBML header and a segment", len(top))
+	}
+	if docType := top[0].child(t, idDocType); string(docType.data) != "webm" {
+		t.Errorf("got doc type %q, want webm", docType.data)
+	}
+
+	segment := top[1]
+	var ids []uint32
+	positions := map[uint32]int64{}
+	for _, e := range segment.children {
+		ids = append(ids, e.id)
+		if _, ok := positions[e.id]; !ok {
+			positions[e.id] = e.offset
+		}
+	}
+	wantIDs := []uint32{idSeekHead, idVoid, idInfo, idTracks, idCluster, idCluster, idCues}
+	if len(ids) != len(wantIDs) {
+		t.Fatalf("got segment elements %x, want %x", ids, wantIDs)
+	}
+	for i := range ids {
+		if ids[i] != wantIDs[i] {
+			t.Fatalf("got segment elements %x, want %x", ids, wantIDs)
+		}
+	}
+
+	for _, seek := range segment.child(t, idSeekHead).all(idSeek) {
+		id := uint32(seek.child(t, idSeekID).uint())
+		if got := int64(seek.child(t, idSeekPosition).uint()); got != positions[id] {
+			t.Errorf("seek head points %x at %d, want %d", id, got, positions[id])
+		}
+	}
+
+	entries := segment.child(t, idTracks).all(idTrackEntry)
+	if len(entries) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(entries))
+	}
+	if codec := entries[0].child(t, idCodecID); string(codec.data) != "A_OPUS" {
+		t.Errorf("got first track %q, want A_OPUS", codec.data)
+	}
+	if codec := entries[1].child(t, idCodecID); string(codec.data) != "V_VP8" {
+		t.Errorf("got second track %q, want V_VP8", codec.data)
+	}
+	size := entries[1].child(t, idVideo)
+	if w, h := size.child(t, idPixelWidth).uint(), size.child(t, idPixelHeight).uint(); w != 320 || h != 240 {
+		t.Errorf("got video %dx%d, want 320x240", w, h)
+	}
+
+	// block timecodes are offset by when each track's first frame arrived
+	type block struct {
+		track    byte
+		timecode int64
+		keyframe bool
+		frame    byte
+	}
+	want := [][]block{{
+		{2, v.base, true, 0x50},
+		{1, a.base, true, 0xfc},
+		{1, a.base + 20, true, 0xfc},
+		{2, v.base + 33, false, 0x01},
+	}, {
+		{2, v.base + 2000, true, 0x50},
+		{1, a.base + 2000, true, 0xfc},
+	}}
+	clusters := segment.all(idCluster)
+	for i, cluster := range clusters {
+		timecode := int64(cluster.child(t, idTimecode).uint())
+		if timecode != want[i][0].timecode {
+			t.Errorf("got cluster %d at %d ms, want %d", i, timecode, want[i][0].timecode)
+		}
+		blocks := cluster.all(idSimpleBlock)
+		if len(blocks) != len(want[i]) {
+			t.Fatalf("got %d blocks in cluster %d, want %d", len(blocks), i, len(want[i]))
+		}
+		for j, b := range blocks {
+			got := block{
+				track:    b.data[0] &^ 0x80,
+				timecode: timecode + int64(int16(binary.BigEndian.Uint16(b.data[1:]))),
+				keyframe: b.data[3]&simpleBlockKeyframe != 0,
+				frame:    b.data[4],
+			}
+			if got != want[i][j] {
+				t.Errorf("got block %d of cluster %d %+v, want %+v", j, i, got, want[i][j])
+			}
+		}
+	}
+
+	points := segment.child(t, idCues).all(idCuePoint)
+	if len(points) != len(clusters) {
+		t.Fatalf("got %d cue points, want one per cluster", len(points))
+	}
+	for i, point := range points {
+		positions := point.child(t, idCueTrackPositions)
+		if got := int64(point.child(t, idCueTime).uint()); got != want[i][0].timecode {
+			t.Errorf("got cue %d at %d ms, want %d", i, got, want[i][0].timecode)
+		}
+		if got := positions.child(t, idCueTrack).uint(); got != 2 {
+			t.Errorf("got cue %d of track %d, want 2", i, got)
+		}
+		if got := int64(positions.child(t, idCueClusterPosition).uint()); got != clusters[i].offset {
+			t.Errorf("got cue %d at %d, want cluster at %d", i, got, clusters[i].offset)
+		}
+	}
+
+	duration := segment.child(t, idInfo).child(t, idDuration)
+	if got, want := math.Float64frombits(duration.uint()), float64(max64(v.base, a.base)+2000); got != want {
+		t.Errorf("got duration %v, want %v", got, want)
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.webm")
+	if err := ioutil.WriteFile(name, []byte("running"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, got, err := createFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if want := filepath.Join(filepath.Dir(name), "test-2.webm"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "running" {
+		t.Errorf("existing file was truncated to %q", b)
+	}
+	if _, err = os.Stat(got); err != nil {
+		t.Error(err)
+	}
+}